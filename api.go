@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keysPrefix is the route of the versioned key resource, the key follows it in the path.
+const keysPrefix = "/v1/keys/"
+
+// KeyResponse is the JSON body of a key returned by the /v1/keys API. Keys and values are
+// arbitrary bytes, so they are base64 encoded in JSON.
+type KeyResponse struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// KeyRequest is the JSON body of a PUT on /v1/keys/{key}, the value is base64 encoded.
+// TTL is in seconds and 0 means never.
+type KeyRequest struct {
+	Value []byte `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// ErrorResponse is the JSON body of the errors of the /v1/keys API.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// KeysHandler serves the key resource /v1/keys/{key}:
+// GET returns the value, as JSON or as the raw value when the client accepts application/octet-stream
+// or text/plain, HEAD returns the same headers without the body,
+// PUT sets the value from a JSON KeyRequest or from the raw body (with an optional ttl parameter in seconds)
+// and answers 201 when the key is created and 204 when it is replaced. An empty value is stored as such,
+// only DELETE removes a key.
+// DELETE deletes the key and answers 204.
+// A missing key is answered with 404 and a method that is not supported with 405.
+// PUT and DELETE honor the If-Match and If-None-Match headers like the old routes, and GET and HEAD
+// answer 304 when the If-None-Match header holds the ETag of the value.
+func KeysHandler(w http.ResponseWriter, r *http.Request, db Store) {
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), keysPrefix))
+	if err != nil || key == "" {
+		writeError(w, "key is missing or invalid", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		getKey(w, r, db, key)
+	case http.MethodPut:
+		putKey(w, r, db, key)
+	case http.MethodDelete:
+		deleteKey(w, r, db, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getKey(w http.ResponseWriter, r *http.Request, db Store, key string) {
+	value, err := db.Get([]byte(key))
+	if err == ErrKeynotfound {
+		writeError(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag(value))
+	if notModified(r, value) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	var body []byte
+	if contentType := rawType(r); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+		body = value
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(KeyResponse{Key: []byte(key), Value: value})
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func putKey(w http.ResponseWriter, r *http.Request, db Store, key string) {
+	var value []byte
+	var ttl int64
+	if isJSON(r.Header.Get("Content-Type")) {
+		var t KeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeError(w, "Error decoding JSON data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, ttl = t.Value, t.TTL
+	} else {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value = body
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			if ttl, err = strconv.ParseInt(s, 10, 64); err != nil {
+				writeError(w, "ttl must be a number of seconds", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if value == nil {
+		writeError(w, "value is missing", http.StatusBadRequest)
+		return
+	}
+	if ttl < 0 {
+		writeError(w, "ttl must not be negative", http.StatusBadRequest)
+		return
+	}
+	cond := preconditions(r)
+	existed := false
+	ok, err := db.PutIf([]byte(key), value, time.Duration(ttl)*time.Second, func(current []byte, found bool) bool {
+		existed = found
+		return cond == nil || cond(current, found)
+	})
+	if errors.Is(err, ErrReadOnly) {
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		writeError(w, ErrPrecondition.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	fmt.Printf("Sets key: %q value = %q\n", key, value)
+	w.Header().Set("ETag", etag(value))
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Location", keysPrefix+url.PathEscape(key))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func deleteKey(w http.ResponseWriter, r *http.Request, db Store, key string) {
+	var err error
+	if cond := preconditions(r); cond != nil {
+		var ok bool
+		ok, err = db.DeleteIf([]byte(key), cond)
+		if err == nil && !ok {
+			writeError(w, ErrPrecondition.Error(), http.StatusPreconditionFailed)
+			return
+		}
+	} else {
+		err = db.Delete([]byte(key))
+	}
+	if err == ErrKeynotfound {
+		writeError(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrReadOnly) {
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("the deleted key: %q\n", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rawType returns the content type of the raw value when the client asked for it instead of JSON,
+// and an empty string otherwise.
+func rawType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/json"):
+		return ""
+	case strings.Contains(accept, "application/octet-stream"):
+		return "application/octet-stream"
+	case strings.Contains(accept, "text/plain"):
+		return "text/plain; charset=utf-8"
+	}
+	return ""
+}
+
+// isJSON reports whether a Content-Type header is the one of a JSON body.
+func isJSON(contentType string) bool {
+	return strings.HasPrefix(strings.TrimSpace(contentType), "application/json")
+}
+
+// writeError answers the request with the status code and a JSON ErrorResponse.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+}
+
+// ScanResponse is the JSON body of a scan of the keys. Next is the start of the next page,
+// it is null when there are no more keys.
+type ScanResponse struct {
+	Keys []KeyResponse `json:"keys"`
+	Next []byte        `json:"next"`
+}
+
+// scanLimit is the number of keys of a page of a scan when the request does not set a limit.
+const scanLimit = 1000
+
+// ScanHandler serves GET /v1/keys, it lists the keys in [start, end) in ascending order with their values.
+// The start and end parameters are optional and limit is the largest number of keys returned, 1000 by default.
+func ScanHandler(w http.ResponseWriter, r *http.Request, db Store) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var start, end []byte
+	if query.Has("start") {
+		start = []byte(query.Get("start"))
+	}
+	if query.Has("end") {
+		end = []byte(query.Get("end"))
+	}
+	limit := scanLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	res := ScanResponse{Keys: []KeyResponse{}}
+	err := db.Scan(start, end, func(key, value []byte) bool {
+		if len(res.Keys) == limit {
+			// the next page starts right after the last key returned
+			last := res.Keys[len(res.Keys)-1].Key
+			res.Next = append(append(make([]byte, 0, len(last)+1), last...), 0)
+			return false
+		}
+		res.Keys = append(res.Keys, KeyResponse{Key: key, Value: value})
+		return true
+	})
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// BatchOp is one write of a BatchRequest: Op is "put", "delete" or "merge". Keys and values are base64 encoded,
+// Operator names the merge operator and an empty Family is the default column family.
+type BatchOp struct {
+	Op       string `json:"op"`
+	Key      []byte `json:"key"`
+	Value    []byte `json:"value,omitempty"`
+	TTL      int64  `json:"ttl,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Family   string `json:"family,omitempty"`
+}
+
+// BatchRequest is the JSON body of POST /v1/batch.
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+// BatchHandler serves POST /v1/batch, it applies the writes of a BatchRequest atomically with DB.Write
+// and answers 204. Deleting a key that does not exist is not an error in a batch.
+func BatchHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var t BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, "Error decoding JSON data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := &WriteBatch{}
+	for i, op := range t.Ops {
+		if len(op.Key) == 0 {
+			writeError(w, fmt.Sprintf("op %d: key is missing", i), http.StatusBadRequest)
+			return
+		}
+		switch op.Op {
+		case "put":
+			if op.TTL < 0 {
+				writeError(w, fmt.Sprintf("op %d: ttl must not be negative", i), http.StatusBadRequest)
+				return
+			}
+			b.PutWithTTL(op.Family, op.Key, op.Value, time.Duration(op.TTL)*time.Second)
+		case "delete":
+			b.Delete(op.Family, op.Key)
+		case "merge":
+			b.Merge(op.Family, op.Key, op.Operator, op.Value)
+		default:
+			writeError(w, fmt.Sprintf("op %d: unknown op %q", i, op.Op), http.StatusBadRequest)
+			return
+		}
+	}
+	err := db.Write(b)
+	if errors.Is(err, ErrFamilyNotFound) {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrReadOnly) {
+		writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Println("Writes batch of ", b.Len(), " ops")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StatsHandler serves GET /v1/stats, the storage statistics of the column families.
+func StatsHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(db.Stats())
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestKeysHandler(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	do := func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		KeysHandler(w, r, db)
+		return w
+	}
+	jsonBody := map[string]string{"Content-Type": "application/json"}
+
+	if w := do(http.MethodGet, "/v1/keys/a", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing key, but got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/v1/keys/a", `{"value": "MQ=="}`, jsonBody); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for a new key, but got %d", w.Code)
+	}
+	if w := do(http.MethodPut, "/v1/keys/a", "2", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a replaced key, but got %d", w.Code)
+	}
+
+	w := do(http.MethodGet, "/v1/keys/a", "", nil)
+	var res KeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected a JSON body, but got %d (%v)", w.Code, err)
+	}
+	if string(res.Key) != "a" || string(res.Value) != "2" {
+		t.Fatalf("Expected a=2, but got %+v", res)
+	}
+	if w := do(http.MethodGet, "/v1/keys/a", "", map[string]string{"Accept": "text/plain"}); w.Body.String() != "2" {
+		t.Fatalf("Expected the raw value 2, but got %q", w.Body.String())
+	}
+	tag := w.Header().Get("ETag")
+	if w := do(http.MethodHead, "/v1/keys/a", "", nil); w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("ETag") != tag {
+		t.Fatalf("Expected the headers of GET without a body, but got %d %q", w.Code, w.Body.String())
+	}
+
+	// keys can hold a slash when it is escaped
+	if w := do(http.MethodPut, "/v1/keys/dir%2Ffile", "x", nil); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, but got %d", w.Code)
+	}
+	if value, err := db.Get([]byte("dir/file")); err != nil || string(value) != "x" {
+		t.Fatalf("Expected value x, but got %s (%v)", value, err)
+	}
+
+	if w := do(http.MethodPut, "/v1/keys/a", "3", map[string]string{"If-Match": `"0"`}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412, but got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/v1/keys/a", "3", nil); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+		t.Fatalf("Expected 405 with an Allow header, but got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/v1/keys/a", "", map[string]string{"If-Match": tag}); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, but got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/v1/keys/a", "", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a deleted key, but got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	DefaultHandler(w, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown route, but got %d", w.Code)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	values := map[string][]byte{
+		"\x00\xff\x01key": {0x00, 0xff, 0xfe, '\n', 0x00},
+		"empty":           {},
+		"utf8":            []byte("héllo"),
+	}
+	for k, v := range values {
+		if err := db.Put([]byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(db *DB) {
+		t.Helper()
+		for k, v := range values {
+			value, err := db.Get([]byte(k))
+			if err != nil || !bytes.Equal(value, v) || value == nil {
+				t.Fatalf("Expected value %q for %q, but got %q (%v)", v, k, value, err)
+			}
+		}
+	}
+	check(db)
+	// the values go through the wal
+	db.Close()
+	db = openTestDB(t, dir)
+	check(db)
+	// and through the SSTables
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+
+	raw := make([]byte, 256)
+	for i := range raw {
+		raw[i] = byte(i)
+	}
+	r := httptest.NewRequest(http.MethodPut, "/v1/keys/%00%FF", bytes.NewReader(raw))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	KeysHandler(w, r, db)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, but got %d", w.Code)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/v1/keys/%00%FF", nil)
+	r.Header.Set("Accept", "application/octet-stream")
+	w = httptest.NewRecorder()
+	KeysHandler(w, r, db)
+	if !bytes.Equal(w.Body.Bytes(), raw) || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("Expected the raw bytes back, but got %q", w.Body.Bytes())
+	}
+	w = httptest.NewRecorder()
+	KeysHandler(w, httptest.NewRequest(http.MethodGet, "/v1/keys/%00%FF", nil), db)
+	var res KeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res.Key, []byte{0x00, 0xff}) || !bytes.Equal(res.Value, raw) {
+		t.Fatalf("Expected the base64 fields to decode to the bytes, but got %+v", res)
+	}
+
+	// an empty value is not a deletion
+	r = httptest.NewRequest(http.MethodPut, "/v1/keys/blank", strings.NewReader(`{"value": ""}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	KeysHandler(w, r, db)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for an empty value, but got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	KeysHandler(w, httptest.NewRequest(http.MethodHead, "/v1/keys/blank", nil), db)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the key with an empty value to exist, but got %d", w.Code)
+	}
+	r = httptest.NewRequest(http.MethodPut, "/v1/keys/blank", strings.NewReader(`{}`))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	KeysHandler(w, r, db)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a missing value, but got %d", w.Code)
+	}
+}
+
+func TestScanAndBatchHandlers(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	body := `{"ops": [
+		{"op": "put", "key": "YQ==", "value": "MQ=="},
+		{"op": "put", "key": "Yg==", "value": "Mg=="},
+		{"op": "put", "key": "Yw==", "value": "Mw=="},
+		{"op": "merge", "key": "bg==", "value": "NQ==", "operator": "add"},
+		{"op": "delete", "key": "eA=="}
+	]}`
+	w := httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body)), db)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, but got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	BatchHandler(w, httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(`{"ops": [{"op": "put", "key": "YQ==", "family": "missing"}]}`)), db)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing family, but got %d", w.Code)
+	}
+
+	scan := func(query string) ScanResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		ScanHandler(w, httptest.NewRequest(http.MethodGet, "/v1/keys?"+query, nil), db)
+		var res ScanResponse
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	res := scan("limit=2")
+	if len(res.Keys) != 2 || string(res.Keys[1].Key) != "b" || string(res.Next) != "b\x00" {
+		t.Fatalf("Expected the first page a, b, but got %+v", res)
+	}
+	res = scan("limit=2&start=" + url.QueryEscape(string(res.Next)))
+	if len(res.Keys) != 2 || string(res.Keys[0].Key) != "c" || string(res.Keys[1].Value) != "5" || res.Next != nil {
+		t.Fatalf("Expected the last page c, n, but got %+v", res)
+	}
+	if res := scan("start=b&end=c"); len(res.Keys) != 1 || string(res.Keys[0].Key) != "b" {
+		t.Fatalf("Expected only b, but got %+v", res)
+	}
+
+	w = httptest.NewRecorder()
+	StatsHandler(w, httptest.NewRequest(http.MethodGet, "/v1/stats", nil), db)
+	var stats []FamilyStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Name != defaultFamily || stats[0].MemtableKeys != 5 {
+		t.Fatalf("Expected the stats of the default family, but got %+v", stats)
+	}
+}
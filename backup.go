@@ -0,0 +1,569 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// A backup engine keeps incremental backups of a database in a backup directory:
+//
+//	shared/<sha256>.sst    the SSTables, named by the sha256 of their content and shared by the backups
+//	backups/<id>/BACKUP    the description of a backup: its SSTables, column families and wal
+//	backups/<id>/wal.log   the wal of the backup from its last watermark
+//
+// The SSTables are immutable, so a backup only adds the SSTables that no earlier backup has; the others are
+// recognized by their family, name, size, crc32 and sequence numbers without being read again, and a file
+// that repair rewrote under the same name is backed up again. A backup is taken like a checkpoint: the writes
+// are held while the new SSTables are linked, or copied if the backup directory is on another filesystem, into
+// a staging directory and the wal is read. After the writes resume they are copied to shared/, hashed on the
+// way, and synced: a file of shared/ is never a link to a file of the database, so damage to an SSTable of the
+// database does not reach the backups. The BACKUP file is written last, a backup without it was interrupted
+// and is ignored, and removed with the SSTables that only it had by the next CreateBackup or Prune.
+
+var (
+	// ErrBackupNotFound is returned for a backup id that is not in the backup directory.
+	ErrBackupNotFound = errors.New("backup not found")
+	// ErrBackupCorrupt is returned by Verify and Restore when a file of a backup is missing or has changed.
+	ErrBackupCorrupt = errors.New("backup is corrupt")
+)
+
+// BackupEngine creates, lists, verifies, prunes and restores the backups of a backup directory.
+// Its methods can be called concurrently, they run one at a time.
+type BackupEngine struct {
+	mu  sync.Mutex
+	dir string
+	fs  vfs.FS
+}
+
+// BackupInfo describes a backup, it is the content of its BACKUP file.
+type BackupInfo struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+	// Size is the size of the SSTables and the wal of the backup, the SSTables may be shared with other backups
+	Size         int64                    `json:"size"`
+	Families     map[string]FamilyOptions `json:"families"`
+	LastSequence int64                    `json:"last_sequence"`
+	Files        []BackupFile             `json:"files"`
+	WALSize      int64                    `json:"wal_size"`
+	WALHash      string                   `json:"wal_sha256"`
+}
+
+// BackupFile is an SSTable of a backup with what the manifest of the restored database records for it.
+type BackupFile struct {
+	Family      string `json:"family"`
+	Name        string `json:"name"`
+	Hash        string `json:"sha256"`
+	Size        int64  `json:"size"`
+	Checksum    uint32 `json:"crc32"`
+	Level       int    `json:"level"`
+	SmallestSeq int64  `json:"smallest_seq"`
+	LargestSeq  int64  `json:"largest_seq"`
+	SmallestKey []byte `json:"smallest_key"`
+	LargestKey  []byte `json:"largest_key"`
+}
+
+// OpenBackupEngine opens the backup directory dir on the filesystem fs, the one of the operating system if it
+// is nil, and creates it if needed. The databases it backs up must be on the same filesystem.
+func OpenBackupEngine(dir string, fs vfs.FS) (*BackupEngine, error) {
+	if fs == nil {
+		fs = vfs.Default
+	}
+	for _, sub := range []string{"shared", "backups"} {
+		if err := fs.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &BackupEngine{dir: dir, fs: fs}, nil
+}
+
+// dedupKey identifies an SSTable of the database for the backups that follow the one that copied it.
+func (f BackupFile) dedupKey() string {
+	return fmt.Sprintf("%s/%s/%d/%08x/%d-%d", f.Family, f.Name, f.Size, f.Checksum, f.SmallestSeq, f.LargestSeq)
+}
+
+func (e *BackupEngine) sharedPath(hash string) string {
+	return filepath.Join(e.dir, "shared", hash+".sst")
+}
+
+func (e *BackupEngine) backupPath(id int) string {
+	return filepath.Join(e.dir, "backups", fmt.Sprintf("%06d", id))
+}
+
+// CreateBackup backs up the database and returns the description of the new backup.
+func (e *BackupEngine) CreateBackup(db *DB) (*BackupInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if db.fs != e.fs {
+		return nil, errors.New("backup: the database is on another filesystem than the backup directory")
+	}
+	backups, err := e.cleanup()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]string{}
+	id := 1
+	for _, b := range backups {
+		for _, f := range b.Files {
+			known[f.dedupKey()] = f.Hash
+		}
+		id = b.ID + 1
+	}
+	staging := filepath.Join(e.dir, "tmp")
+	if err := e.fs.MkdirAll(staging, 0755); err != nil {
+		return nil, err
+	}
+	defer e.fs.RemoveAll(staging)
+
+	info := &BackupInfo{ID: id, Time: now().UTC(), Families: map[string]FamilyOptions{}}
+	// staged are the new SSTables in the staging directory, by their index in info.Files
+	staged := map[int]string{}
+	var wal []byte
+	err = func() error {
+		// the writes are held, so the live files and the wal are those of the same moment
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		for name, cf := range db.families {
+			if name != defaultFamily {
+				info.Families[name] = cf.opts
+			}
+			for _, sstable := range cf.sst.sstables {
+				stat, err := db.fs.Stat(sstable.name)
+				if err != nil {
+					return err
+				}
+				f := BackupFile{
+					Family:      name,
+					Name:        filepath.Base(sstable.name),
+					Size:        stat.Size(),
+					Checksum:    uint32(sstable.checksum),
+					Level:       sstable.level,
+					SmallestSeq: sstable.smallestSeq,
+					LargestSeq:  sstable.largestSeq,
+					SmallestKey: sstable.smallestKey,
+					LargestKey:  sstable.largestKey,
+				}
+				hash, ok := known[f.dedupKey()]
+				if ok {
+					_, err := e.fs.Stat(e.sharedPath(hash))
+					ok = err == nil
+				}
+				if ok {
+					f.Hash = hash
+				} else {
+					path := filepath.Join(staging, fmt.Sprintf("%d.sst", len(info.Files)))
+					if err := linkOrCopy(db.fs, sstable.name, path); err != nil {
+						return err
+					}
+					staged[len(info.Files)] = path
+				}
+				info.Files = append(info.Files, f)
+			}
+		}
+		info.LastSequence = db.manifest.lastSequence
+		var err error
+		wal, err = db.wal.tail(db.manifest.walOffsets)
+		return err
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, path := range staged {
+		// the staged file may be a link to the SSTable of the database, the copy has blocks of its own
+		copied := path + ".copy"
+		hash, err := copyHashed(e.fs, path, copied)
+		if err != nil {
+			return nil, err
+		}
+		info.Files[i].Hash = hash
+		// the same content may have been backed up under another name
+		if _, err := e.fs.Stat(e.sharedPath(hash)); err == nil {
+			continue
+		}
+		if err := e.fs.Rename(copied, e.sharedPath(hash)); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.fs.Sync(filepath.Join(e.dir, "shared")); err != nil {
+		return nil, err
+	}
+	dir := e.backupPath(id)
+	if err := e.fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(e.fs, filepath.Join(dir, "wal.log"), wal); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(wal)
+	info.WALHash = hex.EncodeToString(sum[:])
+	info.WALSize = int64(len(wal))
+	info.Size = info.WALSize
+	for _, f := range info.Files {
+		info.Size += f.Size
+	}
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// the backup exists once its BACKUP file is written
+	if err := writeFileAtomic(e.fs, filepath.Join(dir, "BACKUP"), content); err != nil {
+		return nil, err
+	}
+	if err := e.fs.Sync(filepath.Join(e.dir, "backups")); err != nil {
+		return nil, err
+	}
+	fmt.Println("Creates backup: ", id, " with ", len(staged), " new sstables of ", len(info.Files))
+	return info, nil
+}
+
+// Backups returns the backups of the directory from the oldest to the newest.
+func (e *BackupEngine) Backups() ([]*BackupInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	backups, _, err := e.backups()
+	return backups, err
+}
+
+// backups returns the backups of the directory and the directories of the interrupted ones.
+func (e *BackupEngine) backups() ([]*BackupInfo, []string, error) {
+	entries, err := e.fs.ReadDir(filepath.Join(e.dir, "backups"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var backups []*BackupInfo
+	var interrupted []string
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		info, err := e.info(id)
+		if errors.Is(err, ErrBackupNotFound) {
+			interrupted = append(interrupted, filepath.Join(e.dir, "backups", entry.Name()))
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		backups = append(backups, info)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ID < backups[j].ID })
+	return backups, interrupted, nil
+}
+
+// info reads the BACKUP file of a backup.
+func (e *BackupEngine) info(id int) (*BackupInfo, error) {
+	content, err := vfs.ReadFile(e.fs, filepath.Join(e.backupPath(id), "BACKUP"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %d", ErrBackupNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info BackupInfo
+	if err := json.Unmarshal(content, &info); err != nil {
+		return nil, fmt.Errorf("%w: backup %d: %v", ErrBackupCorrupt, id, err)
+	}
+	return &info, nil
+}
+
+// Prune deletes the oldest backups so that keep of them remain, and the SSTables that no backup uses anymore.
+func (e *BackupEngine) Prune(keep int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if keep < 0 {
+		return errors.New("backup: the number of backups to keep must not be negative")
+	}
+	backups, _, err := e.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		dir := e.backupPath(backups[0].ID)
+		// without its BACKUP file the backup is gone, even if the rest of the directory is left by a crash
+		if err := e.fs.Remove(filepath.Join(dir, "BACKUP")); err != nil {
+			return err
+		}
+		if err := e.fs.RemoveAll(dir); err != nil {
+			return err
+		}
+		fmt.Println("Deletes backup: ", backups[0].ID)
+		backups = backups[1:]
+	}
+	_, err = e.cleanup()
+	return err
+}
+
+// cleanup deletes what the interrupted backups left and the SSTables that no backup uses, and returns the backups.
+func (e *BackupEngine) cleanup() ([]*BackupInfo, error) {
+	backups, interrupted, err := e.backups()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range interrupted {
+		if err := e.fs.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.fs.RemoveAll(filepath.Join(e.dir, "tmp")); err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, b := range backups {
+		for _, f := range b.Files {
+			used[f.Hash+".sst"] = true
+		}
+	}
+	entries, err := e.fs.ReadDir(filepath.Join(e.dir, "shared"))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !used[entry.Name()] {
+			if err := e.fs.Remove(filepath.Join(e.dir, "shared", entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return backups, nil
+}
+
+// Verify checks that every file of the backup is there with the size and the sha256 it was backed up with.
+func (e *BackupEngine) Verify(id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	info, err := e.info(id)
+	if err != nil {
+		return err
+	}
+	check := func(path, hash string, size int64) error {
+		got, n, err := hashFile(e.fs, path)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s is missing", ErrBackupCorrupt, path)
+		}
+		if err != nil {
+			return err
+		}
+		if n != size || got != hash {
+			return fmt.Errorf("%w: %s has changed", ErrBackupCorrupt, path)
+		}
+		return nil
+	}
+	for _, f := range info.Files {
+		if err := check(e.sharedPath(f.Hash), f.Hash, f.Size); err != nil {
+			return err
+		}
+	}
+	return check(filepath.Join(e.backupPath(id), "wal.log"), info.WALHash, info.WALSize)
+}
+
+// Restore writes the database of the backup to dir, which must not exist, so that Open(dir) opens it.
+// The files are checked against their sha256 while they are copied.
+func (e *BackupEngine) Restore(id int, dir string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	info, err := e.info(id)
+	if err != nil {
+		return err
+	}
+	if _, err := e.fs.Stat(dir); err == nil {
+		return fmt.Errorf("restore: %w: %s", os.ErrExist, dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := e.restore(info, dir); err != nil {
+		// a partial restore is of no use
+		e.fs.RemoveAll(dir)
+		return err
+	}
+	fmt.Println("Restores backup: ", id, " to ", dir)
+	return nil
+}
+
+func (e *BackupEngine) restore(info *BackupInfo, dir string) error {
+	db := &DB{dir: dir, fs: e.fs}
+	m := &manifest{dir: dir, fs: e.fs, files: map[string][]*SStable{}, lastSequence: info.LastSequence}
+	if err := e.fs.MkdirAll(db.familyPath(defaultFamily), 0755); err != nil {
+		return err
+	}
+	for name := range info.Families {
+		if err := e.fs.MkdirAll(db.familyPath(name), 0755); err != nil {
+			return err
+		}
+	}
+	for _, f := range info.Files {
+		path := filepath.Join(db.familyPath(f.Family), f.Name)
+		if err := e.copyChecked(e.sharedPath(f.Hash), path, f.Hash); err != nil {
+			return err
+		}
+		m.files[f.Family] = append(m.files[f.Family], &SStable{
+			name:        f.Name,
+			level:       f.Level,
+			smallestSeq: f.SmallestSeq,
+			largestSeq:  f.LargestSeq,
+			smallestKey: f.SmallestKey,
+			largestKey:  f.LargestKey,
+		})
+	}
+	for name := range m.files {
+		if err := e.fs.Sync(db.familyPath(name)); err != nil {
+			return err
+		}
+	}
+	if len(info.Families) > 0 {
+		if err := e.fs.Sync(filepath.Join(dir, "families")); err != nil {
+			return err
+		}
+	}
+	wal, err := vfs.ReadFile(e.fs, filepath.Join(e.backupPath(info.ID), "wal.log"))
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(wal); hex.EncodeToString(sum[:]) != info.WALHash {
+		return fmt.Errorf("%w: the wal of backup %d has changed", ErrBackupCorrupt, info.ID)
+	}
+	return writeMetadata(m, info.Families, wal)
+}
+
+// copyChecked copies the file of the backup to name, syncs the copy and checks the sha256 of the content.
+func (e *BackupEngine) copyChecked(file, name, hash string) error {
+	got, err := copyHashed(e.fs, file, name)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s is missing", ErrBackupCorrupt, file)
+	}
+	if err != nil {
+		return err
+	}
+	if got != hash {
+		return fmt.Errorf("%w: %s has changed", ErrBackupCorrupt, file)
+	}
+	return nil
+}
+
+// copyHashed copies file to name, syncs the copy and returns the sha256 of the content in hexadecimal.
+func copyHashed(fs vfs.FS, file, name string) (string, error) {
+	src, err := fs.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := fs.Create(name)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, h), src); err != nil {
+		dst.Close()
+		return "", err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile returns the sha256 of the content of the file in hexadecimal and its size.
+func hashFile(fs vfs.FS, name string) (string, int64, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// The backup command administers a backup directory without the server:
+//
+//	kvstore backup create DATADIR BACKUPDIR
+//	kvstore backup list BACKUPDIR
+//	kvstore backup verify BACKUPDIR ID
+//	kvstore backup prune -keep N BACKUPDIR
+//	kvstore backup restore BACKUPDIR ID DIR
+//
+// create opens the database, so it fails while a server uses it; a running server creates its backups
+// on POST /admin/backup.
+func backup(args []string, out io.Writer) error {
+	usage := errors.New("usage: kvstore backup create DATADIR BACKUPDIR | list BACKUPDIR | verify BACKUPDIR ID | prune -keep N BACKUPDIR | restore BACKUPDIR ID DIR")
+	if len(args) == 0 {
+		return usage
+	}
+	fs := flag.NewFlagSet("backup "+args[0], flag.ContinueOnError)
+	keep := fs.Int("keep", -1, "number of backups to keep, the newest ones")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	want := map[string]int{"create": 2, "list": 1, "verify": 2, "prune": 1, "restore": 3}[args[0]]
+	if want == 0 || fs.NArg() != want || (args[0] == "prune") != (*keep >= 0) {
+		return usage
+	}
+	backupDir := fs.Arg(0)
+	if args[0] == "create" {
+		backupDir = fs.Arg(1)
+	}
+	e, err := OpenBackupEngine(backupDir, nil)
+	if err != nil {
+		return err
+	}
+	id := 0
+	if args[0] == "verify" || args[0] == "restore" {
+		if id, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			return fmt.Errorf("backup: invalid id %q", fs.Arg(1))
+		}
+	}
+	switch args[0] {
+	case "create":
+		db, err := Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		info, err := e.CreateBackup(db)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "backup %d: %d sstables, %d bytes\n", info.ID, len(info.Files), info.Size)
+	case "list":
+		backups, err := e.Backups()
+		if err != nil {
+			return err
+		}
+		for _, b := range backups {
+			fmt.Fprintf(out, "%d\t%s\t%d sstables\t%d bytes\n", b.ID, b.Time.Format(time.RFC3339), len(b.Files), b.Size)
+		}
+	case "verify":
+		if err := e.Verify(id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "backup %d: ok\n", id)
+	case "prune":
+		return e.Prune(*keep)
+	case "restore":
+		if err := e.Restore(id, fs.Arg(2)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "backup %d restored to %s\n", id, fs.Arg(2))
+	}
+	return nil
+}
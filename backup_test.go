@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBackupEngine(t *testing.T) {
+	dir := t.TempDir()
+	backupDir := filepath.Join(t.TempDir(), "backups")
+	db := openTestDB(t, dir)
+	users, err := db.CreateColumnFamily("users", FamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := OpenBackupEngine(backupDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := func() int {
+		entries, _ := os.ReadDir(filepath.Join(backupDir, "shared"))
+		return len(entries)
+	}
+
+	db.Put([]byte("k"), []byte("v1"))
+	users.Put([]byte("u"), []byte("v1"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.CreateBackup(db); err != nil {
+		t.Fatal(err)
+	}
+	if shared() != 2 {
+		t.Fatalf("Expected the 2 sstables in the backup, but found %d", shared())
+	}
+	// the second backup only adds the new sstable, the third one only has a wal
+	db.Put([]byte("k"), []byte("v2"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.CreateBackup(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("w"), []byte("wal"))
+	info, err := e.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared() != 3 || len(info.Files) != 3 || info.WALSize == 0 {
+		t.Fatalf("Expected 3 shared sstables and a wal, but got %d shared and %+v", shared(), info)
+	}
+	// the compaction replaces the sstables of the default family
+	for i := 0; i < maxFiles; i++ {
+		db.Put([]byte(fmt.Sprintf("later%d", i)), []byte("after"))
+		if err := FlushToDisk(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := e.CreateBackup(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Prune(2); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := e.Backups()
+	if err != nil || len(backups) != 2 || backups[0].ID != 3 || backups[1].ID != 4 {
+		t.Fatalf("Expected the backups 3 and 4 to be kept, but got %v (%v)", backups, err)
+	}
+	used := map[string]bool{}
+	for _, b := range backups {
+		for _, f := range b.Files {
+			used[f.Hash] = true
+		}
+	}
+	if shared() != len(used) {
+		t.Fatalf("Expected the sstables of the pruned backups to be deleted, but found %d for %d", shared(), len(used))
+	}
+	if err := e.Verify(3); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored")
+	if err := e.Restore(3, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Restore(3, restored); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Expected the restore to refuse an existing directory, but got %v", err)
+	}
+	if err := e.Restore(1, filepath.Join(t.TempDir(), "pruned")); !errors.Is(err, ErrBackupNotFound) {
+		t.Fatalf("Expected ErrBackupNotFound for a pruned backup, but got %v", err)
+	}
+	rdb := openTestDB(t, restored)
+	for key, want := range map[string]string{"k": "v2", "w": "wal"} {
+		if value, err := rdb.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s for %s in the restored database, but got %s (%v)", want, key, value, err)
+		}
+	}
+	if _, err := rdb.Get([]byte("later0")); err != ErrKeynotfound {
+		t.Fatalf("Expected the writes after the backup to be missing, but got %v", err)
+	}
+	rusers, err := rdb.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := rusers.Get([]byte("u")); err != nil || string(value) != "v1" {
+		t.Fatalf("Expected the family to be restored, but got %s (%v)", value, err)
+	}
+
+	// a shared sstable that changed is found by Verify, and the database keeps its own copy
+	f := backups[1].Files[0]
+	name := filepath.Join(backupDir, "shared", f.Hash+".sst")
+	live, err := os.Stat(filepath.Join(db.familyPath(f.Family), f.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backedUp, err := os.Stat(name); err != nil || os.SameFile(live, backedUp) {
+		t.Fatalf("Expected the backup to hold a copy of %s, not a link (%v)", f.Name, err)
+	}
+	os.WriteFile(name, []byte("garbage"), 0644)
+	if live, err := os.Stat(filepath.Join(db.familyPath(f.Family), f.Name)); err != nil || live.Size() != f.Size {
+		t.Fatalf("Expected the sstable of the database to be left as it was, but got %v", err)
+	}
+	if err := e.Verify(4); !errors.Is(err, ErrBackupCorrupt) {
+		t.Fatalf("Expected ErrBackupCorrupt, but got %v", err)
+	}
+	if err := e.Restore(4, filepath.Join(t.TempDir(), "corrupt")); !errors.Is(err, ErrBackupCorrupt) {
+		t.Fatalf("Expected the restore of a corrupt backup to fail, but got %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := backup([]string{"list", backupDir}, &out); err != nil || strings.Count(out.String(), "\n") != 2 {
+		t.Fatalf("Expected the 2 backups to be listed, but got %v\n%s", err, out.String())
+	}
+	rec := httptest.NewRecorder()
+	BackupHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/backup?keep=1", nil), db, e)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	BackupHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/backup", nil), db, e)
+	var listed []*BackupInfo
+	if err := json.NewDecoder(rec.Body).Decode(&listed); err != nil || len(listed) != 1 || listed[0].ID != 5 {
+		t.Fatalf("Expected only the new backup to be kept, but got %v (%v)", listed, err)
+	}
+}
+
+func TestBackupRewrittenSStable(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	e, err := OpenBackupEngine(filepath.Join(t.TempDir(), "backups"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("k"), []byte("v1"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	first, err := e.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// the sstable is rewritten under the same name and size with another content, as repair may do
+	name := filepath.Join(db.familyPath(defaultFamily), first.Files[0].Name)
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = bytes.Replace(content, []byte("v1"), []byte("v9"), 1)
+	copy(content[len(content)-4:], encodeInt(int(crc32.ChecksumIEEE(content[:len(content)-4]))))
+	if err := os.WriteFile(name, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, dir)
+	second, err := e.CreateBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Files[0].Name != first.Files[0].Name || second.Files[0].Hash == first.Files[0].Hash {
+		t.Fatalf("Expected the rewritten sstable to be backed up again, but got %+v after %+v", second.Files[0], first.Files[0])
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	if err := e.Restore(second.ID, restored); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := openTestDB(t, restored).Get([]byte("k")); err != nil || string(value) != "v9" {
+		t.Fatalf("Expected v9 in the restored database, but got %s (%v)", value, err)
+	}
+}
+
+func TestBackupConcurrent(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte("w"), 10<<10))
+	}
+	// backups to two engines and checkpoints read the wal at the same time, each of them gets all of it
+	var engines []*BackupEngine
+	for i := 0; i < 2; i++ {
+		e, err := OpenBackupEngine(filepath.Join(t.TempDir(), "backups"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		engines = append(engines, e)
+	}
+	base := t.TempDir()
+	var wg sync.WaitGroup
+	infos := make([]*BackupInfo, len(engines))
+	errs := make([]error, len(engines)+8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i < len(engines) {
+				infos[i], errs[i] = engines[i].CreateBackup(db)
+				return
+			}
+			errs[i] = db.Checkpoint(filepath.Join(base, fmt.Sprint(i)))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, e := range engines {
+		restored := filepath.Join(t.TempDir(), "restored")
+		if err := e.Restore(infos[i].ID, restored); err != nil {
+			t.Fatal(err)
+		}
+		rdb := openTestDB(t, restored)
+		for k := 0; k < 200; k++ {
+			if _, err := rdb.Get([]byte(fmt.Sprintf("k%03d", k))); err != nil {
+				t.Fatalf("Expected k%03d in the backup %d, but got %v", k, i, err)
+			}
+		}
+		rdb.Close()
+	}
+}
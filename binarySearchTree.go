@@ -13,6 +13,17 @@ type Node struct {
 	Left  *Node
 	Right *Node
 	Parent *Node
+	// operands are merge operands applied, oldest first, on top of the value of the node.
+	// If unresolved is set, the value they apply to is not in this tree but in older data.
+	operands   []operand
+	unresolved bool
+	// expiresAt is the time in unix nanoseconds after which the value is gone, 0 if it never expires
+	expiresAt int64
+}
+
+// expired reports whether the value of the node has outlived its TTL at the given time.
+func (n *Node) expired(now int64) bool {
+	return n.expiresAt != 0 && now >= n.expiresAt
 }
 type Tree struct {
 	Root *Node
@@ -24,9 +35,13 @@ func (n *Node) Set(key, value []byte) error {
 		return errors.New("cannot insert a value into a nil tree")
 	}
 	switch {
-	//if the keys are equal we update the value
+	//if the keys are equal we update the value, which also overrides a previous deletion or merge
 	case bytes.Equal(key, n.Key): 
 		n.Value = value
+		n.marker = true
+		n.operands = nil
+		n.unresolved = false
+		n.expiresAt = 0
 		return nil
 	//if the key is less than the current node key we search in the left subtree
 	case bytes.Compare(key, n.Key) == -1:
@@ -54,7 +69,10 @@ func (n *Node) Get(key []byte) ([]byte, error) {
 	}
 	switch {
 	case bytes.Equal(key, n.Key):
-		if n.marker{
+		if n.operands != nil {
+			return nil, errMergePending
+		}
+		if n.marker && !n.expired(now().UnixNano()) {
 			return n.Value, nil
 		}
 		return nil, ErrDeleted
@@ -117,10 +135,13 @@ func (n *Node) Del(key []byte, parent *Node) error {
 	case bytes.Compare(key, n.Key) == 1:
 		return n.Right.Del(key, n)
 	default:
-		if !n.marker {
+		if !n.marker && n.operands == nil {
 			return ErrDeleted
 		}
 		n.marker = false
+		n.operands = nil
+		n.unresolved = false
+		n.expiresAt = 0
 		return nil
 	}
 }
@@ -140,6 +161,69 @@ func (t *Tree) Get(key []byte) ([]byte, error) {
 	}
 	return t.Root.Get(key)
 }
+// Lookup returns the node of the key, or nil if the key is not in the tree.
+func (t *Tree) Lookup(key []byte) *Node {
+	n := t.Root
+	for n != nil {
+		switch c := bytes.Compare(key, n.Key); {
+		case c == 0:
+			return n
+		case c < 0:
+			n = n.Left
+		default:
+			n = n.Right
+		}
+	}
+	return nil
+}
+
+// Merge adds a merge operand to the key. If the key is not in the tree, a node is created
+// whose operands apply to a value that has to be looked up in the SSTables.
+func (t *Tree) Merge(key []byte, op operand) error {
+	if n := t.Lookup(key); n != nil {
+		n.operands = append(n.operands, op)
+		return nil
+	}
+	if err := t.Set(key, nil); err != nil {
+		return err
+	}
+	n := t.Lookup(key)
+	n.operands = []operand{op}
+	n.unresolved = true
+	return nil
+}
+
+// put inserts a copy of an entry read from an SSTable on top of what the tree already holds for its key.
+// Operands without a base value are added to the existing node; anything else replaces it.
+func (t *Tree) put(entry *Node) error {
+	n := t.Lookup(entry.Key)
+	if n != nil && entry.unresolved {
+		n.operands = append(n.operands, entry.operands...)
+		return nil
+	}
+	if n == nil {
+		if err := t.Set(entry.Key, entry.Value); err != nil {
+			return err
+		}
+		n = t.Lookup(entry.Key)
+	}
+	n.Value = entry.Value
+	n.marker = entry.marker
+	n.operands = entry.operands
+	n.unresolved = entry.unresolved
+	n.expiresAt = entry.expiresAt
+	return nil
+}
+
+// SetExpiring sets a value that expires at the given time in unix nanoseconds.
+func (t *Tree) SetExpiring(key, value []byte, expiresAt int64) error {
+	if err := t.Set(key, value); err != nil {
+		return err
+	}
+	t.Lookup(key).expiresAt = expiresAt
+	return nil
+}
+
 func (t *Tree) Del(key []byte) error {
 	//deleting an empty tree
 	if t.Root == nil {
@@ -208,6 +292,9 @@ func (n *Node) SetDeletedKey(key , value[]byte) error{
 	case bytes.Equal(key, n.Key):
 		n.Value = value
 		n.marker = false
+		n.operands = nil
+		n.unresolved = false
+		n.expiresAt = 0
 		return nil
 	case bytes.Compare(key, n.Key) == -1:
 		if n.Left == nil {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// A checkpoint is a copy of the database, taken while it is open, that opens like any database: Open(dir)
+// restores it, the copy then lives on its own. The writes are held for the time of the checkpoint, so it
+// holds exactly the writes acknowledged before it. The SSTables are never modified once written, so they
+// are hard-linked into the checkpoint and cost no space until the database compacts them away; they are
+// copied when they cannot be linked, for example to another filesystem. The wal is copied from its last
+// watermark, its older entries are in the SSTables, and the checkpoint gets its own families.json and a
+// manifest of the live files.
+
+var (
+	// ErrCheckpointExists is returned when the directory of a checkpoint already exists.
+	ErrCheckpointExists = errors.New("checkpoint directory already exists")
+)
+
+// Checkpoint writes a consistent copy of the database to dir, which must not exist. The reads go on
+// during the checkpoint. The copy is synced before Checkpoint returns.
+func (db *DB) Checkpoint(dir string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if _, err := db.fs.Stat(dir); err == nil {
+		return fmt.Errorf("%w: %s", ErrCheckpointExists, dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := db.checkpoint(dir); err != nil {
+		// a partial checkpoint is of no use
+		db.fs.RemoveAll(dir)
+		return err
+	}
+	fmt.Println("Writes checkpoint: ", dir)
+	return nil
+}
+
+func (db *DB) checkpoint(dir string) error {
+	cp := &DB{dir: dir, fs: db.fs}
+	m := &manifest{dir: dir, fs: db.fs, files: map[string][]*SStable{}, lastSequence: db.manifest.lastSequence}
+	if err := db.fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	options := map[string]FamilyOptions{}
+	for name, cf := range db.families {
+		if name != defaultFamily {
+			options[name] = cf.opts
+		}
+		path := cp.familyPath(name)
+		if err := db.fs.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		for _, sstable := range cf.sst.sstables {
+			if err := linkOrCopy(db.fs, sstable.name, filepath.Join(path, filepath.Base(sstable.name))); err != nil {
+				return err
+			}
+			m.files[name] = append(m.files[name], sstable.meta())
+		}
+		if err := db.fs.Sync(path); err != nil {
+			return err
+		}
+		if name != defaultFamily {
+			if err := db.fs.Sync(filepath.Dir(path)); err != nil {
+				return err
+			}
+		}
+	}
+	tail, err := db.wal.tail(db.manifest.walOffsets)
+	if err != nil {
+		return err
+	}
+	return writeMetadata(m, options, tail)
+}
+
+// writeMetadata writes the files of a new database besides its SSTables, which must be in place already:
+// families.json with the options of the families, the wal and the manifest m of the SSTables.
+func writeMetadata(m *manifest, options map[string]FamilyOptions, wal []byte) error {
+	content, err := json.MarshalIndent(options, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.fs, filepath.Join(m.dir, "families.json"), content); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(m.fs, filepath.Join(m.dir, "wal.log"), wal); err != nil {
+		return err
+	}
+	if err := m.rotate(); err != nil {
+		return err
+	}
+	if err := m.Close(); err != nil {
+		return err
+	}
+	return m.fs.Sync(filepath.Dir(filepath.Clean(m.dir)))
+}
+
+// linkOrCopy hard-links the file to name, or copies it if it cannot be linked. The copy is synced.
+func linkOrCopy(fs vfs.FS, file, name string) error {
+	if fs.Link(file, name) == nil {
+		return nil
+	}
+	src, err := fs.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
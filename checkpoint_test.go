@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	users, err := db.CreateColumnFamily("users", FamilyOptions{Compression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("flushed"))
+	}
+	users.Put([]byte("u"), []byte("flushed"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("k0"), []byte("wal"))
+	users.Put([]byte("v"), []byte("wal"))
+
+	cp := filepath.Join(t.TempDir(), "checkpoint")
+	if err := db.Checkpoint(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(cp); !errors.Is(err, ErrCheckpointExists) {
+		t.Fatalf("Expected ErrCheckpointExists, but got %v", err)
+	}
+	sstable := db.def.sst.sstables[0].name
+	original, _ := os.Stat(sstable)
+	linked, err := os.Stat(filepath.Join(cp, "sstFiles", filepath.Base(sstable)))
+	if err != nil || !os.SameFile(original, linked) {
+		t.Fatalf("Expected the sstable to be hard-linked into the checkpoint, but got %v", err)
+	}
+
+	// the writes and the compactions after the checkpoint do not reach it
+	db.Put([]byte("k1"), []byte("after"))
+	for i := 0; i < maxFiles; i++ {
+		db.Put([]byte(fmt.Sprintf("later%d", i)), []byte("after"))
+		if err := FlushToDisk(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored := openTestDB(t, cp)
+	for key, want := range map[string]string{"k0": "wal", "k1": "flushed", "k4": "flushed"} {
+		if value, err := restored.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s for %s in the checkpoint, but got %s (%v)", want, key, value, err)
+		}
+	}
+	if _, err := restored.Get([]byte("later0")); err != ErrKeynotfound {
+		t.Fatalf("Expected the later writes to be missing from the checkpoint, but got %v", err)
+	}
+	users, err = restored.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"u": "flushed", "v": "wal"} {
+		if value, err := users.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s for %s in the family of the checkpoint, but got %s (%v)", want, key, value, err)
+		}
+	}
+	// the restored database lives on its own
+	if err := restored.Put([]byte("k0"), []byte("restored")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get([]byte("k0")); string(value) != "wal" {
+		t.Fatalf("Expected the database to be independent of its checkpoint, but got %s", value)
+	}
+
+	handled := filepath.Join(t.TempDir(), "handled")
+	for _, want := range []int{http.StatusCreated, http.StatusConflict} {
+		rec := httptest.NewRecorder()
+		body := bytes.NewBufferString(fmt.Sprintf(`{"dir": %q}`, handled))
+		CheckpointHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/checkpoint", body), db)
+		if rec.Code != want {
+			t.Fatalf("Expected %d, but got %d: %s", want, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCheckpointConcurrent(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte("w"), 10<<10))
+	}
+	// the checkpoints read the wal at the same time, each of them gets all of it
+	base := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Checkpoint(filepath.Join(base, fmt.Sprint(i)))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := openTestDB(t, filepath.Join(base, fmt.Sprint(i)))
+		for k := 0; k < 200; k++ {
+			if _, err := restored.Get([]byte(fmt.Sprintf("k%03d", k))); err != nil {
+				t.Fatalf("Expected k%03d in the checkpoint %d, but got %v", k, i, err)
+			}
+		}
+		restored.Close()
+	}
+}
@@ -0,0 +1,419 @@
+// kvctl is the command-line client of the key-value store, it talks to the HTTP API of the server.
+//
+// Usage:
+//
+//	kvctl [-addr http://localhost:8084] [-o plain|json|hex] <command> [arguments]
+//
+// The commands are:
+//
+//	get KEY                        print the value of the key
+//	set [-ttl SECONDS] KEY VALUE   set the value of the key, a VALUE of - is read from the standard input
+//	del KEY                        delete the key
+//	scan [-start KEY] [-end KEY] [-limit N]
+//	                               print the keys in [start, end) with their values
+//	batch FILE                     apply the writes of a JSON batch ({"ops": [...]}) atomically
+//	export [FILE]                  write every key as a line of JSON, to the standard output by default
+//	import FILE                    set the keys of a file written by export
+//	stats                          print the storage statistics
+//
+// kvctl exits with 1 when the key does not exist and with 2 on any other error.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	exitNotFound = 1
+	exitError    = 2
+	// importBatch is the number of keys that import sends in one batch
+	importBatch = 1000
+)
+
+var errNotFound = errors.New("key not found")
+
+// keyValue is a key with its value in the JSON of the API, where the bytes are base64 encoded.
+// It is also a line of the files of export and import.
+type keyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type scanResponse struct {
+	Keys []keyValue `json:"keys"`
+	Next []byte     `json:"next"`
+}
+
+type client struct {
+	addr   string
+	format string
+	http   *http.Client
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", "http://localhost:8084", "address of the server")
+	format := fs.String("o", "plain", "output format: plain, json or hex")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: kvctl [-addr URL] [-o plain|json|hex] get|set|del|scan|batch|export|import|stats [arguments]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError
+	}
+	if *format != "plain" && *format != "json" && *format != "hex" {
+		fmt.Fprintf(stderr, "kvctl: unknown output format %q\n", *format)
+		return exitError
+	}
+	c := &client{
+		addr:   strings.TrimRight(*addr, "/"),
+		format: *format,
+		http:   &http.Client{Timeout: time.Minute},
+		stdin:  stdin,
+		stdout: stdout,
+	}
+	err := c.run(fs.Arg(0), fs.Args()[1:])
+	if err == errNotFound {
+		fmt.Fprintln(stderr, "kvctl:", err)
+		return exitNotFound
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "kvctl:", err)
+		return exitError
+	}
+	return 0
+}
+
+func (c *client) run(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	ttl := fs.Int64("ttl", 0, "")
+	start := fs.String("start", "", "")
+	end := fs.String("end", "", "")
+	limit := fs.Int("limit", 0, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	nargs := map[string][2]int{
+		"get": {1, 1}, "set": {2, 2}, "del": {1, 1}, "scan": {0, 0},
+		"batch": {1, 1}, "export": {0, 1}, "import": {1, 1}, "stats": {0, 0},
+	}
+	n, ok := nargs[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if len(args) < n[0] || len(args) > n[1] {
+		return fmt.Errorf("wrong number of arguments for %s", cmd)
+	}
+	switch cmd {
+	case "get":
+		return c.get(args[0])
+	case "set":
+		value := []byte(args[1])
+		if args[1] == "-" {
+			var err error
+			if value, err = io.ReadAll(c.stdin); err != nil {
+				return err
+			}
+		}
+		return c.set(args[0], value, *ttl)
+	case "del":
+		return c.del(args[0])
+	case "scan":
+		return c.scan(*start, isSet(fs, "start"), *end, isSet(fs, "end"), *limit, c.print)
+	case "batch":
+		return c.batch(args[0])
+	case "export":
+		out := c.stdout
+		if len(args) == 1 {
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		enc := json.NewEncoder(out)
+		return c.scan("", false, "", false, 0, func(kv keyValue) error {
+			return enc.Encode(kv)
+		})
+	case "import":
+		return c.importFile(args[0])
+	case "stats":
+		return c.stats()
+	}
+	return nil
+}
+
+// isSet reports whether the flag was given on the command line.
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func (c *client) keyURL(key string) string {
+	return c.addr + "/v1/keys/" + url.PathEscape(key)
+}
+
+// do sends the request and returns the body of a successful response.
+// A 404 is errNotFound and the other errors carry the message of the server.
+func (c *client) do(req *http.Request) ([]byte, error) {
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return body, nil
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil || e.Error == "" {
+		e.Error = strings.TrimSpace(string(body))
+	}
+	if res.StatusCode == http.StatusNotFound && e.Error == "key not found" {
+		return nil, errNotFound
+	}
+	return nil, fmt.Errorf("%s: %s", res.Status, e.Error)
+}
+
+func (c *client) get(key string) error {
+	req, err := http.NewRequest(http.MethodGet, c.keyURL(key), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	value, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	switch c.format {
+	case "json":
+		return c.print(keyValue{Key: []byte(key), Value: value})
+	case "hex":
+		_, err = fmt.Fprintln(c.stdout, hex.EncodeToString(value))
+	default:
+		_, err = c.stdout.Write(value)
+	}
+	return err
+}
+
+func (c *client) set(key string, value []byte, ttl int64) error {
+	u := c.keyURL(key)
+	if ttl != 0 {
+		u += "?ttl=" + strconv.FormatInt(ttl, 10)
+	}
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	_, err = c.do(req)
+	return err
+}
+
+func (c *client) del(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.keyURL(key), nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req)
+	return err
+}
+
+// scan visits the keys page by page until the end of the range or until limit keys were visited.
+func (c *client) scan(start string, hasStart bool, end string, hasEnd bool, limit int, visit func(keyValue) error) error {
+	next := []byte(start)
+	count := 0
+	for {
+		query := url.Values{}
+		if hasStart || count > 0 {
+			query.Set("start", string(next))
+		}
+		if hasEnd {
+			query.Set("end", end)
+		}
+		if limit > 0 {
+			query.Set("limit", strconv.Itoa(limit-count))
+		}
+		req, err := http.NewRequest(http.MethodGet, c.addr+"/v1/keys?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		body, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		var page scanResponse
+		if err := json.Unmarshal(body, &page); err != nil {
+			return err
+		}
+		for _, kv := range page.Keys {
+			if err := visit(kv); err != nil {
+				return err
+			}
+			count++
+		}
+		if page.Next == nil || (limit > 0 && count >= limit) {
+			return nil
+		}
+		next = page.Next
+	}
+}
+
+func (c *client) batch(name string) error {
+	var body []byte
+	var err error
+	if name == "-" {
+		body, err = io.ReadAll(c.stdin)
+	} else {
+		body, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return err
+	}
+	return c.post("/v1/batch", body)
+}
+
+func (c *client) post(path string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = c.do(req)
+	return err
+}
+
+// importFile sets the keys of a file written by export, in batches of importBatch keys.
+func (c *client) importFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	type op struct {
+		Op    string `json:"op"`
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	}
+	var ops []op
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		body, err := json.Marshal(map[string][]op{"ops": ops})
+		if err != nil {
+			return err
+		}
+		ops = ops[:0]
+		return c.post("/v1/batch", body)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var kv keyValue
+		if err := json.Unmarshal(scanner.Bytes(), &kv); err != nil {
+			return fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		if kv.Value == nil {
+			kv.Value = []byte{}
+		}
+		ops = append(ops, op{Op: "put", Key: kv.Key, Value: kv.Value})
+		if len(ops) == importBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (c *client) stats() error {
+	req, err := http.NewRequest(http.MethodGet, c.addr+"/v1/stats", nil)
+	if err != nil {
+		return err
+	}
+	body, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if c.format == "json" {
+		_, err := c.stdout.Write(body)
+		return err
+	}
+	var stats []struct {
+		Name           string `json:"name"`
+		MemtableKeys   int    `json:"memtable_keys"`
+		SSTables       int    `json:"sstables"`
+		SSTableEntries int    `json:"sstable_entries"`
+		SSTableBytes   int64  `json:"sstable_bytes"`
+	}
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FAMILY\tMEMTABLE KEYS\tSSTABLES\tSSTABLE ENTRIES\tSSTABLE BYTES")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", s.Name, s.MemtableKeys, s.SSTables, s.SSTableEntries, s.SSTableBytes)
+	}
+	return w.Flush()
+}
+
+// print writes a key and its value in the output format, as a line of JSON for json
+// and separated by a tab for plain and hex.
+func (c *client) print(kv keyValue) error {
+	var err error
+	switch c.format {
+	case "json":
+		err = json.NewEncoder(c.stdout).Encode(kv)
+	case "hex":
+		_, err = fmt.Fprintf(c.stdout, "%s\t%s\n", hex.EncodeToString(kv.Key), hex.EncodeToString(kv.Value))
+	default:
+		_, err = fmt.Fprintf(c.stdout, "%s\t%s\n", kv.Key, kv.Value)
+	}
+	return err
+}
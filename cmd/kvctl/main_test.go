@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeServer serves the routes of the HTTP API that kvctl uses from a map.
+func fakeServer(t *testing.T) *httptest.Server {
+	data := map[string][]byte{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/keys/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := data[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": "key not found"}`))
+				return
+			}
+			w.Write(value)
+		case http.MethodPut:
+			data[key], _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			if _, ok := data[key]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": "key not found"}`))
+				return
+			}
+			delete(data, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/v1/keys", func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		for k := range data {
+			if k >= r.URL.Query().Get("start") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit == 0 {
+			limit = 2
+		}
+		var res scanResponse
+		for i, k := range keys {
+			if i == limit {
+				res.Next = []byte(keys[i-1] + "\x00")
+				break
+			}
+			res.Keys = append(res.Keys, keyValue{Key: []byte(k), Value: data[k]})
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	mux.HandleFunc("/v1/batch", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Ops []struct {
+				Op    string `json:"op"`
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			} `json:"ops"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		for _, op := range req.Ops {
+			data[string(op.Key)] = op.Value
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestKvctl(t *testing.T) {
+	server := fakeServer(t)
+	defer server.Close()
+	kvctl := func(stdin string, args ...string) (int, string) {
+		var out bytes.Buffer
+		code := run(append([]string{"-addr", server.URL}, args...), strings.NewReader(stdin), &out, io.Discard)
+		return code, out.String()
+	}
+	if code, _ := kvctl("", "get", "a"); code != exitNotFound {
+		t.Fatalf("Expected exit code %d for a missing key, but got %d", exitNotFound, code)
+	}
+	if code, _ := kvctl("", "set", "a", "1"); code != 0 {
+		t.Fatalf("Expected exit code 0, but got %d", code)
+	}
+	if code, _ := kvctl("\x00\xff", "set", "b", "-"); code != 0 {
+		t.Fatalf("Expected exit code 0, but got %d", code)
+	}
+	if _, out := kvctl("", "get", "a"); out != "1" {
+		t.Fatalf("Expected value 1, but got %q", out)
+	}
+	if _, out := kvctl("", "-o", "hex", "get", "b"); out != "00ff\n" {
+		t.Fatalf("Expected the value in hex, but got %q", out)
+	}
+	if code, _ := kvctl("", "frobnicate"); code != exitError {
+		t.Fatalf("Expected exit code %d for an unknown command, but got %d", exitError, code)
+	}
+
+	// export goes through the pages of the scan and import reads its file back
+	kvctl("", "set", "c", "3")
+	name := filepath.Join(t.TempDir(), "export.jsonl")
+	if code, _ := kvctl("", "export", name); code != 0 {
+		t.Fatalf("Expected exit code 0, but got %d", code)
+	}
+	content, _ := os.ReadFile(name)
+	if strings.Count(string(content), "\n") != 3 {
+		t.Fatalf("Expected 3 lines, but got %q", content)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		kvctl("", "del", key)
+	}
+	if code, _ := kvctl("", "import", name); code != 0 {
+		t.Fatalf("Expected exit code 0, but got %d", code)
+	}
+	if _, out := kvctl("", "scan", "-start", "b"); out != "b\t\x00\xff\nc\t3\n" {
+		t.Fatalf("Expected the keys from b, but got %q", out)
+	}
+	if _, out := kvctl("", "scan", "-limit", "1"); out != "a\t1\n" {
+		t.Fatalf("Expected only a, but got %q", out)
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// defaultFamily is the name of the column family used by the methods of DB and the old http endpoints.
+const defaultFamily = "default"
+
+// KeepTTL is the ttl given to Update for the new value to expire when the current one does.
+const KeepTTL time.Duration = -1
+
+var (
+	// ErrFamilyNotFound is returned when a column family does not exist or was dropped.
+	ErrFamilyNotFound = errors.New("column family not found")
+	// ErrFamilyExists is returned when creating a column family whose name is taken.
+	ErrFamilyExists = errors.New("column family already exists")
+)
+
+// FamilyOptions are the settings of a column family.
+type FamilyOptions struct {
+	// Compression compresses the key-value pairs of the SSTables of the family.
+	Compression bool `json:"compression,omitempty"`
+	// FlushSize is the number of keys in the tree that triggers a flush, max if it is 0.
+	FlushSize int `json:"flush_size,omitempty"`
+	// TTL is given to the values written without one, 0 means they never expire.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// A ColumnFamily is a namespace of keys with its own tree, SSTables and options.
+// All the families of a database share its wal, so a WriteBatch can write to several of them atomically.
+type ColumnFamily struct {
+	name    string
+	db      *DB
+	opts    FamilyOptions
+	tree    *Tree
+	sst     *SStables
+	dropped bool
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Options returns the options the column family was created with.
+func (cf *ColumnFamily) Options() FamilyOptions {
+	return cf.opts
+}
+
+// walName is the family of the entries of the column family in the wal, empty for the default one.
+func (cf *ColumnFamily) walName() string {
+	if cf.name == defaultFamily {
+		return ""
+	}
+	return cf.name
+}
+
+// The default family keeps the sstFiles directory it had before column families existed.
+func (db *DB) familyPath(name string) string {
+	if name == defaultFamily {
+		return filepath.Join(db.dir, "sstFiles")
+	}
+	return filepath.Join(db.dir, "families", name)
+}
+
+func (db *DB) openFamily(name string, opts FamilyOptions) (*ColumnFamily, error) {
+	sst, err := newSST(db.familyPath(name), db.opts, db.manifest, name)
+	if err != nil {
+		return nil, err
+	}
+	sst.operators = db.operators
+	sst.compression = opts.Compression
+	cf := &ColumnFamily{
+		name: name,
+		db:   db,
+		opts: opts,
+		tree: &Tree{},
+		sst:  sst,
+	}
+	db.families[name] = cf
+	return cf, nil
+}
+
+// trees returns the trees of the column families by their name in the wal.
+func (db *DB) trees() map[string]*Tree {
+	trees := map[string]*Tree{}
+	for _, cf := range db.families {
+		trees[cf.walName()] = cf.tree
+	}
+	return trees
+}
+
+// ColumnFamily returns the column family with the given name.
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	cf, ok := db.families[name]
+	if !ok {
+		return nil, ErrFamilyNotFound
+	}
+	return cf, nil
+}
+
+// ColumnFamilies returns the names of the column families in alphabetical order.
+func (db *DB) ColumnFamilies() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.families))
+	for name := range db.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CreateColumnFamily creates a new column family. The names of the families are kept with their
+// options in families.json so that they are opened again with the database.
+func (db *DB) CreateColumnFamily(name string, opts FamilyOptions) (*ColumnFamily, error) {
+	if err := db.writable(); err != nil {
+		return nil, err
+	}
+	if err := validFamilyName(name); err != nil {
+		return nil, err
+	}
+	if opts.FlushSize < 0 || opts.TTL < 0 {
+		return nil, errors.New("flush size and ttl must not be negative")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.families[name]; ok {
+		return nil, ErrFamilyExists
+	}
+	cf, err := db.openFamily(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.saveFamilies(); err != nil {
+		delete(db.families, name)
+		return nil, err
+	}
+	return cf, nil
+}
+
+// DropColumnFamily deletes a column family and all its keys. Every family is flushed first so that
+// the wal holds no entry of the dropped family after its last watermark.
+func (db *DB) DropColumnFamily(name string) error {
+	if name == defaultFamily {
+		return errors.New("the default column family cannot be dropped")
+	}
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cf, ok := db.families[name]
+	if !ok {
+		return ErrFamilyNotFound
+	}
+	if err := FlushToDisk(db); err != nil {
+		return err
+	}
+	delete(db.families, name)
+	if err := db.saveFamilies(); err != nil {
+		db.families[name] = cf
+		return err
+	}
+	// a family created later with the same name starts without files
+	if err := cf.sst.logEdit(nil, cf.sst.sstables, 0); err != nil {
+		return err
+	}
+	cf.dropped = true
+	return db.fs.RemoveAll(cf.sst.path)
+}
+
+func validFamilyName(name string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("invalid column family name %q", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid column family name %q", name)
+		}
+	}
+	return nil
+}
+
+// loadFamilies reads the options of the column families other than the default one.
+func (db *DB) loadFamilies() (map[string]FamilyOptions, error) {
+	content, err := vfs.ReadFile(db.fs, filepath.Join(db.dir, "families.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var options map[string]FamilyOptions
+	if err := json.Unmarshal(content, &options); err != nil {
+		return nil, fmt.Errorf("families.json: %w", err)
+	}
+	return options, nil
+}
+
+// saveFamilies writes the options of the column families to a temporary file that then
+// replaces families.json, so that a crash never leaves a partial file.
+func (db *DB) saveFamilies() error {
+	options := map[string]FamilyOptions{}
+	for name, cf := range db.families {
+		if name != defaultFamily {
+			options[name] = cf.opts
+		}
+	}
+	content, err := json.MarshalIndent(options, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.fs, filepath.Join(db.dir, "families.json"), content)
+}
+
+// Get looks for the key in the tree first and then in the SSTables, starting with the newest one.
+// A deleted or expired key is reported as ErrKeynotfound. Merge operands found on the way are collected
+// until the value they apply to is found, and then applied to it.
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	cf.db.mu.RLock()
+	defer cf.db.mu.RUnlock()
+	if cf.dropped {
+		return nil, ErrFamilyNotFound
+	}
+	return cf.get(key)
+}
+
+func (cf *ColumnFamily) get(key []byte) ([]byte, error) {
+	value, _, err := cf.lookup(key)
+	return value, err
+}
+
+// lookup is get that also returns when the value expires, 0 if it does not. The expiry is that of the
+// value the merge operands apply to.
+func (cf *ColumnFamily) lookup(key []byte) ([]byte, int64, error) {
+	var chain []*Node
+	collect := func(n *Node) bool {
+		chain = append(chain, n)
+		return n.unresolved
+	}
+	if n := cf.tree.Lookup(key); n == nil || collect(n) {
+		if err := cf.sst.find(key, collect); err != nil {
+			return nil, 0, err
+		}
+	}
+	value, err := resolve(cf.db.operators, key, chain)
+	if err != nil {
+		return nil, 0, err
+	}
+	var expiresAt int64
+	if last := chain[len(chain)-1]; !last.unresolved && last.marker {
+		expiresAt = last.expiresAt
+	}
+	return value, expiresAt, nil
+}
+
+// Put sets the value in the tree after adding the command to the wal.
+// If the tree has reached the maximum length it is flushed to disk.
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	return cf.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL is Put for a value that expires after ttl. Once expired the key can no longer be read
+// and it is dropped from the SSTables by the compaction. A ttl of 0 gives the value the TTL of the
+// options of the family, if any.
+func (cf *ColumnFamily) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.dropped {
+		return ErrFamilyNotFound
+	}
+	if err := cf.db.writable(); err != nil {
+		return err
+	}
+	return cf.put(key, value, ttl)
+}
+
+func (cf *ColumnFamily) put(key, value []byte, ttl time.Duration) error {
+	return cf.apply(cf.setEntry(key, value, ttl))
+}
+
+// setEntry is the wal entry of a Put, with the TTL of the family if ttl is 0.
+func (cf *ColumnFamily) setEntry(key, value []byte, ttl time.Duration) *Entry {
+	if ttl == 0 {
+		ttl = cf.opts.TTL
+	}
+	// an empty value is a value like any other, only a deletion removes the key
+	if value == nil {
+		value = []byte{}
+	}
+	entry := &Entry{
+		Key:     key,
+		Value:   value,
+		Command: Set,
+		Family:  cf.walName(),
+	}
+	if expiresAt := expiry(ttl); expiresAt != 0 {
+		entry.Command = SetExpiring
+		entry.ExpiresAt = expiresAt
+	}
+	return entry
+}
+
+// apply adds the entry to the wal, redoes it in the tree and flushes if the tree is full.
+func (cf *ColumnFamily) apply(entry *Entry) error {
+	if err := cf.db.wal.AppendCommand(entry); err != nil {
+		return err
+	}
+	if err := redo(entry, map[string]*Tree{entry.Family: cf.tree}); err != nil {
+		return err
+	}
+	return cf.db.maybeFlush()
+}
+
+// Delete marks the key as deleted. If the key is only in the SSTables, it is added
+// to the tree as a deleted key so that the deletion shadows the value on disk.
+// Deleting a key that does not exist returns ErrKeynotfound.
+func (cf *ColumnFamily) Delete(key []byte) error {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.dropped {
+		return ErrFamilyNotFound
+	}
+	if err := cf.db.writable(); err != nil {
+		return err
+	}
+	return cf.delete(key)
+}
+
+func (cf *ColumnFamily) delete(key []byte) error {
+	// a key that is deleted or expired does not exist anymore
+	if _, err := cf.get(key); err != nil {
+		return err
+	}
+	return cf.apply(&Entry{
+		Key:     key,
+		Command: Del,
+		Family:  cf.walName(),
+	})
+}
+
+// Merge records an operand for the key that will be combined with its current value by
+// the named operator. Only the operand is written, the current value is not read. The operand is
+// applied to a missing key first, an operand that the operator refuses gives ErrInvalidOperand.
+func (cf *ColumnFamily) Merge(key []byte, name string, value []byte) error {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.dropped {
+		return ErrFamilyNotFound
+	}
+	if err := cf.db.writable(); err != nil {
+		return err
+	}
+	current, err := cf.mergeBase(key)
+	if err != nil {
+		return err
+	}
+	if _, err := checkOperand(cf.db.operators, key, current, operand{name: name, value: value}); err != nil {
+		return err
+	}
+	return cf.apply(&Entry{
+		Key:     key,
+		Value:   encodeOperand(operand{name: name, value: value}),
+		Command: Merge,
+		Family:  cf.walName(),
+	})
+}
+
+// mergeBase returns the value that a new merge operand of the key applies to, nil if the key does not exist.
+func (cf *ColumnFamily) mergeBase(key []byte) ([]byte, error) {
+	value, _, err := cf.lookup(key)
+	if err == ErrKeynotfound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// CompareAndSwap sets the value of the key to new only if its current value is old.
+// It reports whether the swap happened; a missing key never matches.
+func (cf *ColumnFamily) CompareAndSwap(key, old, new []byte) (bool, error) {
+	return cf.PutIf(key, new, 0, func(current []byte, found bool) bool {
+		return found && bytes.Equal(current, old)
+	})
+}
+
+// PutIfAbsent sets the value of the key only if the key does not exist yet.
+// It reports whether the value was written.
+func (cf *ColumnFamily) PutIfAbsent(key, value []byte) (bool, error) {
+	return cf.PutIf(key, value, 0, func(current []byte, found bool) bool {
+		return !found
+	})
+}
+
+// PutIf sets the value of the key, with a ttl if it is not 0, if cond accepts its current value.
+// The read and the write happen under the same lock, so no other write can slip in between them.
+func (cf *ColumnFamily) PutIf(key, value []byte, ttl time.Duration, cond func(current []byte, found bool) bool) (bool, error) {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.dropped {
+		return false, ErrFamilyNotFound
+	}
+	if err := cf.db.writable(); err != nil {
+		return false, err
+	}
+	ok, err := cf.check(key, cond)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, cf.put(key, value, ttl)
+}
+
+// Update replaces the value of the key by the one fn computes from its current value, with a ttl if
+// it is not 0, and returns the new value. With KeepTTL the new value expires when the current one does.
+// The read and the write happen under the same lock like for PutIf.
+// Nothing is written when fn returns an error, which Update returns. fn must not use the database.
+func (cf *ColumnFamily) Update(key []byte, ttl time.Duration, fn func(current []byte, found bool) ([]byte, error)) ([]byte, error) {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.dropped {
+		return nil, ErrFamilyNotFound
+	}
+	if err := cf.db.writable(); err != nil {
+		return nil, err
+	}
+	current, expiresAt, err := cf.lookup(key)
+	if err != nil && err != ErrKeynotfound {
+		return nil, err
+	}
+	found := err == nil
+	value, err := fn(current, found)
+	if err != nil {
+		return nil, err
+	}
+	return value, cf.apply(cf.updateEntry(key, value, ttl, found, expiresAt))
+}
+
+// updateEntry is the wal entry that replaces a value, with the expiry of the current value for KeepTTL.
+// A key that does not exist yet gets the TTL of the family, like for a Put.
+func (cf *ColumnFamily) updateEntry(key, value []byte, ttl time.Duration, found bool, expiresAt int64) *Entry {
+	if ttl != KeepTTL {
+		return cf.setEntry(key, value, ttl)
+	}
+	entry := cf.setEntry(key, value, 0)
+	if found {
+		entry.Command, entry.ExpiresAt = Set, 0
+		if expiresAt != 0 {
+			entry.Command, entry.ExpiresAt = SetExpiring, expiresAt
+		}
+	}
+	return entry
+}
+
+// DeleteIf deletes the key if cond accepts its current value.
+func (cf *ColumnFamily) DeleteIf(key []byte, cond func(current []byte, found bool) bool) (bool, error) {
+	cf.db.mu.Lock()
+	defer cf.db.mu.Unlock()
+	if cf.dropped {
+		return false, ErrFamilyNotFound
+	}
+	if err := cf.db.writable(); err != nil {
+		return false, err
+	}
+	ok, err := cf.check(key, cond)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, cf.delete(key)
+}
+
+func (cf *ColumnFamily) check(key []byte, cond func(current []byte, found bool) bool) (bool, error) {
+	current, err := cf.get(key)
+	if err != nil && err != ErrKeynotfound {
+		return false, err
+	}
+	return cond(current, err == nil), nil
+}
+
+// Scan visits in ascending order the keys in [start, end) with their values until visit returns false.
+// A nil start or end leaves the range open on that side. Deleted and expired keys are skipped and
+// merge operands are resolved. The keys are those of the moment Scan is called: the entries of the SSTables
+// and of the tree are merged as they are visited, from a snapshot taken by iterate, so visit runs without
+// the lock of the database and may write to it.
+func (cf *ColumnFamily) Scan(start, end []byte, visit func(key, value []byte) bool) error {
+	it, err := cf.iterate(start, end)
+	if err != nil {
+		return err
+	}
+	for it.Next() {
+		if !visit(it.Key(), it.Value()) {
+			break
+		}
+	}
+	err = it.Err()
+	if err1 := it.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// flushSize is the number of keys that the tree of the family holds before it is flushed.
+func (cf *ColumnFamily) flushSize() int {
+	if cf.opts.FlushSize > 0 {
+		return cf.opts.FlushSize
+	}
+	return max
+}
+
+// maybeFlush flushes to disk once the tree of any family has reached its flush size.
+func (db *DB) maybeFlush() error {
+	for _, cf := range db.families {
+		if cf.tree.Len() >= cf.flushSize() {
+			return FlushToDisk(db)
+		}
+	}
+	return nil
+}
+
+// A WriteBatch groups writes to one or more column families. DB.Write adds them to the wal as a single
+// entry, so after a crash either all of them or none of them are recovered.
+// An empty family name stands for the default family.
+type WriteBatch struct {
+	entries []*Entry
+	ttls    []time.Duration
+}
+
+// Put adds the setting of a value to the batch.
+func (b *WriteBatch) Put(family string, key, value []byte) {
+	b.PutWithTTL(family, key, value, 0)
+}
+
+// PutWithTTL adds the setting of a value that expires after ttl to the batch.
+func (b *WriteBatch) PutWithTTL(family string, key, value []byte, ttl time.Duration) {
+	b.entries = append(b.entries, &Entry{Key: key, Value: value, Command: Set, Family: family})
+	b.ttls = append(b.ttls, ttl)
+}
+
+// Delete adds the deletion of a key to the batch. Unlike ColumnFamily.Delete, deleting a key that
+// does not exist is not an error.
+func (b *WriteBatch) Delete(family string, key []byte) {
+	b.entries = append(b.entries, &Entry{Key: key, Command: Del, Family: family})
+	b.ttls = append(b.ttls, 0)
+}
+
+// Merge adds a merge operand to the batch.
+func (b *WriteBatch) Merge(family string, key []byte, operator string, value []byte) {
+	b.entries = append(b.entries, &Entry{
+		Key:     key,
+		Value:   encodeOperand(operand{name: operator, value: value}),
+		Command: Merge,
+		Family:  family,
+	})
+	b.ttls = append(b.ttls, 0)
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Write applies all the writes of the batch atomically.
+func (db *DB) Write(b *WriteBatch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	entries := make([]*Entry, 0, len(b.entries))
+	// the operands are checked against the value of their key, which the writes before them in the batch
+	// change; the values are by family and key, nil for a deleted key
+	values := map[string][]byte{}
+	for i, e := range b.entries {
+		name := e.Family
+		if name == "" {
+			name = defaultFamily
+		}
+		cf, ok := db.families[name]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrFamilyNotFound, name)
+		}
+		id := name + "\x00" + string(e.Key)
+		switch e.Command {
+		case Set:
+			e = cf.setEntry(e.Key, e.Value, b.ttls[i])
+			values[id] = e.Value
+		case Merge:
+			op, err := decodeOperand(bytes.NewReader(e.Value))
+			if err != nil {
+				return err
+			}
+			current, ok := values[id]
+			if !ok {
+				if current, err = cf.mergeBase(e.Key); err != nil {
+					return err
+				}
+			}
+			if values[id], err = checkOperand(db.operators, e.Key, current, op); err != nil {
+				return err
+			}
+			e = &Entry{Key: e.Key, Value: e.Value, Command: Merge, Family: cf.walName()}
+		default:
+			e = &Entry{Key: e.Key, Command: e.Command, Family: cf.walName()}
+			values[id] = nil
+		}
+		entries = append(entries, e)
+	}
+	return db.applyBatch(entries)
+}
+
+// applyBatch adds the entries to the wal as one batch, redoes them in the trees and flushes if a tree is full.
+func (db *DB) applyBatch(entries []*Entry) error {
+	entry := &Entry{Command: Batch, Batch: entries}
+	if err := db.wal.AppendCommand(entry); err != nil {
+		return err
+	}
+	if err := redo(entry, db.trees()); err != nil {
+		return err
+	}
+	return db.maybeFlush()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestColumnFamilies(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	users, err := db.CreateColumnFamily("users", FamilyOptions{Compression: true, FlushSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateColumnFamily("users", FamilyOptions{}); err != ErrFamilyExists {
+		t.Fatalf("Expected ErrFamilyExists, but got %v", err)
+	}
+	if _, err := db.CreateColumnFamily("../users", FamilyOptions{}); err == nil {
+		t.Fatal("Expected an error for an invalid name")
+	}
+
+	// the same key lives independently in each family
+	if err := db.Put([]byte("k"), []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put([]byte("k"), []byte("users")); err != nil {
+		t.Fatal(err)
+	}
+	batch := &WriteBatch{}
+	batch.Put("", []byte("a"), []byte("1"))
+	batch.Put("users", []byte("a"), []byte("2"))
+	batch.Put("users", []byte("x"), []byte("4"))
+	batch.Delete("users", []byte("k"))
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	bad := &WriteBatch{}
+	bad.Put("users", []byte("b"), []byte("1"))
+	bad.Put("missing", []byte("b"), []byte("1"))
+	if err := db.Write(bad); err == nil {
+		t.Fatal("Expected an error for a batch writing to a missing family")
+	}
+
+	check := func(cf Store, key, want string) {
+		t.Helper()
+		value, err := cf.Get([]byte(key))
+		if want == "" {
+			if err != ErrKeynotfound {
+				t.Fatalf("Expected ErrKeynotfound for %s, but got %s (%v)", key, value, err)
+			}
+			return
+		}
+		if err != nil || string(value) != want {
+			t.Fatalf("Expected value %s for %s, but got %s (%v)", want, key, value, err)
+		}
+	}
+	check(db, "k", "default")
+	check(db, "a", "1")
+	check(users, "a", "2")
+	check(users, "k", "")
+	check(users, "b", "")
+
+	// reaching the flush size of users flushed it to a compressed sstable
+	if len(users.sst.sstables) != 1 || users.sst.sstables[0].version != 2 {
+		t.Fatalf("Expected one compressed sstable for users, but found %d", len(users.sst.sstables))
+	}
+	if users.tree.Len() != 0 || db.def.tree.Len() != 0 {
+		t.Fatal("Expected all the families to be flushed together")
+	}
+	if err := users.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	db = openTestDB(t, dir)
+	users, err = db.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.Options().Compression || users.Options().FlushSize != 3 {
+		t.Fatalf("Expected the options to be kept, but got %+v", users.Options())
+	}
+	check(users, "a", "2")
+	check(users, "c", "3")
+	check(users, "k", "")
+	check(db, "k", "default")
+
+	if err := db.DropColumnFamily("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get([]byte("a")); err != ErrFamilyNotFound {
+		t.Fatalf("Expected ErrFamilyNotFound after the drop, but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "families", "users")); !os.IsNotExist(err) {
+		t.Fatal("Expected the directory of the family to be removed")
+	}
+	users, err = db.CreateColumnFamily("users", FamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(users, "a", "")
+}
+
+func TestTornBatch(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	batch := &WriteBatch{}
+	batch.Put("", []byte("b"), []byte("2"))
+	batch.Put("", []byte("c"), []byte("3"))
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// a crash in the middle of the write of the batch leaves a part of it in the wal
+	name := filepath.Join(dir, "wal.log")
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, dir)
+	if value, err := db.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Fatalf("Expected value 1, but got %s (%v)", value, err)
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, err := db.Get([]byte(key)); err != ErrKeynotfound {
+			t.Fatalf("Expected the torn batch to be dropped as a whole, but got %v for %s", err, key)
+		}
+	}
+	// the torn part was removed, so what is written next is recovered
+	if err := db.Put([]byte("d"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = openTestDB(t, dir)
+	if value, err := db.Get([]byte("d")); err != nil || string(value) != "4" {
+		t.Fatalf("Expected value 4, but got %s (%v)", value, err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// commands are the tools that the binary runs instead of the server when their name is its first argument.
+var commands = map[string]func(args []string, out io.Writer) error{
+	"sstdump": sstdump,
+	"waldump": waldump,
+	"repair":  repair,
+	"backup":  backup,
+}
+
+// runCommand runs the tool named by the first argument, if there is one, and reports whether it did.
+// A tool that fails exits with the status 1.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := cmd(args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	for _, key := range []string{"a", "b", "c"} {
+		db.Put([]byte(key), []byte(key))
+		if err := FlushToDisk(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	for _, sst := range db.def.sst.sstables {
+		names = append(names, sst.name)
+	}
+	db.Close()
+
+	// a byte of the first file is flipped, the second file is cut in its header
+	content, _ := os.ReadFile(names[0])
+	content[len(content)-6] ^= 0xff
+	os.WriteFile(names[0], content, 0644)
+	content, _ = os.ReadFile(names[1])
+	os.WriteFile(names[1], content[:10], 0644)
+
+	_, err := OpenWithOptions(dir, Options{Paranoid: true})
+	var corrupt *CorruptionError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.File != names[0] || corrupt.Reason != "checksum mismatch" {
+		t.Fatalf("Expected the paranoid mode to refuse the first file, but got %v", err)
+	}
+	if _, err := os.Stat(names[0]); err != nil {
+		t.Fatalf("Expected the paranoid mode to leave the file in place, but got %v", err)
+	}
+
+	db = openTestDB(t, dir)
+	if stats := db.Stats(); stats[0].QuarantinedSSTables != 2 || stats[0].SSTables != 1 {
+		t.Fatalf("Expected 2 quarantined sstables and 1 left, but got %+v", stats[0])
+	}
+	for _, name := range names[:2] {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(name), quarantineDir, filepath.Base(name))); err != nil {
+			t.Fatalf("Expected %s in the quarantine directory, but got %v", name, err)
+		}
+	}
+	if _, err := db.Get([]byte("a")); err != ErrKeynotfound {
+		t.Fatalf("Expected the key of a quarantined file to be missing, but got %v", err)
+	}
+	if value, err := db.Get([]byte("c")); err != nil || string(value) != "c" {
+		t.Fatalf("Expected the intact file to be read, but got %s (%v)", value, err)
+	}
+	db.Close()
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	if stats := db.Stats(); stats[0].QuarantinedSSTables != 0 || stats[0].SSTables != 1 {
+		t.Fatalf("Expected the quarantined files to stay out of the database, but got %+v", stats[0])
+	}
+}
+
+func TestCorruptionErrorOfReads(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	for _, key := range []string{"a", "b"} {
+		db.Put([]byte(key), []byte(key))
+		if err := FlushToDisk(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the file is damaged while the database is open, the reads find it through the checksum
+	name := db.def.sst.sstables[0].name
+	content, _ := os.ReadFile(name)
+	content[len(content)-6] ^= 0xff
+	os.WriteFile(name, content, 0644)
+
+	check := func(what string, err error) {
+		t.Helper()
+		var corrupt *CorruptionError
+		if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.File != name || corrupt.Reason != "checksum mismatch" {
+			t.Fatalf("Expected a CorruptionError for %s from %s, but got %v", name, what, err)
+		}
+	}
+	_, err := db.Get([]byte("a"))
+	check("Get", err)
+	_, err = db.def.sst.sstables[0].entries()
+	check("entries", err)
+	check("Compact", db.def.sst.Compact())
+
+	// the decoding of an entry matches ErrCorrupt, the readers add the file and the entry to it
+	var n Node
+	err = n.decodeMergeValue([]byte{0, 9, 0, 0, 0, 0, 0, 0, 0, 0})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt for an unknown merge base, but got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errCrash = errors.New("crash")
+
+// crashAt makes the n-th call of crashPoint at the step fail, as if the process stopped there.
+func crashAt(t *testing.T, step string, n int) {
+	t.Helper()
+	t.Cleanup(func() { crashPoint = func(string) error { return nil } })
+	crashPoint = func(s string) error {
+		if s != step {
+			return nil
+		}
+		n--
+		if n == 0 {
+			return errCrash
+		}
+		return nil
+	}
+}
+
+func TestFlushCrash(t *testing.T) {
+	steps := []struct {
+		step string
+		// n is the call of the step that crashes, the ones of a compaction come after the one of the flush
+		n int
+	}{
+		{"sstable written", 1},
+		{"sstable renamed", 1},
+		{"sstables flushed", 1},
+		{"sstable written", 2},
+		{"sstable renamed", 3},
+	}
+	for _, tt := range steps {
+		t.Run(fmt.Sprintf("%s %d", tt.step, tt.n), func(t *testing.T) {
+			dir := t.TempDir()
+			db := openTestDB(t, dir)
+			var acked []string
+			put := func(key string) {
+				if err := db.Put([]byte(key), []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				acked = append(acked, key)
+			}
+			// the flushes before the crash fill the sstables up to a compaction
+			for i := 0; i < maxFiles-1; i++ {
+				put(fmt.Sprintf("flushed%d", i))
+				if err := FlushToDisk(db); err != nil {
+					t.Fatal(err)
+				}
+			}
+			put("a")
+			put("b")
+			crashAt(t, tt.step, tt.n)
+			if err := FlushToDisk(db); err != errCrash {
+				t.Fatalf("Expected the flush to crash, but got %v", err)
+			}
+			if tt.step == "sstable written" {
+				// the data that was not synced is lost with the crash
+				tmps, _ := filepath.Glob(filepath.Join(dir, "sstFiles", "*"+tmpSuffix))
+				for _, tmp := range tmps {
+					os.Truncate(tmp, 10)
+				}
+			}
+			crashPoint = func(string) error { return nil }
+			// the process dies, its files are closed and its lock is released
+			db.Close()
+
+			db = openTestDB(t, dir)
+			for _, key := range acked {
+				if value, err := db.Get([]byte(key)); err != nil || string(value) != key {
+					t.Fatalf("Expected the acknowledged key %s after the crash, but got %s (%v)", key, value, err)
+				}
+			}
+			if stats := db.Stats(); stats[0].QuarantinedSSTables != 0 {
+				t.Fatalf("Expected no corrupt sstable after the crash, but got %+v", stats[0])
+			}
+			tmps, _ := filepath.Glob(filepath.Join(dir, "sstFiles", "*"+tmpSuffix))
+			if len(tmps) != 0 {
+				t.Fatalf("Expected the unfinished sstables to be deleted, but found %v", tmps)
+			}
+			// the database works on after the crash
+			put("c")
+			if err := FlushToDisk(db); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+			db = openTestDB(t, dir)
+			for _, key := range acked {
+				if _, err := db.Get([]byte(key)); err != nil {
+					t.Fatalf("Expected the key %s after the next flush, but got %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+// A crash after the flushed files are in the manifest and before the watermark leaves their entries after
+// the last watermark of the wal, they must not be replayed on top of the SSTables that hold them.
+func TestFlushCrashReplay(t *testing.T) {
+	start := time.Now()
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	cf, err := db.CreateColumnFamily("counters", FamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge([]byte("count"), "add", []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Merge([]byte("count"), "add", []byte("1"))
+	cf.Merge([]byte("count"), "add", []byte("5"))
+	db.PutWithTTL([]byte("ttl"), []byte("v"), time.Minute)
+	b := &WriteBatch{}
+	b.Merge("", []byte("batched"), "add", []byte("2"))
+	b.Merge("counters", []byte("batched"), "add", []byte("3"))
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	crashAt(t, "sstables flushed", 1)
+	if err := FlushToDisk(db); err != errCrash {
+		t.Fatalf("Expected the flush to crash, but got %v", err)
+	}
+	crashPoint = func(string) error { return nil }
+	db.Close()
+
+	check := func(db *DB) {
+		t.Helper()
+		cf, err := db.ColumnFamily("counters")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			cf    *ColumnFamily
+			key   string
+			value string
+		}{
+			{db.def, "count", "11"},
+			{cf, "count", "5"},
+			{db.def, "batched", "2"},
+			{cf, "batched", "3"},
+			{db.def, "ttl", "v"},
+		} {
+			if value, err := tt.cf.Get([]byte(tt.key)); err != nil || string(value) != tt.value {
+				t.Fatalf("Expected %s=%s in %s after the crash, but got %s (%v)", tt.key, tt.value, tt.cf.name, value, err)
+			}
+		}
+		if _, expiresAt, err := db.def.lookup([]byte("ttl")); err != nil || expiresAt != start.Add(time.Minute).UnixNano() {
+			t.Fatalf("Expected the key to keep its expiry, but got %d (%v)", expiresAt, err)
+		}
+	}
+	db = openTestDB(t, dir)
+	check(db)
+	// a checkpoint leaves out the entries that are in the SSTables as well
+	cp := filepath.Join(t.TempDir(), "cp")
+	if err := db.Checkpoint(cp); err != nil {
+		t.Fatal(err)
+	}
+	check(openTestDB(t, cp))
+	db.Close()
+	db = openTestDB(t, dir)
+	check(db)
+
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	if _, err := db.Get([]byte("ttl")); err != ErrKeynotfound {
+		t.Fatalf("Expected the key to expire, but got %v", err)
+	}
+	db.Merge([]byte("count"), "add", []byte("1"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = openTestDB(t, dir)
+	if value, err := db.Get([]byte("count")); err != nil || string(value) != "12" {
+		t.Fatalf("Expected count=12 after the next flush, but got %s (%v)", value, err)
+	}
+}
@@ -1,26 +1,344 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+var (
+	// ErrPrecondition is returned when a conditional write finds a current value
+	// that does not satisfy its condition.
+	ErrPrecondition = errors.New("precondition failed")
+	// ErrLocked is returned when the directory of the database is already used by another process.
+	ErrLocked = errors.New("database is locked")
+	// ErrReadOnly is returned by the writes to a database opened with Options.ReadOnly.
+	ErrReadOnly = errors.New("database is read-only")
+)
+
+// now is the clock used to set and check the expiry of the keys.
+var now = time.Now
+
 type DB struct{
+	// mu serializes writes and lets reads run concurrently with each other,
+	// so that a conditional write sees the same value it replaces.
+	mu sync.RWMutex
 	wal *Wal
-	tree *Tree
-	sst *SStables
+	// dir is the directory of the database, it holds the SSTables of every column family
+	dir string
+	// def is the default column family, the one used by the methods of DB
+	def *ColumnFamily
+	families map[string]*ColumnFamily
+	// operators are the merge operators registered by name
+	operators map[string]MergeOperator
+	opts Options
+	// manifest records the live SSTables of every column family
+	manifest *manifest
+	// fs is the filesystem of the files of the database
+	fs vfs.FS
+	// lock is the lock of the LOCK file of the directory, it is held until Close
+	lock io.Closer
+	// closed is set by Close, the calls of Close that follow do nothing
+	closed bool
+}
+
+// Options are the settings of a database, given to OpenWithOptions.
+type Options struct {
+	// Paranoid refuses to open the database when an SSTable is corrupt. By default the corrupt
+	// SSTables are moved to the quarantine directory of their column family and the database opens
+	// without them.
+	Paranoid bool
+	// FS is the filesystem of the database, the one of the operating system if it is nil
+	FS vfs.FS
+	// SyncWAL syncs the wal after every write. Without it a write survives a crash of the process
+	// but not always a crash of the machine.
+	SyncWAL bool
+	// ReadOnly opens an existing database without writing to its directory: the SSTables are loaded and the
+	// wal is replayed in memory, but no watermark is written, nothing is flushed or compacted, the corrupt
+	// SSTables are skipped instead of quarantined and the writes fail with ErrReadOnly. The directory is not
+	// locked, it is meant for a copy of the data directory.
+	ReadOnly bool
 }
 // Create a new database instance by initializing a new SSTable and Tree.
 // Additionally, recover by reading values from the WAL
 // in case of a crash during a previous connection, ensuring data integrity.
 func NewDB(wal *Wal) (*DB, error){
-	tree := Tree{}
-	err := Recover(wal, &tree)
+	return openDB(wal, ".", Options{})
+}
+
+// Open opens the database stored in dir, creating it if needed. The wal is dir/wal.log,
+// the SSTables of the default column family are in dir/sstFiles and the ones of the other
+// families in dir/families.
+func Open(dir string) (*DB, error) {
+	return OpenWithOptions(dir, Options{})
+}
+
+// OpenWithOptions is Open with the given options.
+func OpenWithOptions(dir string, opts Options) (*DB, error) {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+	name := filepath.Join(dir, "wal.log")
+	var f vfs.File
+	var err error
+	if opts.ReadOnly {
+		f, err = opts.FS.Open(name)
+	} else if err = opts.FS.MkdirAll(dir, 0755); err == nil {
+		f, err = opts.FS.OpenAppend(name)
+	}
 	if err != nil {
-		return nil,err
+		return nil, err
 	}
-	sst, err := NewSST("sstFiles")
+	db, err := openDB(NewWal(f, name), dir, opts)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	return &DB{
+	return db, nil
+}
+
+// openDB locks the directory of the database, so that a single process uses it at a time, and loads it.
+// The lock is an advisory flock on dir/LOCK, it is released by Close or when the process exits.
+func openDB(wal *Wal, dir string, opts Options) (*DB, error) {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+	if opts.ReadOnly {
+		return loadDB(wal, dir, opts)
+	}
+	name := filepath.Join(dir, "LOCK")
+	lock, err := opts.FS.Lock(name)
+	if errors.Is(err, vfs.ErrLocked) {
+		return nil, fmt.Errorf("%w: %s is held by another process", ErrLocked, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := loadDB(wal, dir, opts)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	db.lock = lock
+	return db, nil
+}
+
+// loadDB loads the column families of the database in dir and replays the wal into their trees.
+func loadDB(wal *Wal, dir string, opts Options) (*DB, error) {
+	wal.sync = opts.SyncWAL
+	operators := map[string]MergeOperator{}
+	for _, op := range []MergeOperator{Int64Add{}, StringAppend{}, JSONMerge{}} {
+		operators[op.Name()] = op
+	}
+	db := &DB{
 		wal: wal,
-		tree: &tree,
-		sst: sst,
-	},nil
+		dir: dir,
+		families: map[string]*ColumnFamily{},
+		operators: operators,
+		opts: opts,
+		fs: opts.FS,
+	}
+	m, err := loadManifest(db.fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	db.manifest = m
+	def, err := db.openFamily(defaultFamily, FamilyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	db.def = def
+	options, err := db.loadFamilies()
+	if err != nil {
+		return nil, err
+	}
+	for name, opts := range options {
+		if _, err := db.openFamily(name, opts); err != nil {
+			return nil, err
+		}
+	}
+	// the manifest is rewritten with the files that were loaded, the ones of dropped families are forgotten
+	for name := range m.files {
+		if _, ok := db.families[name]; !ok {
+			delete(m.files, name)
+		}
+	}
+	for name := range m.walOffsets {
+		if _, ok := db.families[name]; !ok {
+			delete(m.walOffsets, name)
+		}
+	}
+	if opts.ReadOnly {
+		// the torn end of the wal, if any, is left as it is
+		if err := replay(wal, db.trees(), m.walOffsets); err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	if err := m.rotate(); err != nil {
+		return nil, err
+	}
+	err = replay(wal, db.trees(), m.walOffsets)
+	if err != nil {
+		return nil,err
+	}
+	if err := wal.truncateTorn(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the wal and the manifest and releases the lock of the directory. The trees are not flushed,
+// they are replayed from the wal by the next Open. Closing a database that is closed already does nothing.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	db.manifest.Close()
+	err := db.wal.Close()
+	if db.lock != nil {
+		db.lock.Close()
+		db.lock = nil
+	}
+	return err
+}
+
+// writable returns ErrReadOnly if the database was opened with Options.ReadOnly.
+func (db *DB) writable() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Flush writes the trees of every column family to SSTables and adds a watermark to the wal, so that the
+// next Open has nothing to replay. It waits for the flush or the compaction that is running, if any.
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return FlushToDisk(db)
+}
+
+// Sync syncs the wal, so that the writes acknowledged so far survive a crash of the machine even without
+// Options.SyncWAL. It waits for the flush or the compaction that is running, if any.
+func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.wal.Sync()
+}
+
+// Get returns the value of the key in the default column family, see ColumnFamily.Get.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.def.Get(key)
+}
+
+// Put sets the value of the key in the default column family, see ColumnFamily.Put.
+func (db *DB) Put(key, value []byte) error {
+	return db.def.Put(key, value)
+}
+
+// PutWithTTL sets a value that expires after ttl in the default column family, see ColumnFamily.PutWithTTL.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.def.PutWithTTL(key, value, ttl)
+}
+
+// Delete deletes the key from the default column family, see ColumnFamily.Delete.
+func (db *DB) Delete(key []byte) error {
+	return db.def.Delete(key)
+}
+
+// Scan visits the keys of the default column family, see ColumnFamily.Scan.
+func (db *DB) Scan(start, end []byte, visit func(key, value []byte) bool) error {
+	return db.def.Scan(start, end, visit)
+}
+
+// CompareAndSwap sets the value of the key to new only if its current value is old.
+// It reports whether the swap happened; a missing key never matches.
+func (db *DB) CompareAndSwap(key, old, new []byte) (bool, error) {
+	return db.def.CompareAndSwap(key, old, new)
+}
+
+// PutIfAbsent sets the value of the key only if the key does not exist yet.
+// It reports whether the value was written.
+func (db *DB) PutIfAbsent(key, value []byte) (bool, error) {
+	return db.def.PutIfAbsent(key, value)
+}
+
+// PutIf is ColumnFamily.PutIf on the default column family.
+func (db *DB) PutIf(key, value []byte, ttl time.Duration, cond func(current []byte, found bool) bool) (bool, error) {
+	return db.def.PutIf(key, value, ttl, cond)
+}
+
+// Update is ColumnFamily.Update on the default column family.
+func (db *DB) Update(key []byte, ttl time.Duration, fn func(current []byte, found bool) ([]byte, error)) ([]byte, error) {
+	return db.def.Update(key, ttl, fn)
+}
+
+// DeleteIf is ColumnFamily.DeleteIf on the default column family.
+func (db *DB) DeleteIf(key []byte, cond func(current []byte, found bool) bool) (bool, error) {
+	return db.def.DeleteIf(key, cond)
+}
+
+// expiry converts a ttl into an expiry time in unix nanoseconds, 0 if there is no ttl.
+func expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now().Add(ttl).UnixNano()
+}
+
+// Version returns a hash of the value, the same value always has the same version.
+// It is used as the ETag of the key in the http handlers.
+func Version(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	return h.Sum64()
+}
+
+// FamilyStats describes the storage of a column family.
+type FamilyStats struct {
+	Name string `json:"name"`
+	// MemtableKeys is the number of keys in the tree, deleted keys included
+	MemtableKeys int `json:"memtable_keys"`
+	SSTables     int `json:"sstables"`
+	// SSTableBytes is the size on disk of the SSTables
+	SSTableBytes int64 `json:"sstable_bytes"`
+	// SSTableEntries is the number of entries in the SSTables, a key can be in more than one of them
+	SSTableEntries int `json:"sstable_entries"`
+	// QuarantinedSSTables is the number of corrupt SSTables moved to the quarantine directory when the database was opened
+	QuarantinedSSTables int `json:"quarantined_sstables"`
+}
+
+// Stats returns the storage statistics of every column family, in the alphabetical order of their names.
+func (db *DB) Stats() []FamilyStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stats := make([]FamilyStats, 0, len(db.families))
+	for name, cf := range db.families {
+		s := FamilyStats{
+			Name:                name,
+			MemtableKeys:        cf.tree.Len(),
+			SSTables:            len(cf.sst.sstables),
+			QuarantinedSSTables: len(cf.sst.quarantined),
+		}
+		for _, sst := range cf.sst.sstables {
+			s.SSTableEntries += sst.entryCount
+			if info, err := db.fs.Stat(sst.name); err == nil {
+				s.SSTableBytes += info.Size()
+			}
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
 }
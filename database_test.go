@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+
+	if ok, err := db.CompareAndSwap([]byte("k"), []byte("v1"), []byte("v2")); err != nil || ok {
+		t.Fatalf("Expected no swap of a missing key, but got %v (%v)", ok, err)
+	}
+	if ok, err := db.PutIfAbsent([]byte("k"), []byte("v1")); err != nil || !ok {
+		t.Fatalf("Expected the absent key to be set, but got %v (%v)", ok, err)
+	}
+	if ok, err := db.PutIfAbsent([]byte("k"), []byte("other")); err != nil || ok {
+		t.Fatalf("Expected the existing key to be kept, but got %v (%v)", ok, err)
+	}
+	if ok, err := db.CompareAndSwap([]byte("k"), []byte("wrong"), []byte("v2")); err != nil || ok {
+		t.Fatalf("Expected no swap on a mismatch, but got %v (%v)", ok, err)
+	}
+	if value, _ := db.Get([]byte("k")); string(value) != "v1" {
+		t.Fatalf("Expected v1 after the failed swap, but got %s", value)
+	}
+	if ok, err := db.CompareAndSwap([]byte("k"), []byte("v1"), []byte("v2")); err != nil || !ok {
+		t.Fatalf("Expected the swap to happen, but got %v (%v)", ok, err)
+	}
+	// the swap sees the value of the SSTables too
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.CompareAndSwap([]byte("k"), []byte("v2"), []byte("v3")); err != nil || !ok {
+		t.Fatalf("Expected the swap of a flushed value to happen, but got %v (%v)", ok, err)
+	}
+	if value, _ := db.Get([]byte("k")); string(value) != "v3" {
+		t.Fatalf("Expected v3, but got %s", value)
+	}
+	// a deleted key is absent again
+	db.Delete([]byte("k"))
+	if ok, err := db.PutIfAbsent([]byte("k"), []byte("again")); err != nil || !ok {
+		t.Fatalf("Expected the deleted key to be set, but got %v (%v)", ok, err)
+	}
+}
+
+func TestConditionalHandlers(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	do := func(handler func(w http.ResponseWriter, r *http.Request, db Store), method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r, db)
+		return w
+	}
+	db.Put([]byte("a"), []byte("1"))
+	tag := etag([]byte("1"))
+	stale := etag([]byte("0"))
+
+	// the old routes
+	set := func(value string, header map[string]string) int {
+		return do(SetHandler, http.MethodPost, "/set", `{"key": "a", "value": "`+value+`"}`, header).Code
+	}
+	if code := set("2", map[string]string{"If-Match": stale}); code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for a stale If-Match, but got %d", code)
+	}
+	if code := set("2", map[string]string{"If-None-Match": "*"}); code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for If-None-Match: * on an existing key, but got %d", code)
+	}
+	if w := do(GetHandler, http.MethodGet, "/get?key=a", "", map[string]string{"If-None-Match": tag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("Expected 304 without a body, but got %d %q", w.Code, w.Body.String())
+	}
+	if w := do(GetHandler, http.MethodGet, "/get?key=a", "", map[string]string{"If-None-Match": stale}); w.Code != http.StatusOK || w.Header().Get("ETag") != tag {
+		t.Fatalf("Expected 200 with the ETag for a stale If-None-Match, but got %d", w.Code)
+	}
+	if code := set("2", map[string]string{"If-Match": tag}); code != http.StatusOK {
+		t.Fatalf("Expected the write with the current ETag to succeed, but got %d", code)
+	}
+	tag = etag([]byte("2"))
+	if w := do(DelHandler, http.MethodGet, "/del?key=a", "", map[string]string{"If-Match": stale}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for the deletion, but got %d", w.Code)
+	}
+	if w := do(SetHandler, http.MethodPost, "/set", `{"key": "new", "value": "x"}`, map[string]string{"If-None-Match": "*"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected If-None-Match: * to create an absent key, but got %d", w.Code)
+	}
+
+	// the REST routes
+	keys := func(w http.ResponseWriter, r *http.Request, db Store) { KeysHandler(w, r, db) }
+	if w := do(keys, http.MethodPut, "/v1/keys/a", "3", map[string]string{"If-None-Match": "*"}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412, but got %d", w.Code)
+	}
+	if w := do(keys, http.MethodGet, "/v1/keys/a", "", map[string]string{"If-None-Match": tag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("Expected 304 without a body, but got %d %q", w.Code, w.Body.String())
+	}
+	if w := do(keys, http.MethodHead, "/v1/keys/a", "", map[string]string{"If-None-Match": `"x", ` + tag}); w.Code != http.StatusNotModified {
+		t.Fatalf("Expected 304 for a list of ETags, but got %d", w.Code)
+	}
+	if w := do(keys, http.MethodPut, "/v1/keys/a", "3", map[string]string{"If-Match": tag}); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, but got %d", w.Code)
+	}
+	if w := do(keys, http.MethodGet, "/v1/keys/a", "", map[string]string{"If-None-Match": tag, "Accept": "text/plain"}); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), []byte("3")) {
+		t.Fatalf("Expected the changed value, but got %d %q", w.Code, w.Body.String())
+	}
+	if w := do(keys, http.MethodDelete, "/v1/keys/a", "", map[string]string{"If-Match": tag}); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 for the deletion with a stale ETag, but got %d", w.Code)
+	}
+}
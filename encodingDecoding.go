@@ -1,6 +1,9 @@
 package main 
 
-import 	"encoding/binary"
+import (
+	"encoding/binary"
+	"io"
+)
 
 // encodeInt converts an integer value into a 4-byte big-endian encoded byte slice.
 func encodeInt(x int)[]byte{
@@ -22,3 +25,33 @@ func encodeNum(v int)[]byte {
 func decodeNum(encoded []byte) int {
 	return int(binary.BigEndian.Uint16(encoded))
 }
+// encodeInt64 converts an int64 value into an 8-byte big-endian encoded byte slice.
+func encodeInt64(x int64) []byte {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], uint64(x))
+	return encoded[:]
+}
+// decodeInt64 converts an 8-byte big-endian encoded byte slice into an int64 value.
+func decodeInt64(encoded []byte) int64 {
+	return int64(binary.BigEndian.Uint64(encoded))
+}
+
+// readN reads n bytes. A large n is read little by little, so that a damaged length does not
+// allocate more memory than there is data to read.
+func readN(r io.Reader, n int) ([]byte, error) {
+	if n <= 1<<20 {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Export and Import move the keys of a column family in and out of the database as JSON Lines, one
+// {"key": ..., "value": ...} record per line, with "expires_at" for a key that has a TTL. The keys and the
+// values are JSON strings, or with the Base64 option the base64 of their bytes, which is also what kvctl
+// export writes and what binary data needs.
+
+var (
+	// ErrNotUTF8 is returned by Export when a key or a value is not text and the Base64 option is not set.
+	ErrNotUTF8 = errors.New("not valid UTF-8, export with base64")
+	// ErrBadRecord is returned by Import for a line that is not a record.
+	ErrBadRecord = errors.New("bad record")
+)
+
+// importBatchSize is the number of records that Import writes in a single batch.
+var importBatchSize = 1000
+
+// ExportOptions are the options of Export and Import, Import reads what Export wrote with the same options.
+type ExportOptions struct {
+	// Family is the column family of the keys, the default one if it is empty.
+	Family string
+	// Base64 encodes the keys and the values in base64 instead of as JSON strings.
+	Base64 bool
+}
+
+// textRecord is a line of JSON Lines without the Base64 option, binaryRecord one with it. ExpiresAt is
+// when the key expires, nil if it does not.
+type textRecord struct {
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type binaryRecord struct {
+	Key       []byte     `json:"key"`
+	Value     []byte     `json:"value"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (db *DB) exportFamily(name string) (*ColumnFamily, error) {
+	if name == "" {
+		return db.def, nil
+	}
+	return db.ColumnFamily(name)
+}
+
+// Export writes the keys of the family with their values and expiry to w, in ascending order of the keys.
+// The keys are those of a single moment: they are read from an iterator, which holds the lock of the
+// database only while it is created, and each record is written as its key is read, so neither a large
+// family nor a slow writer holds the memory or the writes. A key or a value that is not valid UTF-8 without
+// the Base64 option stops the export with ErrNotUTF8; the records of the keys before it may have been written.
+func (db *DB) Export(w io.Writer, opts ExportOptions) error {
+	cf, err := db.exportFamily(opts.Family)
+	if err != nil {
+		return err
+	}
+	it, err := cf.iterate(nil, nil)
+	if err != nil {
+		return err
+	}
+	err = writeRecords(w, it, opts)
+	if err1 := it.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// writeRecords writes a record for each key of the iterator.
+func writeRecords(w io.Writer, it *scanIterator, opts ExportOptions) error {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	for it.Next() {
+		key, value := it.Key(), it.Value()
+		var expiresAt *time.Time
+		if ns := it.ExpiresAt(); ns != 0 {
+			t := time.Unix(0, ns).UTC()
+			expiresAt = &t
+		}
+		var err error
+		switch {
+		case opts.Base64:
+			err = enc.Encode(binaryRecord{Key: key, Value: value, ExpiresAt: expiresAt})
+		case !utf8.Valid(key):
+			err = fmt.Errorf("export: key %q: %w", key, ErrNotUTF8)
+		case !utf8.Valid(value):
+			err = fmt.Errorf("export: value of %q: %w", key, ErrNotUTF8)
+		default:
+			err = enc.Encode(textRecord{Key: string(key), Value: string(value), ExpiresAt: expiresAt})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// Import sets the keys of the records read from r in the family and returns the number of keys it set.
+// A key with an expiry keeps it, and a record that has already expired is skipped. The records are written
+// in batches of importBatchSize, so a failure leaves the batches before it written; their records are
+// counted. Empty lines are skipped.
+func (db *DB) Import(r io.Reader, opts ExportOptions) (int, error) {
+	cf, err := db.exportFamily(opts.Family)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	b := &WriteBatch{}
+	write := func() error {
+		if b.Len() == 0 {
+			return nil
+		}
+		if err := db.Write(b); err != nil {
+			return err
+		}
+		imported += b.Len()
+		b = &WriteBatch{}
+		return nil
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var key, value []byte
+		var expiresAt *time.Time
+		if opts.Base64 {
+			var rec binaryRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return imported, fmt.Errorf("import: line %d: %w: %v", line, ErrBadRecord, err)
+			}
+			key, value, expiresAt = rec.Key, rec.Value, rec.ExpiresAt
+		} else {
+			var rec textRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return imported, fmt.Errorf("import: line %d: %w: %v", line, ErrBadRecord, err)
+			}
+			key, value, expiresAt = []byte(rec.Key), []byte(rec.Value), rec.ExpiresAt
+		}
+		if len(key) == 0 {
+			return imported, fmt.Errorf("import: line %d: %w: the key is missing", line, ErrBadRecord)
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		var ttl time.Duration
+		if expiresAt != nil {
+			if ttl = expiresAt.Sub(now()); ttl <= 0 {
+				continue
+			}
+		}
+		b.PutWithTTL(cf.name, key, value, ttl)
+		if b.Len() == importBatchSize {
+			if err := write(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, fmt.Errorf("import: %w: %v", ErrBadRecord, err)
+	}
+	return imported, write()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	users, err := db.CreateColumnFamily("users", FamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("flushed"))
+	}
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("k0"), []byte(`"quoted" <value>`))
+	db.Delete([]byte("k1"))
+	users.Put([]byte("u"), []byte("user"))
+
+	var out bytes.Buffer
+	if err := db.Export(&out, ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || lines[0] != `{"key":"k0","value":"\"quoted\" <value>"}` {
+		t.Fatalf("Expected the 4 live keys in order, but got\n%s", out.String())
+	}
+
+	importBatchSize = 3
+	defer func() { importBatchSize = 1000 }()
+	copied := openTestDB(t, t.TempDir())
+	if n, err := copied.Import(bytes.NewReader(append(out.Bytes(), '\n')), ExportOptions{}); err != nil || n != 4 {
+		t.Fatalf("Expected 4 keys to be imported, but got %d (%v)", n, err)
+	}
+	for key, want := range map[string]string{"k0": `"quoted" <value>`, "k4": "flushed"} {
+		if value, err := copied.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s for %s, but got %s (%v)", want, key, value, err)
+		}
+	}
+	if _, err := copied.Get([]byte("u")); err != ErrKeynotfound {
+		t.Fatalf("Expected the other families not to be exported, but got %v", err)
+	}
+
+	// binary data needs base64, which is also the format of kvctl export
+	binary := []byte{0xff, 0x00, 0xfe}
+	users.Put(binary, binary)
+	if err := db.Export(&bytes.Buffer{}, ExportOptions{Family: "users"}); !errors.Is(err, ErrNotUTF8) {
+		t.Fatalf("Expected ErrNotUTF8, but got %v", err)
+	}
+	out.Reset()
+	if err := db.Export(&out, ExportOptions{Family: "users", Base64: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := copied.Import(&out, ExportOptions{Base64: true}); err != nil || n != 2 {
+		t.Fatalf("Expected 2 keys to be imported, but got %d (%v)", n, err)
+	}
+	if value, err := copied.Get(binary); err != nil || !bytes.Equal(value, binary) {
+		t.Fatalf("Expected the binary value, but got %v (%v)", value, err)
+	}
+
+	// the batches before a bad line are written
+	bad := "{\"key\":\"a\",\"value\":\"1\"}\n{\"key\":\"b\"}\n{\"key\":\"c\"}\nnot json\n"
+	n, err := copied.Import(strings.NewReader(bad), ExportOptions{})
+	if !errors.Is(err, ErrBadRecord) || !strings.Contains(err.Error(), "line 4") || n != 3 {
+		t.Fatalf("Expected the 3 keys before the bad line 4, but got %d (%v)", n, err)
+	}
+	if value, err := copied.Get([]byte("b")); err != nil || len(value) != 0 {
+		t.Fatalf("Expected an empty value for a missing one, but got %q (%v)", value, err)
+	}
+
+	rec := httptest.NewRecorder()
+	ExportHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/export?family=users&base64=true", nil), db)
+	if rec.Code != http.StatusOK || strings.Count(rec.Body.String(), "\n") != 2 {
+		t.Fatalf("Expected the 2 keys of the family, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body
+	rec = httptest.NewRecorder()
+	ImportHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/import?family=users&base64=true", body), copied)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing family, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	ImportHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader("[]\n")), copied)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad record, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestExportTTL(t *testing.T) {
+	start := time.Now()
+	now = func() time.Time { return start }
+	defer func() { now = time.Now }()
+	db := openTestDB(t, t.TempDir())
+	db.PutWithTTL([]byte("short"), []byte("1"), time.Minute)
+	db.PutWithTTL([]byte("long"), []byte("2"), time.Hour)
+	db.Put([]byte("forever"), []byte("3"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Merge([]byte("long"), "append", []byte("+"))
+
+	var out bytes.Buffer
+	if err := db.Export(&out, ExportOptions{Base64: true}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "expires_at") != 2 {
+		t.Fatalf("Expected the 2 keys with a TTL to have expires_at, but got\n%s", out.String())
+	}
+	// the key of a minute has expired by the time of the import, the other keeps its expiry
+	now = func() time.Time { return start.Add(10 * time.Minute) }
+	copied := openTestDB(t, t.TempDir())
+	if n, err := copied.Import(&out, ExportOptions{Base64: true}); err != nil || n != 2 {
+		t.Fatalf("Expected 2 keys to be imported, but got %d (%v)", n, err)
+	}
+	if _, err := copied.Get([]byte("short")); err != ErrKeynotfound {
+		t.Fatalf("Expected the expired key to be skipped, but got %v", err)
+	}
+	_, expiresAt, err := copied.def.lookup([]byte("long"))
+	if err != nil || expiresAt != start.Add(time.Hour).UnixNano() {
+		t.Fatalf("Expected long to expire an hour after the start, but got %v (%v)", time.Unix(0, expiresAt), err)
+	}
+	if value, expiresAt, err := copied.def.lookup([]byte("forever")); err != nil || expiresAt != 0 || string(value) != "3" {
+		t.Fatalf("Expected forever without an expiry, but got %s at %d (%v)", value, expiresAt, err)
+	}
+}
+
+func TestExportStreams(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	for i := 0; i < 1000; i++ {
+		db.Put([]byte(fmt.Sprintf("k%04d", i)), []byte("value"))
+	}
+	db.Put([]byte{0xff}, []byte("binary"))
+
+	// the records before the key that is not text are already written when the export fails
+	var out bytes.Buffer
+	if err := db.Export(&out, ExportOptions{}); !errors.Is(err, ErrNotUTF8) || out.Len() == 0 {
+		t.Fatalf("Expected ErrNotUTF8 after some records, but got %v with %d bytes", err, out.Len())
+	}
+	// so the http response, which can no longer answer an error, is cut
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { ExportHandler(w, r, db) }))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/admin/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatal("Expected the response of a failed export to be cut")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/um6p/kvstore/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// kvServer implements the KV gRPC service of kvpb/kv.proto against the database.
+type kvServer struct {
+	kvpb.UnimplementedKVServer
+	db *DB
+}
+
+// NewGRPCServer returns a gRPC server that serves the KV service against the database.
+func NewGRPCServer(db *DB) *grpc.Server {
+	s := grpc.NewServer()
+	kvpb.RegisterKVServer(s, &kvServer{db: db})
+	return s
+}
+
+// family returns the column family of a request, the default one for an empty name.
+func (s *kvServer) family(name string) (*ColumnFamily, error) {
+	if name == "" {
+		return s.db.def, nil
+	}
+	cf, err := s.db.ColumnFamily(name)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return cf, nil
+}
+
+func (s *kvServer) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	cf, err := s.family(req.Family)
+	if err != nil {
+		return nil, err
+	}
+	value, err := cf.Get(req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.GetResponse{Value: value, Version: Version(value)}, nil
+}
+
+func (s *kvServer) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "key is missing")
+	}
+	if req.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl must not be negative")
+	}
+	cf, err := s.family(req.Family)
+	if err != nil {
+		return nil, err
+	}
+	if err := cf.PutWithTTL(req.Key, req.Value, time.Duration(req.TtlSeconds)*time.Second); err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.PutResponse{Version: Version(req.Value)}, nil
+}
+
+func (s *kvServer) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	cf, err := s.family(req.Family)
+	if err != nil {
+		return nil, err
+	}
+	if err := cf.Delete(req.Key); err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+func (s *kvServer) Batch(ctx context.Context, req *kvpb.BatchRequest) (*kvpb.BatchResponse, error) {
+	if err := s.write(req.Mutations); err != nil {
+		return nil, err
+	}
+	return &kvpb.BatchResponse{}, nil
+}
+
+// write applies the mutations as a WriteBatch.
+func (s *kvServer) write(mutations []*kvpb.Mutation) error {
+	b := &WriteBatch{}
+	for _, m := range mutations {
+		if len(m.Key) == 0 {
+			return status.Error(codes.InvalidArgument, "key is missing")
+		}
+		switch m.Op {
+		case kvpb.Mutation_PUT:
+			if m.TtlSeconds < 0 {
+				return status.Error(codes.InvalidArgument, "ttl must not be negative")
+			}
+			b.PutWithTTL(m.Family, m.Key, m.Value, time.Duration(m.TtlSeconds)*time.Second)
+		case kvpb.Mutation_DELETE:
+			b.Delete(m.Family, m.Key)
+		case kvpb.Mutation_MERGE:
+			b.Merge(m.Family, m.Key, m.Operator, m.Value)
+		default:
+			return status.Errorf(codes.InvalidArgument, "unknown operation %v", m.Op)
+		}
+	}
+	return grpcError(s.db.Write(b))
+}
+
+// Scan streams the keys of the range from a single iterator, which merges the SSTables and the tree as the
+// keys are sent. The iterator reads a snapshot, so a slow client does not hold back the writes.
+func (s *kvServer) Scan(req *kvpb.ScanRequest, stream kvpb.KV_ScanServer) error {
+	cf, err := s.family(req.Family)
+	if err != nil {
+		return err
+	}
+	start, end := req.Start, req.End
+	if len(start) == 0 {
+		start = nil
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+	it, err := cf.iterate(start, end)
+	if err != nil {
+		return grpcError(err)
+	}
+	sent := uint32(0)
+	for (req.Limit == 0 || sent < req.Limit) && it.Next() {
+		if err := stream.Send(&kvpb.KeyValue{Key: it.Key(), Value: it.Value()}); err != nil {
+			it.Close()
+			return err
+		}
+		sent++
+	}
+	err = it.Err()
+	if err1 := it.Close(); err == nil {
+		err = err1
+	}
+	return grpcError(err)
+}
+
+func (s *kvServer) Write(stream kvpb.KV_WriteServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res := &kvpb.WriteResponse{Id: req.Id}
+		if err := s.write(req.Mutations); err != nil {
+			res.Error = status.Convert(err).Message()
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// grpcError gives the errors of the database their gRPC code.
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrKeynotfound, errors.Is(err, ErrFamilyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case err == ErrPrecondition, err == ErrReadOnly:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrUnknownOperator), errors.Is(err, ErrInvalidOperand):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
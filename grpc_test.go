@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/um6p/kvstore/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPC(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	if _, err := db.CreateColumnFamily("users", FamilyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewGRPCServer(db)
+	go server.Serve(ln)
+	defer server.Stop()
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := kvpb.NewKVClient(conn)
+	ctx := context.Background()
+
+	if _, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("a")}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound, but got %v", err)
+	}
+	if _, err := client.Put(ctx, &kvpb.PutRequest{Key: []byte("a"), Value: []byte{0, 1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("a")})
+	if err != nil || string(res.Value) != "\x00\x01\x02" || res.Version != Version(res.Value) {
+		t.Fatalf("Expected the value that was put, but got %v (%v)", res, err)
+	}
+	if _, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("a"), Family: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for a missing family, but got %v", err)
+	}
+
+	_, err = client.Batch(ctx, &kvpb.BatchRequest{Mutations: []*kvpb.Mutation{
+		{Op: kvpb.Mutation_PUT, Key: []byte("u"), Value: []byte("1"), Family: "users"},
+		{Op: kvpb.Mutation_MERGE, Key: []byte("n"), Value: []byte("2"), Operator: "add"},
+		{Op: kvpb.Mutation_DELETE, Key: []byte("a")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(ctx, &kvpb.DeleteRequest{Key: []byte("a")}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected the batch to delete the key, but got %v", err)
+	}
+	if res, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("u"), Family: "users"}); err != nil || string(res.Value) != "1" {
+		t.Fatalf("Expected value 1, but got %v (%v)", res, err)
+	}
+
+	// the bulk writes are answered in order, a failed request does not stop the stream
+	write, err := client.Write(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 600; i++ {
+		req := &kvpb.WriteRequest{Id: uint64(i), Mutations: []*kvpb.Mutation{
+			{Op: kvpb.Mutation_PUT, Key: []byte("k" + strconv.Itoa(1000+i)), Value: []byte(strconv.Itoa(i))},
+		}}
+		if i == 5 {
+			req.Mutations[0].Family = "missing"
+		}
+		if err := write.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write.CloseSend()
+	for i := 0; i < 600; i++ {
+		res, err := write.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Id != uint64(i) || (res.Error != "") != (i == 5) {
+			t.Fatalf("Unexpected response %v for request %d", res, i)
+		}
+	}
+	if _, err := write.Recv(); err != io.EOF {
+		t.Fatalf("Expected the end of the stream, but got %v", err)
+	}
+
+	// the scan streams the keys of several SSTables and of the tree
+	scan, err := client.Scan(ctx, &kvpb.ScanRequest{Start: []byte("k"), End: []byte("l")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	var last []byte
+	for {
+		kv, err := scan.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != nil && string(kv.Key) <= string(last) {
+			t.Fatalf("Expected the keys in order, but got %s after %s", kv.Key, last)
+		}
+		last = kv.Key
+		count++
+	}
+	if count != 599 {
+		t.Fatalf("Expected 599 keys, but got %d", count)
+	}
+	scan, err = client.Scan(ctx, &kvpb.ScanRequest{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count = 0
+	for {
+		if _, err := scan.Recv(); err != nil {
+			break
+		}
+		count++
+	}
+	if count != 3 {
+		t.Fatalf("Expected 3 keys, but got %d", count)
+	}
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -13,14 +19,27 @@ var (
 type KeyValue struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// TTL is the number of seconds after which the key expires, 0 means never
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// Store is what the handlers need to read and write keys, both DB (for its default column family)
+// and ColumnFamily implement it.
+type Store interface {
+	Get(key []byte) ([]byte, error)
+	PutWithTTL(key, value []byte, ttl time.Duration) error
+	PutIf(key, value []byte, ttl time.Duration, cond func(current []byte, found bool) bool) (bool, error)
+	Delete(key []byte) error
+	DeleteIf(key []byte, cond func(current []byte, found bool) bool) (bool, error)
+	Merge(key []byte, name string, value []byte) error
+	Scan(start, end []byte, visit func(key, value []byte) bool) error
 }
 // To handle the 'get' operation, the process begins by checking if the key is not empty.
-// Subsequently, the database's tree is queried to determine if the key exists.
-// If the key is found in the tree, the operation concludes, and the corresponding value is returned.
-// If the key is not present in the tree, a search in the SSTables is initiated using the sst.search() function.
-// If the key is found in the SSTables, the operation concludes, and the corresponding value is returned.
-// If the key is not found in the SSTables, the operation concludes, and an error(key not found) is returned.
-func GetHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+// Subsequently, the database is queried: the tree first and then the SSTables, from the newest one.
+// If the key is found, the corresponding value is returned along with its ETag, or 304 Not Modified
+// when the If-None-Match header holds that ETag.
+// If the key is not found, the operation concludes, and an error(key not found) is returned.
+func GetHandler(w http.ResponseWriter, r *http.Request, db Store) {
 	key := r.URL.Query().Get("key")
 
 	if key == "" {
@@ -28,42 +47,33 @@ func GetHandler(w http.ResponseWriter, r *http.Request, db *DB) {
 		http.Error(w, "key parameter is missing", http.StatusBadRequest)
 		return
 	}
-	key1 := []byte(key)
-	//check if the value is in the tree if not we search in the sstfiles
-	value, err := db.tree.Get(key1)
-	if err == ErrDeleted {
+	value, err := db.Get([]byte(key))
+	if err == ErrKeynotfound {
 		fmt.Println("key not found")
 		http.Error(w, "key not found", http.StatusBadRequest)
 		return
 	}
-	if err == ErrKeynotfound {
-		// search in sstfiles
-		value, err := db.sst.Search(key1)
-		if err == ErrDeleted || err == ErrKeynotfound {
-			fmt.Println("key not found")
-			http.Error(w, "key not found", http.StatusBadRequest)
-			return
-		}
-		if err != nil {
-			fmt.Println(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		
-		fmt.Println("Gets key:  ", string(value))
-		//print in the page
-		fmt.Fprintf(w, "key: %s, value: %s \n", string(key), string(value))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	fmt.Println("Gets key:  ", string(value))
-		//print in the page
-		fmt.Fprintf(w, "key: %s, value: %s \n", string(key), string(value))
 	fmt.Println("Gets key: ", string(value))
+	w.Header().Set("ETag", etag(value))
+	if notModified(r, value) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	//print in the page
+	fmt.Fprintf(w, "key: %s, value: %s \n", string(key), string(value))
 }
 // To handle the 'set' operation, the process initiates by extracting the key and value from the JSON format and check if 
 //they are not empty. If they are not empty we set the value in the tree and add the command to the wal.
-//If the tree has reached the maximum length it needs to be flushed to disk
-func SetHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+//If the tree has reached the maximum length it needs to be flushed to disk.
+//An optional ttl in seconds makes the key expire. The value may be empty.
+//The write can be made conditional with the If-Match and If-None-Match headers, in which case
+//a mismatch is answered with 412 Precondition Failed.
+func SetHandler(w http.ResponseWriter, r *http.Request, db Store) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -78,47 +88,51 @@ func SetHandler(w http.ResponseWriter, r *http.Request, db *DB) {
 	key := t.Key
 	value := t.Value
 
-	if key == "" || value == "" {
-		fmt.Println("key or value parameter is missing")
-		http.Error(w, "key or value parameter is missing", http.StatusBadRequest)
+	// an empty value is stored as such, it is not a deletion
+	if key == "" {
+		fmt.Println("key parameter is missing")
+		http.Error(w, "key parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if t.TTL < 0 {
+		http.Error(w, "ttl must not be negative", http.StatusBadRequest)
 		return
 	}
 	key1 := []byte(key)
 	value1 := []byte(value)
-	// set the value in the tree
-	err1 := db.tree.Set(key1, value1)
-	if err1 != nil {
-		http.Error(w, err1.Error(), http.StatusBadRequest)
+	ttl := time.Duration(t.TTL) * time.Second
+	if cond := preconditions(r); cond != nil {
+		ok, err := db.PutIf(key1, value1, ttl, cond)
+		if errors.Is(err, ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			http.Error(w, ErrPrecondition.Error(), http.StatusPreconditionFailed)
+			return
+		}
+	} else if err := db.PutWithTTL(key1, value1, ttl); errors.Is(err, ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
 		return
-	}
-	entry := Entry{
-		Key:     key1,
-		Value:   value1,
-		Command: Set,
-	}
-	// add the command to the wal
-	err = db.wal.AppendCommand(&entry)
-	if err != nil {
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	fmt.Println("Sets key: ", string(key), " value = ", string(value))
+	w.Header().Set("ETag", etag(value1))
 	fmt.Fprintf(w, "Sets key: %s, value: %s \n", string(key), string(value))
-
-	//if the tree has reached the maximum length it needs to be flushed to disk
-	if db.tree.Len() == max {
-		if err := FlushToDisk(db); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-	}
 }
 // To handle the 'del' operation, we first check if the given key is not null. 
 // If the key is found in the tree, the corresponding node is marked as deleted by changing its marker to 0.
 // If the key is not present in the tree, we search for it in the SSTables. If found, 
 // a deleted node (marked with 0) is created in the tree, and the deletion command is added to the WAL.
 // Additionally, if the tree has reached its maximum length, it needs to be flushed to disk to maintain efficiency.
-func DelHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+// Like the 'set' operation, the deletion honors the If-Match and If-None-Match headers.
+func DelHandler(w http.ResponseWriter, r *http.Request, db Store) {
 	key := r.URL.Query().Get("key")
 
 	if key == "" {
@@ -127,74 +141,160 @@ func DelHandler(w http.ResponseWriter, r *http.Request, db *DB) {
 		return
 	}
 	key1 := []byte(key)
-	// if the key is in the tree it will be deleted if not we search it the sstfiles
-	//if the key is there then we add it to the tree as a deleted one (marker = false)
-	err := db.tree.Del(key1)
-	if err == ErrKeynotfound {
-		//the key is not in the tree we should search if it in the sstfiles
-		value, err := db.sst.Search(key1)
-		if err == ErrDeleted || err == ErrKeynotfound {
-			fmt.Println("key not found")
-			http.Error(w, "key not found", http.StatusBadRequest)
-			return
-		}
-
-		// if we found it we will add it to the tree as a deleted key and to the wal  to keep it updated
-		entry := Entry{
-			Key:     key1,
-			Value:   value,
-			Command: Set,
-		}
-		err1 := db.wal.AppendCommand(&entry)
-		if err1 != nil {
-			http.Error(w, err1.Error(), http.StatusBadRequest)
-			return
-		}
-		//add it to the tree but the marker will be false
-		err = db.tree.SetDeletedKey(key1, value)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	var err error
+	if cond := preconditions(r); cond != nil {
+		var ok bool
+		ok, err = db.DeleteIf(key1, cond)
+		if err == nil && !ok {
+			http.Error(w, ErrPrecondition.Error(), http.StatusPreconditionFailed)
 			return
 		}
-	} else if err != nil {
-		//the key is already deleted in the tree
+	} else {
+		err = db.Delete(key1)
+	}
+	if err == ErrKeynotfound {
 		fmt.Println("key not found")
 		http.Error(w, "key not found", http.StatusBadRequest)
 		return
 	}
-	entry := Entry{
-		Key:     key1,
-		Command: Del,
+	if errors.Is(err, ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
-	err1 := db.wal.AppendCommand(&entry)
-	if err1 != nil {
-		http.Error(w, err1.Error(), http.StatusBadRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	fmt.Println("the deleted key: ", string(key))
 	fmt.Fprintf(w, "the deleted key: %s ", string(key))
-	//if the tree has reached the maximum length it needs to be flushed to disk
+}
 
-	if db.tree.Len() == max {
-		if err := FlushToDisk(db); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+// MergeValue is the payload of the 'merge' operation, Operator is the name of a registered merge operator.
+type MergeValue struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Operator string `json:"operator"`
+}
+
+// To handle the 'merge' operation, the key, the operand and the operator name are extracted from the JSON payload.
+// The operand is added to the wal and the tree without reading the current value of the key,
+// it is combined with that value when the key is read.
+func MergeHandler(w http.ResponseWriter, r *http.Request, db Store) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var t MergeValue
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Error decoding JSON data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t.Key == "" || t.Operator == "" {
+		fmt.Println("key or operator parameter is missing")
+		http.Error(w, "key or operator parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if err := db.Merge([]byte(t.Key), t.Operator, []byte(t.Value)); errors.Is(err, ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Println("Merges key: ", t.Key, " operand = ", t.Value, " operator = ", t.Operator)
+	fmt.Fprintf(w, "Merges key: %s, operand: %s, operator: %s \n", t.Key, t.Value, t.Operator)
+}
+
+// etag formats the version of a value as a quoted http entity tag.
+func etag(value []byte) string {
+	return fmt.Sprintf("\"%016x\"", Version(value))
+}
+
+// preconditions turns the If-Match and If-None-Match headers of a write into a condition
+// on the current value of the key. It returns nil when the request has neither header.
+// "If-Match: *" requires the key to exist and "If-None-Match: *" requires it to be absent.
+func preconditions(r *http.Request) func(current []byte, found bool) bool {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	return func(current []byte, found bool) bool {
+		if ifMatch != "" && !(found && etagMatches(ifMatch, current)) {
+			return false
+		}
+		if ifNoneMatch != "" && found && etagMatches(ifNoneMatch, current) {
+			return false
+		}
+		return true
+	}
+}
+
+// notModified reports whether the If-None-Match header of a read matches the value, in which case the
+// value the client already has is current and the read is answered with 304 Not Modified.
+func notModified(r *http.Request, value []byte) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	return ifNoneMatch != "" && etagMatches(ifNoneMatch, value)
+}
+
+// etagMatches checks whether a comma separated list of entity tags (or "*") matches the value.
+// Weak tags are compared like strong ones since the tag is a hash of the whole value.
+func etagMatches(header string, value []byte) bool {
+	tag := etag(value)
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
 		}
 	}
+	return false
+}
 
+// ReadOnlyHandler answers the routes that write when the server was started with -read-only.
+func ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, ErrReadOnly.Error(), http.StatusForbidden)
 }
 
-// The FlushToDisk function flushes the tree to disk, reinitializes the tree, and add
-// the watermark in the wal
+// The FlushToDisk function flushes the trees to disk, reinitializes them, and add
+// the watermark in the wal. The column families share the wal, so all of them are flushed
+// together for the watermark to cover the entries of every family.
 func FlushToDisk(db *DB) error {
-	err := db.sst.Flush(db.tree)
-	if err != nil {
+	if err := db.writable(); err != nil {
 		return err
 	}
-	err = db.tree.Reinitialize()
+	// the wal is synced first: without SyncWAL, a family flushed before a failure would otherwise hold
+	// writes that the wal loses for the other families in a crash, and a batch would be recovered in part
+	if err := db.wal.Sync(); err != nil {
+		return err
+	}
+	// the trees hold the entries up to the end of the wal, the manifest records this offset with each flushed
+	// file so that a crash before the watermark does not replay them a second time
+	walOffset, err := db.wal.size()
 	if err != nil {
 		return err
 	}
+	for _, cf := range db.families {
+		if cf.tree.Len() == 0 {
+			continue
+		}
+		err := cf.sst.flushUpTo(cf.tree, walOffset)
+		if err != nil {
+			return err
+		}
+		err = cf.tree.Reinitialize()
+		if err != nil {
+			return err
+		}
+		// the tree is emptied first: if the compaction fails, its entries are in the SSTables only once
+		err = cf.sst.compactIfFull()
+		if err != nil {
+			return err
+		}
+	}
+	// the SSTables are durable and recorded in the manifest, the wal can move past their entries
+	if err := crashPoint("sstables flushed"); err != nil {
+		return err
+	}
 	err = db.wal.WaterMark()
 	if err != nil {
 		return err
@@ -202,7 +302,297 @@ func FlushToDisk(db *DB) error {
 	return nil
 }
 
-// Default handler
+// FamilyHandler serves the operations of a column family on the routes /cf/{name}/get, /cf/{name}/set,
+// /cf/{name}/del and /cf/{name}/merge, which work like the routes of the default family.
+func FamilyHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/cf/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	cf, err := db.ColumnFamily(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	switch parts[1] {
+	case "get":
+		GetHandler(w, r, cf)
+	case "set":
+		SetHandler(w, r, cf)
+	case "del":
+		DelHandler(w, r, cf)
+	case "merge":
+		MergeHandler(w, r, cf)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// FamilyRequest is the payload that creates a column family, TTL is in seconds.
+type FamilyRequest struct {
+	Name        string `json:"name"`
+	Compression bool   `json:"compression,omitempty"`
+	FlushSize   int    `json:"flush_size,omitempty"`
+	TTL         int64  `json:"ttl,omitempty"`
+}
+
+// FamiliesHandler administers the column families on /admin/cf: GET lists their names,
+// POST creates one from a FamilyRequest and DELETE drops the one given by the name parameter.
+func FamiliesHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(db.ColumnFamilies())
+	case http.MethodPost:
+		var t FamilyRequest
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Error decoding JSON data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err := db.CreateColumnFamily(t.Name, FamilyOptions{
+			Compression: t.Compression,
+			FlushSize:   t.FlushSize,
+			TTL:         time.Duration(t.TTL) * time.Second,
+		})
+		if err == ErrFamilyExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Println("Creates column family: ", t.Name)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Creates column family: %s \n", t.Name)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		err := db.DropColumnFamily(name)
+		if err == ErrFamilyNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Println("Drops column family: ", name)
+		fmt.Fprintf(w, "Drops column family: %s \n", name)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// CheckpointRequest is the payload of POST /admin/checkpoint, the directory of the checkpoint on the server.
+type CheckpointRequest struct {
+	Dir string `json:"dir"`
+}
+
+// CheckpointHandler serves POST /admin/checkpoint, which writes a checkpoint of the database to the directory
+// of a CheckpointRequest with DB.Checkpoint. The directory must not exist.
+func CheckpointHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var t CheckpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Error decoding JSON data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t.Dir == "" {
+		http.Error(w, "dir parameter is missing", http.StatusBadRequest)
+		return
+	}
+	err := db.Checkpoint(t.Dir)
+	if errors.Is(err, ErrCheckpointExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Writes checkpoint: %s \n", t.Dir)
+}
+
+// IngestRequest is the payload of POST /admin/ingest, the paths on the server of the SSTables to ingest.
+type IngestRequest struct {
+	Files      []string `json:"files"`
+	Family     string   `json:"family"`
+	FlushFirst bool     `json:"flush_first"`
+}
+
+// IngestHandler serves POST /admin/ingest, which adds the SSTables of an IngestRequest to a column family
+// with DB.IngestExternalFiles.
+func IngestHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var t IngestRequest
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Error decoding JSON data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(t.Files) == 0 {
+		http.Error(w, "files parameter is missing", http.StatusBadRequest)
+		return
+	}
+	err := db.IngestExternalFiles(t.Files, IngestOptions{Family: t.Family, FlushFirst: t.FlushFirst})
+	switch {
+	case err == nil:
+		fmt.Fprintf(w, "Ingests files: %d \n", len(t.Files))
+	case errors.Is(err, ErrFamilyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrReadOnly):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrIngestOverlap):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrCorrupt), errors.Is(err, ErrEmptySSTable), errors.Is(err, os.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// BackupHandler serves /admin/backup for the backup directory of the server: GET lists the backups and POST
+// creates one and returns its description. With the keep parameter, POST then prunes the older backups so
+// that keep of them remain.
+func BackupHandler(w http.ResponseWriter, r *http.Request, db *DB, e *BackupEngine) {
+	switch r.Method {
+	case http.MethodGet:
+		backups, err := e.Backups()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backups)
+	case http.MethodPost:
+		keep := -1
+		if s := r.URL.Query().Get("keep"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				http.Error(w, "keep must be a positive number", http.StatusBadRequest)
+				return
+			}
+			keep = n
+		}
+		info, err := e.CreateBackup(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if keep > 0 {
+			if err := e.Prune(keep); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// exportOptions reads the family and base64 parameters of /admin/export and /admin/import.
+func exportOptions(r *http.Request) (ExportOptions, error) {
+	opts := ExportOptions{Family: r.URL.Query().Get("family")}
+	if s := r.URL.Query().Get("base64"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, errors.New("base64 must be true or false")
+		}
+		opts.Base64 = b
+	}
+	return opts, nil
+}
+
+// ExportHandler serves GET /admin/export, which streams the keys of a family as JSON Lines with DB.Export.
+func ExportHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	opts, err := exportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	out := &exportWriter{w: w}
+	err = db.Export(out, opts)
+	switch {
+	case err == nil:
+	case out.wrote:
+		// the records are streamed: once some are sent, the response is cut so that it is not taken as whole
+		fmt.Println("Fails to export: ", err)
+		panic(http.ErrAbortHandler)
+	case errors.Is(err, ErrFamilyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotUTF8):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// exportWriter records whether the export has written to the response, after which no error can be answered.
+type exportWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	e.wrote = true
+	return e.w.Write(p)
+}
+
+// ImportHandler serves POST /admin/import, which sets the keys of the JSON Lines of the body with DB.Import
+// and answers with the number of keys it set, also when it fails after some batches were written.
+func ImportHandler(w http.ResponseWriter, r *http.Request, db *DB) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	opts, err := exportOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imported, err := db.Import(r.Body, opts)
+	if err != nil {
+		msg := fmt.Sprintf("%v (imported %d keys)", err, imported)
+		switch {
+		case errors.Is(err, ErrFamilyNotFound):
+			http.Error(w, msg, http.StatusNotFound)
+		case errors.Is(err, ErrReadOnly):
+			http.Error(w, msg, http.StatusForbidden)
+		case errors.Is(err, ErrBadRecord):
+			http.Error(w, msg, http.StatusBadRequest)
+		default:
+			http.Error(w, msg, http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"imported": imported})
+}
+
+// Default handler, it answers the routes that do not exist with 404 Not Found.
 func DefaultHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Unknown command: %s\n", r.URL.Path)
+	http.Error(w, fmt.Sprintf("Unknown command: %s", r.URL.Path), http.StatusNotFound)
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// External SSTables are built outside of the database with an SSTWriter, for example by a bulk load, and
+// attached to a column family with DB.IngestExternalFiles without going through the tree or the wal.
+//
+// An ingested file is newer than every SSTable of the family: it gets the next sequence number, like a
+// flushed file, and the level 0. The tree is newer than the SSTables, so a key of the tree inside the key
+// range of an ingested file would hide the ingested value; such an ingestion fails with ErrIngestOverlap,
+// unless IngestOptions.FlushFirst flushes the trees before.
+
+var (
+	// ErrKeyOrder is returned by an SSTWriter when a key is not greater than the previous one.
+	ErrKeyOrder = errors.New("keys are not in ascending order")
+	// ErrEmptySSTable is returned when an SSTable without entries is written or ingested.
+	ErrEmptySSTable = errors.New("sstable has no entries")
+	// ErrIngestOverlap is returned by IngestExternalFiles when the tree of the family holds a key in the
+	// key range of an ingested file.
+	ErrIngestOverlap = errors.New("ingested keys overlap the memtable")
+)
+
+// SSTWriterOptions are the settings of an SSTWriter.
+type SSTWriterOptions struct {
+	// Compression compresses the key-value pairs of the file, like FamilyOptions.Compression.
+	Compression bool
+	// FS is the filesystem of the file, the one of the operating system if it is nil
+	FS vfs.FS
+}
+
+// An SSTWriter writes an SSTable from entries given in ascending order of their keys. The entries are held
+// in memory until Finish writes the file.
+type SSTWriter struct {
+	path  string
+	sst   *SStables
+	nodes []*Node
+}
+
+// NewSSTWriter returns a writer of the SSTable at path.
+func NewSSTWriter(path string, opts SSTWriterOptions) *SSTWriter {
+	if opts.FS == nil {
+		opts.FS = vfs.Default
+	}
+	return &SSTWriter{
+		path: path,
+		sst:  &SStables{path: filepath.Dir(path), compression: opts.Compression, fs: opts.FS},
+	}
+}
+
+// add appends the entry of a key, which must be greater than the key of the previous entry.
+func (w *SSTWriter) add(node *Node) error {
+	if n := len(w.nodes); n > 0 && bytes.Compare(node.Key, w.nodes[n-1].Key) <= 0 {
+		return fmt.Errorf("%w: %q after %q", ErrKeyOrder, node.Key, w.nodes[n-1].Key)
+	}
+	w.nodes = append(w.nodes, node)
+	return nil
+}
+
+// Put adds the value of a key. The key and the value are copied.
+func (w *SSTWriter) Put(key, value []byte) error {
+	return w.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL adds a value that expires after ttl, it never expires if ttl is 0.
+func (w *SSTWriter) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return w.add(&Node{
+		Key:       append([]byte{}, key...),
+		Value:     append([]byte{}, value...),
+		marker:    true,
+		expiresAt: expiry(ttl),
+	})
+}
+
+// Delete adds the deletion of a key, it hides the values of the key in the older SSTables.
+func (w *SSTWriter) Delete(key []byte) error {
+	return w.add(&Node{Key: append([]byte{}, key...)})
+}
+
+// Finish writes the file, under a temporary name that is renamed once the file is synced. It fails with
+// ErrEmptySSTable if no entry was added.
+func (w *SSTWriter) Finish() error {
+	if len(w.nodes) == 0 {
+		return ErrEmptySSTable
+	}
+	_, err := w.sst.writeFile(w.path, w.nodes)
+	w.nodes = nil
+	return err
+}
+
+// IngestOptions are the options of IngestExternalFiles.
+type IngestOptions struct {
+	// Family is the column family the files are added to, the default one if it is empty.
+	Family string
+	// FlushFirst flushes the trees when one of them overlaps the files, instead of failing with ErrIngestOverlap.
+	FlushFirst bool
+}
+
+// IngestExternalFiles adds the SSTables at paths to the column family. The files are checked, linked into
+// the directory of the family, or copied if they cannot be linked, and added to the manifest in a single
+// edit: either all of them are ingested or none is. The files are left in place. A later file of paths
+// is newer than an earlier one, so its values win where their keys overlap.
+func (db *DB) IngestExternalFiles(paths []string, opts IngestOptions) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	cf, err := db.exportFamily(opts.Family)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if cf.dropped {
+		return ErrFamilyNotFound
+	}
+	var external []*SStable
+	for _, path := range paths {
+		sstable, err := checkExternal(db.fs, path)
+		if err != nil {
+			return err
+		}
+		external = append(external, sstable)
+	}
+	if overlapsTree(cf.tree, external) {
+		if !opts.FlushFirst {
+			return ErrIngestOverlap
+		}
+		if err := FlushToDisk(db); err != nil {
+			return err
+		}
+	}
+	return cf.sst.ingest(external)
+}
+
+// checkExternal opens an SSTable to ingest and reads all of its entries, which must be sorted and match
+// the keys of its header.
+func checkExternal(fs vfs.FS, path string) (*SStable, error) {
+	corrupt := func(reason string) error {
+		return &CorruptionError{File: path, Reason: reason}
+	}
+	sstable, err := openSStable(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	sstable.name = path
+	nodes, err := sstable.entries()
+	if errors.Is(err, ErrCorrupt) {
+		return nil, corrupt("the entries do not match the checksum")
+	}
+	if err != nil {
+		return nil, corrupt(err.Error())
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%s: %w", path, ErrEmptySSTable)
+	}
+	for i := 1; i < len(nodes); i++ {
+		if bytes.Compare(nodes[i-1].Key, nodes[i].Key) >= 0 {
+			return nil, corrupt("the keys are not in ascending order")
+		}
+	}
+	if !bytes.Equal(nodes[0].Key, sstable.smallestKey) || !bytes.Equal(nodes[len(nodes)-1].Key, sstable.largestKey) {
+		return nil, corrupt("the keys do not match the header")
+	}
+	return sstable, nil
+}
+
+// overlapsTree reports whether a key of the tree, deleted keys included, is in the key range of one of the files.
+func overlapsTree(tree *Tree, files []*SStable) bool {
+	for it := tree.Iterator(); it.HasNext(); {
+		node, err := it.Next()
+		if err != nil {
+			return true
+		}
+		for _, f := range files {
+			if bytes.Compare(node.Key, f.smallestKey) >= 0 && bytes.Compare(node.Key, f.largestKey) <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ingest links the external files into the directory as the newest SSTables and records them in the
+// manifest. The links are deleted if the manifest does not record them; a crash before it leaves orphans
+// that are deleted when the database opens.
+func (s *SStables) ingest(external []*SStable) error {
+	fs := s.filesystem()
+	var added []*SStable
+	remove := func() {
+		for _, sstable := range added {
+			fs.Remove(sstable.name)
+		}
+	}
+	for _, ext := range external {
+		// the names are timestamps, two files written in a row can get the same one
+		name := filepath.Join(s.path, s.Name())
+		for _, err := fs.Stat(name); err == nil; _, err = fs.Stat(name) {
+			name = filepath.Join(s.path, s.Name())
+		}
+		if err := linkOrCopy(fs, ext.name, name); err != nil {
+			remove()
+			return err
+		}
+		sstable := *ext
+		sstable.name = name
+		sstable.fs = fs
+		sstable.level = 0
+		added = append(added, &sstable)
+	}
+	if err := fs.Sync(s.path); err != nil {
+		remove()
+		return err
+	}
+	if s.manifest != nil {
+		next := s.manifest.nextSequence()
+		for i, sstable := range added {
+			sstable.smallestSeq = next + int64(i)
+			sstable.largestSeq = sstable.smallestSeq
+		}
+	}
+	// the files are live once the manifest records them
+	if err := s.logEdit(added, nil, 0); err != nil {
+		remove()
+		return err
+	}
+	s.sstables = append(s.sstables, added...)
+	s.numOfSStable += len(added)
+	// a flush compacts when it makes maxFiles files, several ingested files can go past it
+	for s.numOfSStable >= maxFiles {
+		if err := s.Compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
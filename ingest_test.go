@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeExternal writes an SSTable of the keys, in order, with the value of each key in the file.
+func writeExternal(t *testing.T, path string, keys []string, value string) {
+	t.Helper()
+	w := NewSSTWriter(path, SSTWriterOptions{Compression: true})
+	for _, key := range keys {
+		if err := w.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	dir := t.TempDir()
+	external := t.TempDir()
+	db := openTestDB(t, dir)
+	users, err := db.CreateColumnFamily("users", FamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewSSTWriter(filepath.Join(external, "bad.sst"), SSTWriterOptions{})
+	w.Put([]byte("b"), []byte("1"))
+	if err := w.Put([]byte("a"), []byte("1")); !errors.Is(err, ErrKeyOrder) {
+		t.Fatalf("Expected ErrKeyOrder, but got %v", err)
+	}
+	if err := NewSSTWriter(filepath.Join(external, "empty.sst"), SSTWriterOptions{}).Finish(); err != ErrEmptySSTable {
+		t.Fatalf("Expected ErrEmptySSTable, but got %v", err)
+	}
+
+	db.Put([]byte("a"), []byte("flushed"))
+	db.Put([]byte("c"), []byte("flushed"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	first := filepath.Join(external, "first.sst")
+	second := filepath.Join(external, "second.sst")
+	writeExternal(t, first, []string{"a", "b"}, "first")
+	w = NewSSTWriter(second, SSTWriterOptions{})
+	w.Put([]byte("b"), []byte("second"))
+	w.Delete([]byte("c"))
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.IngestExternalFiles([]string{first, second}, IngestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// the ingested files are newer than the flushed one, and the second one is newer than the first
+	for key, want := range map[string]string{"a": "first", "b": "second"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s for %s, but got %s (%v)", want, key, value, err)
+		}
+	}
+	if _, err := db.Get([]byte("c")); err != ErrDeleted && err != ErrKeynotfound {
+		t.Fatalf("Expected c to be deleted by the ingested file, but got %v", err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Fatalf("Expected the ingested file to be left in place, but got %v", err)
+	}
+
+	// a key of the tree in the range of a file is newer than the file
+	db.Put([]byte("m"), []byte("tree"))
+	third := filepath.Join(external, "third.sst")
+	writeExternal(t, third, []string{"k", "n"}, "third")
+	if err := db.IngestExternalFiles([]string{third}, IngestOptions{}); !errors.Is(err, ErrIngestOverlap) {
+		t.Fatalf("Expected ErrIngestOverlap, but got %v", err)
+	}
+	if err := db.IngestExternalFiles([]string{third}, IngestOptions{FlushFirst: true}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("m")); err != nil || string(value) != "tree" {
+		t.Fatalf("Expected the flushed tree to be older than the ingested file, but got %s (%v)", value, err)
+	}
+	if value, err := db.Get([]byte("n")); err != nil || string(value) != "third" {
+		t.Fatalf("Expected the third file to be ingested, but got %s (%v)", value, err)
+	}
+
+	// a corrupt file is refused and nothing of the call is ingested
+	corrupt := filepath.Join(external, "corrupt.sst")
+	writeExternal(t, corrupt, []string{"x"}, "corrupt")
+	content, _ := os.ReadFile(corrupt)
+	content[len(content)-6] ^= 0xff
+	os.WriteFile(corrupt, content, 0644)
+	fourth := filepath.Join(external, "fourth.sst")
+	writeExternal(t, fourth, []string{"w"}, "fourth")
+	before := len(db.def.sst.sstables)
+	if err := db.IngestExternalFiles([]string{fourth, corrupt}, IngestOptions{}); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, but got %v", err)
+	}
+	if len(db.def.sst.sstables) != before {
+		t.Fatalf("Expected no file to be ingested, but got %d files instead of %d", len(db.def.sst.sstables), before)
+	}
+
+	// enough ingested files are compacted like flushed ones
+	var many []string
+	for i := 0; i < maxFiles; i++ {
+		path := filepath.Join(external, fmt.Sprintf("many%d.sst", i))
+		writeExternal(t, path, []string{fmt.Sprintf("many%02d", i)}, "many")
+		many = append(many, path)
+	}
+	if err := db.IngestExternalFiles(many, IngestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.def.sst.sstables) >= maxFiles {
+		t.Fatalf("Expected the files to be compacted, but found %d", len(db.def.sst.sstables))
+	}
+
+	// the ingested files are in the manifest, the reopened database has them
+	db.Close()
+	db = openTestDB(t, dir)
+	for key, want := range map[string]string{"a": "first", "b": "second", "m": "tree", "n": "third", "many09": "many"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s for %s after reopening, but got %s (%v)", want, key, value, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	body := bytes.NewBufferString(fmt.Sprintf(`{"files": [%q], "family": "users"}`, first))
+	IngestHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/ingest", body), db)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	users, _ = db.ColumnFamily("users")
+	if value, err := users.Get([]byte("a")); err != nil || string(value) != "first" {
+		t.Fatalf("Expected the file to be ingested in the family, but got %s (%v)", value, err)
+	}
+	rec = httptest.NewRecorder()
+	body = bytes.NewBufferString(fmt.Sprintf(`{"files": [%q]}`, filepath.Join(external, "missing.sst")))
+	IngestHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/ingest", body), db)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a missing file, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
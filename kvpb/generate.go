@@ -0,0 +1,4 @@
+// Package kvpb holds the gRPC KV service of the key-value store, generated from kv.proto.
+package kvpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kv.proto
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected the second open to fail with ErrLocked, but got %v", err)
+	}
+	if err := repair([]string{dir}, io.Discard); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected repair to refuse an open database, but got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(dir)
+	if err != nil {
+		t.Fatalf("Expected the lock to be released by Close, but got %v", err)
+	}
+	db.Close()
+}
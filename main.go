@@ -1,48 +1,169 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
-)
-
-const (
-	watermarkSize = 9 // Change this to the size of your watermark in bytes
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 // todo readme testing code
 // Todo make the count to flush to disk 100 and remove all the unnecessary fmt.println
 func main() {
-	//creating or opening the wal
-	f, err := os.OpenFile("wal.log", os.O_CREATE|os.O_APPEND, 0755)
-	if err != nil {
-		fmt.Println(err)
+	// kvstore sstdump ... runs a tool instead of the server
+	if runCommand(os.Args[1:]) {
 		return
 	}
-	defer f.Close()
-	wal := NewWal(f, "wal.log")
-	//creating a new db
-	db, err := NewDB(wal)
+	respAddr := flag.String("resp-addr", "", "address of the Redis (RESP) listener, for example :6379, none if empty")
+	memcacheAddr := flag.String("memcache-addr", "", "address of the memcached listener, for example :11211, none if empty")
+	grpcAddr := flag.String("grpc-addr", "", "address of the gRPC listener, for example :9090, none if empty")
+	paranoid := flag.Bool("paranoid", false, "refuse to start when an sstable is corrupt instead of quarantining it")
+	syncWAL := flag.Bool("sync-wal", false, "sync the wal after every write, so that it survives a crash of the machine")
+	flushOnShutdown := flag.Bool("flush-on-shutdown", false, "flush the memtable to sstables when the server is stopped, so that the next start has no wal to replay")
+	readOnly := flag.Bool("read-only", false, "open the database without writing to it, /set and /del are refused")
+	backupDir := flag.String("backup-dir", "", "backup directory of POST /admin/backup, the route is disabled if empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time given to the requests in flight when the server is stopped")
+	flag.Parse()
+
+	//opening the db, the wal and the sstfiles are in the current directory
+	db, err := OpenWithOptions(".", Options{Paranoid: *paranoid, SyncWAL: *syncWAL, ReadOnly: *readOnly})
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
+	// shutdown closes the database, the deferred Close is for the returns before it and then does nothing
+	defer db.Close()
+
+	http.HandleFunc(keysPrefix, func(w http.ResponseWriter, r *http.Request) {
+		KeysHandler(w, r, db)
+	})
+
+	http.HandleFunc("/v1/keys", func(w http.ResponseWriter, r *http.Request) {
+		ScanHandler(w, r, db)
+	})
+
+	http.HandleFunc("/v1/batch", func(w http.ResponseWriter, r *http.Request) {
+		BatchHandler(w, r, db)
+	})
+
+	http.HandleFunc("/v1/stats", func(w http.ResponseWriter, r *http.Request) {
+		StatsHandler(w, r, db)
+	})
 
+	// the routes below are kept for the clients of the first version of the api
 	http.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
 		GetHandler(w, r, db)
 	})
 
-	http.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
-		SetHandler(w, r, db)
+	// a read-only server refuses the routes that write, the other writes fail with ErrReadOnly
+	if *readOnly {
+		http.HandleFunc("/set", ReadOnlyHandler)
+		http.HandleFunc("/del", ReadOnlyHandler)
+	} else {
+		http.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+			SetHandler(w, r, db)
+		})
+
+		http.HandleFunc("/del", func(w http.ResponseWriter, r *http.Request) {
+			DelHandler(w, r, db)
+		})
+	}
+
+	http.HandleFunc("/merge", func(w http.ResponseWriter, r *http.Request) {
+		MergeHandler(w, r, db)
+	})
+
+	http.HandleFunc("/cf/", func(w http.ResponseWriter, r *http.Request) {
+		FamilyHandler(w, r, db)
+	})
+
+	http.HandleFunc("/admin/cf", func(w http.ResponseWriter, r *http.Request) {
+		FamiliesHandler(w, r, db)
+	})
+
+	http.HandleFunc("/admin/checkpoint", func(w http.ResponseWriter, r *http.Request) {
+		CheckpointHandler(w, r, db)
+	})
+
+	http.HandleFunc("/admin/export", func(w http.ResponseWriter, r *http.Request) {
+		ExportHandler(w, r, db)
+	})
+
+	http.HandleFunc("/admin/import", func(w http.ResponseWriter, r *http.Request) {
+		ImportHandler(w, r, db)
 	})
 
-	http.HandleFunc("/del", func(w http.ResponseWriter, r *http.Request) {
-		DelHandler(w, r, db)
+	http.HandleFunc("/admin/ingest", func(w http.ResponseWriter, r *http.Request) {
+		IngestHandler(w, r, db)
 	})
 
+	if *backupDir != "" {
+		engine, err := OpenBackupEngine(*backupDir, nil)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		http.HandleFunc("/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+			BackupHandler(w, r, db, engine)
+		})
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		DefaultHandler(w, r)
 	})
 
-	http.ListenAndServe(":8084", nil)
+	// the Redis, memcached and gRPC listeners run alongside the http server, against the same database
+	srv := servers{http: &http.Server{Addr: ":8084"}}
+	if *respAddr != "" {
+		ln, err := net.Listen("tcp", *respAddr)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		srv.listeners = append(srv.listeners, ln)
+		go ServeRESP(ln, db)
+	}
+	if *memcacheAddr != "" {
+		ln, err := net.Listen("tcp", *memcacheAddr)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		srv.listeners = append(srv.listeners, ln)
+		go ServeMemcache(ln, db)
+	}
+	if *grpcAddr != "" {
+		ln, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		srv.grpc = NewGRPCServer(db)
+		go srv.grpc.Serve(ln)
+	}
 
+	// SIGTERM and ctrl-c stop the server cleanly, see shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- srv.http.ListenAndServe()
+	}()
+	select {
+	case sig := <-stop:
+		fmt.Println("Shuts down on signal: ", sig)
+	case err := <-failed:
+		fmt.Println(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := shutdown(ctx, srv, db, *flushOnShutdown && !*readOnly); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// The MANIFEST is the log of the changes to the set of live SSTables of every column family. A flush adds
+// a file, a compaction adds its outputs and removes its inputs in a single edit, so that after a crash the
+// database loads exactly the files of the last edit that was written, whatever else is in the directories.
+// The SSTables that are not in the manifest are the outputs of an interrupted flush or compaction, or the
+// inputs of a finished compaction that were not deleted yet; they are deleted when the database opens.
+//
+// The manifest is named MANIFEST-<number> and the CURRENT file holds the name of the one in use. When the
+// database opens, and when the manifest grows over maxManifestSize, a new manifest holding the live files
+// is written and CURRENT is switched to it with a rename, so a crash leaves either the old or the new one.
+//
+// Each record of the manifest is its length (4 bytes), its crc32 (4 bytes) and a version edit:
+// the family name (2 bytes length), the last sequence number (8 bytes), the number of added files (4 bytes),
+// the added files, the number of removed files (4 bytes) and the names of the removed files (2 bytes length).
+// An added file is its name (2 bytes length), its level (2 bytes), its sequence range (8 bytes each) and its
+// smallest and largest keys (4 bytes length each). The edit of a flush ends with the offset of the wal (8 bytes)
+// before which the entries of the family are in its SSTables; an edit written without it is read as offset 0.
+//
+// The sequence numbers count the flushes of the database: a flushed file has a single one, and a compacted
+// file has the range of the files it was merged from. They order the files from the oldest to the newest.
+// The level of a flushed file is 0, a compacted file is one level above the highest of its inputs.
+//
+// The watermark is written to the wal after the flushed files are in the manifest, a crash in between
+// leaves entries after the last watermark that are already in the SSTables. Their offset in the wal tells
+// the replay to skip them, a merge operand is not added twice and an expired entry does not come back.
+
+var (
+	// ErrCorruptManifest is returned when a record of the manifest is corrupt, other than a torn last one.
+	ErrCorruptManifest = errors.New("corrupt manifest")
+)
+
+// maxManifestSize is the size above which the manifest is rewritten with only the live files.
+var maxManifestSize int64 = 4 << 20
+
+// versionEdit is a change to the set of live SSTables of a column family.
+type versionEdit struct {
+	family       string
+	lastSequence int64
+	// added are the new files, their names are relative to the directory of the family
+	added   []*SStable
+	removed []string
+	// walOffset is set by a flush, the entries of the family before this offset of the wal are in its SSTables
+	walOffset int64
+}
+
+type manifest struct {
+	// dir is the directory of the database, it holds CURRENT and the manifests
+	dir    string
+	fs     vfs.FS
+	number int
+	file   vfs.File
+	size   int64
+	// files are the live SSTables of each family from the oldest to the newest, their names are relative
+	files        map[string][]*SStable
+	lastSequence int64
+	// walOffsets are the offsets of the wal before which the entries of each family are in its SSTables
+	walOffsets map[string]int64
+	// bootstrap is set when the database had no manifest yet, its SSTables are then the ones of the directories
+	bootstrap bool
+	// broken is set when an edit that failed may be in the file, the manifest is rotated before the next edit
+	broken bool
+}
+
+// loadManifest reads the manifest named by the CURRENT file of dir. The manifest is not opened for writing
+// until rotate is called. A torn record at the end of the manifest, one that runs past the end of the file,
+// is an edit that was not committed, it is ignored. Any other damaged record is ErrCorruptManifest, the database
+// does not open then and no file is deleted.
+func loadManifest(fs vfs.FS, dir string) (*manifest, error) {
+	m := &manifest{dir: dir, fs: fs, files: map[string][]*SStable{}, walOffsets: map[string]int64{}}
+	current, err := vfs.ReadFile(fs, filepath.Join(dir, "CURRENT"))
+	if os.IsNotExist(err) {
+		m.bootstrap = true
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(string(current))
+	number, err := strconv.Atoi(strings.TrimPrefix(name, "MANIFEST-"))
+	if err != nil || !strings.HasPrefix(name, "MANIFEST-") {
+		return nil, fmt.Errorf("%w: CURRENT names %q", ErrCorruptManifest, name)
+	}
+	m.number = number
+	data, err := vfs.ReadFile(fs, filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	for offset := 0; offset < len(data); {
+		record := data[offset:]
+		if len(record) < 8 || decodeInt(record[:4]) > len(record)-8 {
+			// a record that runs past the end of the file can only be a torn last record, unless the records
+			// that follow it are still there and it is its length that is damaged
+			if next := findRecord(record[1:]); next >= 0 {
+				return nil, fmt.Errorf("%w: the length of the record at offset %d runs over the record at offset %d",
+					ErrCorruptManifest, offset, offset+1+next)
+			}
+			break
+		}
+		n := decodeInt(record[:4])
+		payload := record[8 : 8+n]
+		if crc32.ChecksumIEEE(payload) != uint32(decodeInt(record[4:8])) {
+			return nil, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptManifest, offset)
+		}
+		e, err := decodeEdit(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: offset %d: %v", ErrCorruptManifest, offset, err)
+		}
+		m.apply(e)
+		offset += 8 + n
+	}
+	return m, nil
+}
+
+// findRecord returns the offset of the first complete record with a valid checksum in data, -1 if there is none.
+func findRecord(data []byte) int {
+	for i := 0; i+8 <= len(data); i++ {
+		n := decodeInt(data[i : i+4])
+		if n == 0 || n > len(data)-i-8 {
+			continue
+		}
+		if crc32.ChecksumIEEE(data[i+8:i+8+n]) == uint32(decodeInt(data[i+4:i+8])) {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply changes the live files of the family, keeping them ordered by sequence number.
+func (m *manifest) apply(e *versionEdit) {
+	removed := map[string]bool{}
+	for _, name := range e.removed {
+		removed[name] = true
+	}
+	var files []*SStable
+	for _, f := range m.files[e.family] {
+		if !removed[f.name] {
+			files = append(files, f)
+		}
+	}
+	files = append(files, e.added...)
+	sort.SliceStable(files, func(i, j int) bool { return files[i].smallestSeq < files[j].smallestSeq })
+	m.files[e.family] = files
+	if e.lastSequence > m.lastSequence {
+		m.lastSequence = e.lastSequence
+	}
+	if e.walOffset > m.walOffsets[e.family] {
+		if m.walOffsets == nil {
+			m.walOffsets = map[string]int64{}
+		}
+		m.walOffsets[e.family] = e.walOffset
+	}
+}
+
+// log appends the edit to the manifest and syncs it, the edit is committed once log returns.
+// An edit that fails is not committed: if it may still be in the file, the manifest is replaced
+// by a new one with the live files, right away if it can be written or else before the next edit.
+func (m *manifest) log(e *versionEdit) error {
+	if m.broken {
+		if err := m.rotate(); err != nil {
+			return err
+		}
+	}
+	if e.lastSequence < m.lastSequence {
+		e.lastSequence = m.lastSequence
+	}
+	record := encodeRecord(encodeEdit(e))
+	if _, err := m.file.Write(record); err != nil {
+		// a part of the record may have been written, the next records must not follow it
+		if m.file.Truncate(m.size) != nil {
+			m.broken = true
+		} else if _, err := m.file.Seek(m.size, io.SeekStart); err != nil {
+			m.broken = true
+		}
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		// the record may reach the disk later or not at all, a truncation would not be durable either,
+		// so the edit is left out by a new manifest
+		m.broken = true
+		m.rotate()
+		return err
+	}
+	m.size += int64(len(record))
+	m.apply(e)
+	if m.size > maxManifestSize {
+		return m.rotate()
+	}
+	return nil
+}
+
+// nextSequence returns the sequence number of the next flushed file.
+func (m *manifest) nextSequence() int64 {
+	return m.lastSequence + 1
+}
+
+// rotate writes a new manifest holding the live files and switches CURRENT to it. The old manifest is deleted.
+func (m *manifest) rotate() error {
+	number := m.number + 1
+	name := fmt.Sprintf("MANIFEST-%06d", number)
+	var content bytes.Buffer
+	families := make([]string, 0, len(m.files))
+	for family := range m.files {
+		families = append(families, family)
+	}
+	for family := range m.walOffsets {
+		if _, ok := m.files[family]; !ok {
+			families = append(families, family)
+		}
+	}
+	sort.Strings(families)
+	for _, family := range families {
+		content.Write(encodeRecord(encodeEdit(&versionEdit{
+			family:       family,
+			lastSequence: m.lastSequence,
+			added:        m.files[family],
+			walOffset:    m.walOffsets[family],
+		})))
+	}
+	if len(families) == 0 {
+		// the last sequence number is kept even without files
+		content.Write(encodeRecord(encodeEdit(&versionEdit{family: defaultFamily, lastSequence: m.lastSequence})))
+	}
+	file, err := m.fs.Create(filepath.Join(m.dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writeFileAtomic(m.fs, filepath.Join(m.dir, "CURRENT"), []byte(name+"\n")); err != nil {
+		file.Close()
+		return err
+	}
+	if m.file != nil {
+		m.file.Close()
+	}
+	if m.number > 0 {
+		m.fs.Remove(filepath.Join(m.dir, fmt.Sprintf("MANIFEST-%06d", m.number)))
+	}
+	m.file = file
+	m.number = number
+	m.size = int64(content.Len())
+	m.bootstrap = false
+	m.broken = false
+	return nil
+}
+
+// Close closes the manifest.
+func (m *manifest) Close() error {
+	if m.file == nil {
+		return nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
+
+// writeFileAtomic replaces the file with the data: the data is written to a temporary file, synced,
+// renamed over the file and the directory is synced, so that a crash leaves either the old or the new content.
+func writeFileAtomic(fs vfs.FS, name string, data []byte) error {
+	tmp := name + ".tmp"
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp, name); err != nil {
+		return err
+	}
+	return fs.Sync(filepath.Dir(name))
+}
+
+// encodeRecord frames a record of the manifest with its length and its checksum.
+func encodeRecord(payload []byte) []byte {
+	res := make([]byte, 0, len(payload)+8)
+	res = append(res, encodeInt(len(payload))...)
+	res = append(res, encodeInt(int(crc32.ChecksumIEEE(payload)))...)
+	return append(res, payload...)
+}
+
+func encodeEdit(e *versionEdit) []byte {
+	var res []byte
+	res = append(res, encodeNum(len(e.family))...)
+	res = append(res, e.family...)
+	res = append(res, encodeInt64(e.lastSequence)...)
+	res = append(res, encodeInt(len(e.added))...)
+	for _, f := range e.added {
+		res = append(res, encodeNum(len(f.name))...)
+		res = append(res, f.name...)
+		res = append(res, encodeNum(f.level)...)
+		res = append(res, encodeInt64(f.smallestSeq)...)
+		res = append(res, encodeInt64(f.largestSeq)...)
+		res = append(res, encodeInt(len(f.smallestKey))...)
+		res = append(res, f.smallestKey...)
+		res = append(res, encodeInt(len(f.largestKey))...)
+		res = append(res, f.largestKey...)
+	}
+	res = append(res, encodeInt(len(e.removed))...)
+	for _, name := range e.removed {
+		res = append(res, encodeNum(len(name))...)
+		res = append(res, name...)
+	}
+	if e.walOffset > 0 {
+		res = append(res, encodeInt64(e.walOffset)...)
+	}
+	return res
+}
+
+func decodeEdit(payload []byte) (*versionEdit, error) {
+	r := bytes.NewReader(payload)
+	readNum := func() (int, error) {
+		buf, err := readN(r, 2)
+		if err != nil {
+			return 0, err
+		}
+		return decodeNum(buf), nil
+	}
+	readInt := func() (int, error) {
+		buf, err := readN(r, 4)
+		if err != nil {
+			return 0, err
+		}
+		return decodeInt(buf), nil
+	}
+	readInt64 := func() (int64, error) {
+		buf, err := readN(r, 8)
+		if err != nil {
+			return 0, err
+		}
+		return decodeInt64(buf), nil
+	}
+	readBytes := func(n int, err error) ([]byte, error) {
+		if err != nil {
+			return nil, err
+		}
+		if n > r.Len() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return readN(r, n)
+	}
+	e := &versionEdit{}
+	family, err := readBytes(readNum())
+	if err != nil {
+		return nil, err
+	}
+	e.family = string(family)
+	if e.lastSequence, err = readInt64(); err != nil {
+		return nil, err
+	}
+	added, err := readInt()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < added; i++ {
+		f := &SStable{}
+		name, err := readBytes(readNum())
+		if err != nil {
+			return nil, err
+		}
+		f.name = string(name)
+		if f.level, err = readNum(); err != nil {
+			return nil, err
+		}
+		if f.smallestSeq, err = readInt64(); err != nil {
+			return nil, err
+		}
+		if f.largestSeq, err = readInt64(); err != nil {
+			return nil, err
+		}
+		if f.smallestKey, err = readBytes(readInt()); err != nil {
+			return nil, err
+		}
+		if f.largestKey, err = readBytes(readInt()); err != nil {
+			return nil, err
+		}
+		e.added = append(e.added, f)
+	}
+	removed, err := readInt()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < removed; i++ {
+		name, err := readBytes(readNum())
+		if err != nil {
+			return nil, err
+		}
+		e.removed = append(e.removed, string(name))
+	}
+	if r.Len() > 0 {
+		if e.walOffset, err = readInt64(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	for i := 0; i < maxFiles+1; i++ {
+		db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i)))
+		if err := FlushToDisk(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the compaction merged the files two by two, the last flush came after it
+	files := db.def.sst.sstables
+	if len(files) != maxFiles/2+1 || files[0].level != 1 || files[0].smallestSeq != 1 || files[0].largestSeq != 2 ||
+		files[len(files)-1].level != 0 || files[len(files)-1].smallestSeq != int64(maxFiles+1) {
+		t.Fatalf("Unexpected files after the compaction: %+v", files[0])
+	}
+	live := db.def.sst.sstables[0].name
+	db.Close()
+
+	// an orphan left by an interrupted compaction is deleted, a torn edit at the end of the manifest is ignored
+	orphan := filepath.Join(dir, "sstFiles", "file1.sst")
+	content, _ := os.ReadFile(live)
+	os.WriteFile(orphan, content, 0644)
+	current, _ := os.ReadFile(filepath.Join(dir, "CURRENT"))
+	f, _ := os.OpenFile(filepath.Join(dir, string(bytes.TrimSpace(current))), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(encodeRecord(encodeEdit(&versionEdit{family: defaultFamily, removed: []string{filepath.Base(live)}}))[:20])
+	f.Close()
+
+	db = openTestDB(t, dir)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("Expected the orphan to be deleted, but got %v", err)
+	}
+	if len(db.def.sst.sstables) != maxFiles/2+1 || db.def.sst.sstables[0].name != live || db.def.sst.sstables[0].level != 1 {
+		t.Fatalf("Expected the files of the manifest, but got %+v", db.def.sst.sstables[0])
+	}
+	for i := 0; i < maxFiles+1; i++ {
+		if value, err := db.Get([]byte(fmt.Sprintf("k%02d", i))); err != nil || string(value) != fmt.Sprint(i) {
+			t.Fatalf("Expected k%02d to be %d, but got %s (%v)", i, i, value, err)
+		}
+	}
+	manifests, _ := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+	if len(manifests) != 1 {
+		t.Fatalf("Expected the old manifest to be deleted, but found %v", manifests)
+	}
+	db.Close()
+
+	// a live file that is missing stops the opening until the database is repaired
+	os.Remove(live)
+	if _, err := Open(dir); !errors.Is(err, ErrCorruptManifest) {
+		t.Fatalf("Expected a missing file to be an error, but got %v", err)
+	}
+	var out bytes.Buffer
+	if err := repair([]string{dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, dir)
+	if _, err := db.Get([]byte("k00")); err != ErrKeynotfound {
+		t.Fatalf("Expected the keys of the missing file to be lost, but got %v", err)
+	}
+	if value, err := db.Get([]byte("k02")); err != nil || string(value) != "2" {
+		t.Fatalf("Expected k02 to be 2, but got %s (%v)", value, err)
+	}
+}
+
+func TestManifestCorruptRecord(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		damage func(record []byte)
+	}{
+		// the record seems to run past the end of the file, but the records that follow it are there
+		{"length", func(record []byte) { record[0] = 0x7f }},
+		{"checksum", func(record []byte) { record[len(record)-1] ^= 0xff }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := openTestDB(t, dir)
+			for i := 0; i < 3; i++ {
+				db.Put([]byte(fmt.Sprint(i)), []byte("v"))
+				if err := FlushToDisk(db); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Close()
+			ssts, _ := filepath.Glob(filepath.Join(dir, "sstFiles", "*.sst"))
+
+			// the record before the last one is damaged
+			current, _ := os.ReadFile(filepath.Join(dir, "CURRENT"))
+			name := filepath.Join(dir, string(bytes.TrimSpace(current)))
+			data, _ := os.ReadFile(name)
+			var offsets []int
+			for offset := 0; offset < len(data); offset += 8 + decodeInt(data[offset:offset+4]) {
+				offsets = append(offsets, offset)
+			}
+			if len(offsets) < 3 {
+				t.Fatalf("Expected at least 3 records, but found %d", len(offsets))
+			}
+			c.damage(data[offsets[len(offsets)-2]:offsets[len(offsets)-1]])
+			os.WriteFile(name, data, 0644)
+
+			if _, err := Open(dir); !errors.Is(err, ErrCorruptManifest) {
+				t.Fatalf("Expected ErrCorruptManifest, but got %v", err)
+			}
+			for _, sst := range ssts {
+				if _, err := os.Stat(sst); err != nil {
+					t.Fatalf("Expected %s to be kept, but got %v", sst, err)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestBootstrap(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	db.Put([]byte("k"), []byte("old"))
+	FlushToDisk(db)
+	db.Put([]byte("k"), []byte("new"))
+	FlushToDisk(db)
+	db.Close()
+
+	// a database written before the manifest existed is loaded from its directories, in the order of the names
+	manifests, _ := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+	for _, name := range append(manifests, filepath.Join(dir, "CURRENT")) {
+		os.Remove(name)
+	}
+	db = openTestDB(t, dir)
+	if value, err := db.Get([]byte("k")); err != nil || string(value) != "new" {
+		t.Fatalf("Expected the newest file to win, but got %s (%v)", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "CURRENT")); err != nil {
+		t.Fatalf("Expected a manifest to be written, but got %v", err)
+	}
+	if files := db.def.sst.sstables; files[0].smallestSeq != 1 || files[1].smallestSeq != 2 {
+		t.Fatalf("Expected the files to be numbered in the order of their names, but got %d and %d", files[0].smallestSeq, files[1].smallestSeq)
+	}
+}
+
+func TestManifestCompactionFaults(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	db, err := OpenWithOptions("db", Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	flush := func(i int) error {
+		db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i)))
+		db.Merge([]byte("count"), "add", []byte("1"))
+		return FlushToDisk(db)
+	}
+	for i := 1; i < maxFiles; i++ {
+		if err := flush(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the inputs of the compaction cannot be deleted, the compaction is committed all the same
+	fs.SetFault(func(op, name string) error {
+		if op == "remove" && strings.HasSuffix(name, ".sst") {
+			return vfs.ErrInjected
+		}
+		return nil
+	})
+	if err := flush(maxFiles); err != nil {
+		t.Fatalf("Expected the compaction to ignore the inputs it cannot delete, but got %v", err)
+	}
+	fs.SetFault(nil)
+	if n := len(db.def.sst.sstables); n != maxFiles/2 || db.def.sst.numOfSStable != n {
+		t.Fatalf("Expected the outputs of the compaction to replace its inputs, but got %d files", n)
+	}
+	for i := maxFiles + 1; i < maxFiles+maxFiles/2; i++ {
+		if err := flush(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the edit of the compaction fails after the one of the flush, the flushed entries are not counted twice
+	writes := 0
+	fs.SetFault(func(op, name string) error {
+		if op == "write" && strings.Contains(name, "MANIFEST") {
+			if writes++; writes == 2 {
+				return vfs.ErrInjected
+			}
+		}
+		return nil
+	})
+	if err := flush(maxFiles + maxFiles/2); !errors.Is(err, vfs.ErrInjected) {
+		t.Fatalf("Expected the compaction to fail, but got %v", err)
+	}
+	fs.SetFault(nil)
+	check := func(count int) {
+		t.Helper()
+		if value, err := db.Get([]byte("count")); err != nil || string(value) != fmt.Sprint(count) {
+			t.Fatalf("Expected count=%d, but got %s (%v)", count, value, err)
+		}
+		for i := 1; i < count; i++ {
+			if value, err := db.Get([]byte(fmt.Sprintf("k%02d", i))); err != nil || string(value) != fmt.Sprint(i) {
+				t.Fatalf("Expected k%02d to be %d, but got %s (%v)", i, i, value, err)
+			}
+		}
+	}
+	check(maxFiles + maxFiles/2)
+	// the next flush compacts again
+	if err := flush(maxFiles + maxFiles/2 + 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.def.sst.sstables); n >= maxFiles {
+		t.Fatalf("Expected the next flush to compact, but got %d files", n)
+	}
+	check(maxFiles + maxFiles/2 + 1)
+	db.Close()
+	if db, err = OpenWithOptions("db", Options{FS: fs}); err != nil {
+		t.Fatal(err)
+	}
+	check(maxFiles + maxFiles/2 + 1)
+}
+
+func TestManifestSyncFailure(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// failures is the number of syncs of the manifests that fail
+		failures int
+	}{
+		{"rotated at once", 1},
+		{"rotated before the next edit", 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := vfs.NewFaultFS(vfs.NewMemFS())
+			db, err := OpenWithOptions("db", Options{FS: fs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			db.Put([]byte("a"), []byte("1"))
+			if err := FlushToDisk(db); err != nil {
+				t.Fatal(err)
+			}
+			// the edit of the flush is written but not synced, the file it adds is deleted
+			failures := tt.failures
+			fs.SetFault(func(op, name string) error {
+				if op == "sync" && strings.Contains(name, "MANIFEST") && failures > 0 {
+					failures--
+					return vfs.ErrInjected
+				}
+				return nil
+			})
+			db.Put([]byte("b"), []byte("2"))
+			if err := FlushToDisk(db); !errors.Is(err, vfs.ErrInjected) {
+				t.Fatalf("Expected the flush to fail, but got %v", err)
+			}
+			fs.SetFault(nil)
+			db.Put([]byte("c"), []byte("3"))
+			if err := FlushToDisk(db); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Crash(); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+			if db, err = OpenWithOptions("db", Options{FS: fs}); err != nil {
+				t.Fatalf("Expected the manifest to leave out the failed edit, but got %v", err)
+			}
+			for _, key := range []string{"a", "b", "c"} {
+				if _, err := db.Get([]byte(key)); err != nil {
+					t.Fatalf("Expected %s after the failed sync, but got %v", key, err)
+				}
+			}
+		})
+	}
+}
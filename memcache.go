@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The memcached listener serves the ASCII protocol of memcached for the default column family.
+// The values of the items are those of the keys, so the other front ends see them, and the expiration time
+// of an item is the TTL of the key. The flags of the items and their cas uniques, a version of the key that
+// changes with every write, are kept in the memcache column family, written with the values.
+
+var (
+	errMemcacheNotFound = errors.New("NOT_FOUND")
+	errMemcacheExists   = errors.New("EXISTS")
+	errMemcacheNotNum   = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+	errMemcacheFormat   = errors.New("CLIENT_ERROR bad command line format")
+	// errMemcacheReadOnly answers the storage commands of a read-only server, the item is not stored
+	errMemcacheReadOnly = errors.New("SERVER_ERROR read only")
+)
+
+const (
+	// memcacheMaxKey is the longest key accepted by memcached
+	memcacheMaxKey = 250
+	// memcacheMaxValue is the largest value accepted by a storage command
+	memcacheMaxValue = 64 << 20
+	// memcacheRelative is the largest expiration time counted in seconds from now,
+	// a larger one is a unix time
+	memcacheRelative = 60 * 60 * 24 * 30
+)
+
+// ServeMemcache accepts the connections of the listener and serves the memcached commands of each of them
+// until the listener is closed.
+func ServeMemcache(ln net.Listener, db *DB) error {
+	if _, err := db.ColumnFamily(memcacheFamily); err == ErrFamilyNotFound && db.writable() == nil {
+		if _, err := db.CreateColumnFamily(memcacheFamily, FamilyOptions{}); err != nil && err != ErrFamilyExists {
+			return err
+		}
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveMemcacheConn(conn, db)
+	}
+}
+
+func serveMemcacheConn(conn net.Conn, db *DB) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return
+		}
+		args := strings.Fields(string(line))
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if args[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := execMemcache(db, r, w, args); err != nil {
+			// the data of the command could not be read, the connection is out of sync
+			w.WriteString(err.Error() + "\r\n")
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execMemcache runs a command and writes its reply. It only returns an error when the connection must be closed.
+func execMemcache(db *DB, r *bufio.Reader, w *bufio.Writer, args []string) error {
+	name := args[0]
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	reply := func(msg string) {
+		if !noreply {
+			w.WriteString(msg + "\r\n")
+		}
+	}
+	replyErr := func(err error) {
+		if errors.Is(err, ErrReadOnly) {
+			err = errMemcacheReadOnly
+		}
+		switch err {
+		case errMemcacheNotFound, errMemcacheExists, errMemcacheNotNum, errMemcacheFormat, errMemcacheReadOnly:
+			reply(err.Error())
+		default:
+			reply("SERVER_ERROR " + err.Error())
+		}
+	}
+	if len(args) > 1 && len(args[1]) > memcacheMaxKey {
+		if name == "set" || name == "add" || name == "replace" || name == "cas" {
+			// the data of the item still has to be skipped
+			if _, err := readMemcacheData(r, args); err != nil {
+				return err
+			}
+		}
+		reply("CLIENT_ERROR key too long")
+		return nil
+	}
+	switch name {
+	case "get", "gets":
+		if len(args) < 2 {
+			w.WriteString("ERROR\r\n")
+			return nil
+		}
+		for _, key := range args[1:] {
+			item, err := memcacheGet(db, []byte(key))
+			if err != nil || item == nil {
+				continue
+			}
+			if name == "gets" {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.value), item.cas)
+			} else {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.flags, len(item.value))
+			}
+			w.Write(item.value)
+			w.WriteString("\r\n")
+		}
+		w.WriteString("END\r\n")
+	case "set", "add", "replace", "cas":
+		value, err := readMemcacheData(r, args)
+		if err != nil {
+			return err
+		}
+		if (name == "cas" && len(args) != 6) || (name != "cas" && len(args) != 5) {
+			reply(errMemcacheFormat.Error())
+			return nil
+		}
+		flags, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil {
+			reply(errMemcacheFormat.Error())
+			return nil
+		}
+		ttl, err := memcacheTTL(args[3])
+		if err != nil {
+			reply(errMemcacheFormat.Error())
+			return nil
+		}
+		cond := func(current *memcacheItem) error { return nil }
+		switch name {
+		case "add":
+			cond = func(current *memcacheItem) error {
+				if current != nil {
+					return errMemcacheExists
+				}
+				return nil
+			}
+		case "replace":
+			cond = func(current *memcacheItem) error {
+				if current == nil {
+					return errMemcacheNotFound
+				}
+				return nil
+			}
+		case "cas":
+			unique, err := strconv.ParseUint(args[5], 10, 64)
+			if err != nil {
+				reply(errMemcacheFormat.Error())
+				return nil
+			}
+			cond = func(current *memcacheItem) error {
+				if current == nil {
+					return errMemcacheNotFound
+				}
+				if current.cas != unique {
+					return errMemcacheExists
+				}
+				return nil
+			}
+		}
+		err = memcacheStore(db, []byte(args[1]), value, uint32(flags), ttl, cond)
+		if name != "cas" && (err == errMemcacheExists || err == errMemcacheNotFound) {
+			// add and replace answer NOT_STORED, only cas tells the two cases apart
+			reply("NOT_STORED")
+		} else if err != nil {
+			replyErr(err)
+		} else {
+			reply("STORED")
+		}
+	case "delete":
+		if len(args) != 2 {
+			reply(errMemcacheFormat.Error())
+			return nil
+		}
+		err := memcacheStore(db, []byte(args[1]), nil, 0, -1, func(current *memcacheItem) error {
+			if current == nil {
+				return errMemcacheNotFound
+			}
+			return nil
+		})
+		if err == errMemcacheNotFound {
+			reply(errMemcacheNotFound.Error())
+		} else if err != nil {
+			replyErr(err)
+		} else {
+			reply("DELETED")
+		}
+	case "incr", "decr":
+		if len(args) != 3 {
+			reply(errMemcacheFormat.Error())
+			return nil
+		}
+		delta, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid numeric delta argument")
+			return nil
+		}
+		n, err := memcacheIncr(db, []byte(args[1]), delta, name == "decr")
+		if err != nil {
+			replyErr(err)
+			return nil
+		}
+		reply(strconv.FormatUint(n, 10))
+	case "touch":
+		if len(args) != 3 {
+			reply(errMemcacheFormat.Error())
+			return nil
+		}
+		ttl, err := memcacheTTL(args[2])
+		if err != nil {
+			reply(errMemcacheFormat.Error())
+			return nil
+		}
+		err = memcacheStore(db, []byte(args[1]), nil, 0, ttl, func(current *memcacheItem) error {
+			if current == nil {
+				return errMemcacheNotFound
+			}
+			return nil
+		})
+		if err != nil {
+			replyErr(err)
+		} else {
+			reply("TOUCHED")
+		}
+	case "version":
+		w.WriteString("VERSION kvstore\r\n")
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// readMemcacheData reads the data block that follows a storage command, its size is the fifth word of the command.
+func readMemcacheData(r *bufio.Reader, args []string) ([]byte, error) {
+	if len(args) < 5 {
+		return nil, errMemcacheFormat
+	}
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 || size > memcacheMaxValue {
+		return nil, errMemcacheFormat
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if string(data[size:]) != "\r\n" {
+		return nil, errors.New("CLIENT_ERROR bad data chunk")
+	}
+	return data[:size], nil
+}
+
+// memcacheTTL converts an expiration time into a ttl: 0 is never, up to 30 days it is a number of seconds
+// and above a unix time. An expiration time in the past gives a negative ttl.
+func memcacheTTL(exptime string) (time.Duration, error) {
+	n, err := strconv.ParseInt(exptime, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case n == 0:
+		return 0, nil
+	case n < 0:
+		return -1, nil
+	case n <= memcacheRelative:
+		return time.Duration(n) * time.Second, nil
+	}
+	ttl := time.Unix(n, 0).Sub(now())
+	if ttl <= 0 {
+		return -1, nil
+	}
+	return ttl, nil
+}
+
+// memcacheFamily is the column family of the flags and the cas uniques of the items.
+const memcacheFamily = "memcache"
+
+// A memcacheItem is the value of a key with the flags given by the client and its cas unique.
+type memcacheItem struct {
+	value []byte
+	flags uint32
+	cas   uint64
+}
+
+// encodeMemcacheMeta encodes the flags and the cas unique of the item with the Version of its value,
+// which tells whether the value was written through another front end since.
+func encodeMemcacheMeta(item *memcacheItem) []byte {
+	meta := make([]byte, 20)
+	binary.BigEndian.PutUint32(meta, item.flags)
+	binary.BigEndian.PutUint64(meta[4:], item.cas)
+	binary.BigEndian.PutUint64(meta[12:], Version(item.value))
+	return meta
+}
+
+// lookupMemcacheItem returns the item of the key, nil if there is none, and when it expires.
+// The lock of the database must be held.
+func lookupMemcacheItem(db *DB, key []byte) (*memcacheItem, int64, error) {
+	value, expiresAt, err := db.def.lookup(key)
+	if err == ErrKeynotfound {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	// a value written through another front end has no flags and its Version is its cas unique
+	item := &memcacheItem{value: value, cas: Version(value)}
+	if cf, ok := db.families[memcacheFamily]; ok {
+		meta, _, err := cf.lookup(key)
+		if err != nil && err != ErrKeynotfound {
+			return nil, 0, err
+		}
+		if len(meta) == 20 && binary.BigEndian.Uint64(meta[12:]) == Version(value) {
+			item.flags = binary.BigEndian.Uint32(meta)
+			item.cas = binary.BigEndian.Uint64(meta[4:])
+		}
+	}
+	return item, expiresAt, nil
+}
+
+// memcacheGet returns the item of the key, nil if there is none.
+func memcacheGet(db *DB, key []byte) (*memcacheItem, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	item, _, err := lookupMemcacheItem(db, key)
+	return item, err
+}
+
+// memcacheUpdate replaces the item of the key by the one fn returns from the current item, nil if there is
+// none, or deletes it if fn returns nil. The value expires after ttl, or when the current one does with KeepTTL,
+// and the flags are written with it in the same batch. The item gets a new cas unique, unless fn gives it one.
+// A unique is never smaller than the time, so a key deleted and created again does not reuse its old ones.
+// Nothing is written when fn returns an error, which memcacheUpdate returns.
+func memcacheUpdate(db *DB, key []byte, ttl time.Duration, fn func(current *memcacheItem) (*memcacheItem, error)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.writable(); err != nil {
+		return err
+	}
+	meta, ok := db.families[memcacheFamily]
+	if !ok {
+		return ErrFamilyNotFound
+	}
+	current, expiresAt, err := lookupMemcacheItem(db, key)
+	if err != nil {
+		return err
+	}
+	item, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		if current == nil {
+			return nil
+		}
+		return db.applyBatch([]*Entry{
+			{Key: key, Command: Del, Family: db.def.walName()},
+			{Key: key, Command: Del, Family: meta.walName()},
+		})
+	}
+	if item.cas == 0 {
+		item.cas = uint64(now().UnixNano())
+		if current != nil && current.cas >= item.cas {
+			item.cas = current.cas + 1
+		}
+	}
+	value := db.def.updateEntry(key, item.value, ttl, current != nil, expiresAt)
+	flags := meta.setEntry(key, encodeMemcacheMeta(item), 0)
+	flags.Command, flags.ExpiresAt = value.Command, value.ExpiresAt
+	return db.applyBatch([]*Entry{value, flags})
+}
+
+// memcacheStore writes the value with the flags, or keeps the current item if value is nil, if cond accepts
+// the current item. A negative ttl means that the item expires at once, so it is deleted instead.
+func memcacheStore(db *DB, key, value []byte, flags uint32, ttl time.Duration, cond func(current *memcacheItem) error) error {
+	return memcacheUpdate(db, key, ttl, func(current *memcacheItem) (*memcacheItem, error) {
+		if err := cond(current); err != nil {
+			return nil, err
+		}
+		switch {
+		case ttl < 0:
+			return nil, nil
+		case value == nil:
+			// touch changes the expiration time only
+			return &memcacheItem{value: current.value, flags: current.flags, cas: current.cas}, nil
+		}
+		return &memcacheItem{value: value, flags: flags}, nil
+	})
+}
+
+// memcacheIncr adds delta to the value of the key, or subtracts it when decr is set, and returns the new value.
+// The value is an unsigned 64 bit integer: an increment wraps around and a decrement stops at 0.
+// Unlike INCRBY, a missing key is not created. The item keeps its flags and its expiration time.
+func memcacheIncr(db *DB, key []byte, delta uint64, decr bool) (uint64, error) {
+	var n uint64
+	err := memcacheUpdate(db, key, KeepTTL, func(current *memcacheItem) (*memcacheItem, error) {
+		if current == nil {
+			return nil, errMemcacheNotFound
+		}
+		var err error
+		if n, err = strconv.ParseUint(strings.TrimSpace(string(current.value)), 10, 64); err != nil {
+			return nil, errMemcacheNotNum
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		return &memcacheItem{value: []byte(strconv.FormatUint(n, 10)), flags: current.flags}, nil
+	})
+	return n, err
+}
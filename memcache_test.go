@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemcache(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer func() { now = time.Now }()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeMemcache(ln, db)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// send writes the command and reads a reply made of lines lines
+	send := func(cmd string, lines int) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		var reply strings.Builder
+		for i := 0; i < lines; i++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.WriteString(line)
+		}
+		return reply.String()
+	}
+	expect := func(got, want string) {
+		t.Helper()
+		if got != want {
+			t.Fatalf("Expected reply %q, but got %q", want, got)
+		}
+	}
+
+	expect(send("get a\r\n", 1), "END\r\n")
+	expect(send("set a 0 0 5\r\nhello\r\n", 1), "STORED\r\n")
+	expect(send("get a b\r\n", 3), "VALUE a 0 5\r\nhello\r\nEND\r\n")
+	expect(send("add a 0 0 1\r\nx\r\n", 1), "NOT_STORED\r\n")
+	expect(send("replace b 0 0 1\r\nx\r\n", 1), "NOT_STORED\r\n")
+	expect(send("add b 0 0 4\r\na\r\nb\r\n", 1), "STORED\r\n")
+	expect(send("replace b 0 0 1\r\nx\r\n", 1), "STORED\r\n")
+
+	// gets returns the cas unique of the item, the last word of the VALUE line
+	gets := func(key string) string {
+		t.Helper()
+		reply := send("gets "+key+"\r\n", 3)
+		line := strings.Fields(strings.SplitN(reply, "\r\n", 2)[0])
+		if len(line) != 5 {
+			t.Fatalf("Expected a VALUE line with a cas unique, but got %q", reply)
+		}
+		return line[4]
+	}
+	unique := gets("a")
+	expect(send("cas a 0 0 5 "+unique+"\r\nworld\r\n", 1), "STORED\r\n")
+	expect(send("cas a 0 0 5 "+unique+"\r\nagain\r\n", 1), "EXISTS\r\n")
+	expect(send("cas c 0 0 1 1\r\nx\r\n", 1), "NOT_FOUND\r\n")
+	// the unique is a version of the key, a value written again is a change even if it is the same
+	unique = gets("a")
+	expect(send("set a 0 0 5\r\nother\r\n", 1), "STORED\r\n")
+	expect(send("set a 0 0 5\r\nworld\r\n", 1), "STORED\r\n")
+	expect(send("cas a 0 0 5 "+unique+"\r\nagain\r\n", 1), "EXISTS\r\n")
+	// a value written through another front end changes the unique too
+	unique = gets("a")
+	db.Put([]byte("a"), []byte("other"))
+	expect(send("cas a 0 0 5 "+unique+"\r\nagain\r\n", 1), "EXISTS\r\n")
+	expect(send("set a 0 0 5\r\nworld\r\n", 1), "STORED\r\n")
+
+	// the flags are stored with the value
+	expect(send("set f 42 0 1\r\nx\r\n", 1), "STORED\r\n")
+	expect(send("get f\r\n", 3), "VALUE f 42 1\r\nx\r\nEND\r\n")
+	expect(send("set f 70000 0 1\r\nx\r\n", 1), "STORED\r\n")
+	expect(send("get f\r\n", 3), "VALUE f 70000 1\r\nx\r\nEND\r\n")
+	expect(send("set f 1x 0 1\r\nx\r\n", 1), "CLIENT_ERROR bad command line format\r\n")
+
+	expect(send("incr n 1\r\n", 1), "NOT_FOUND\r\n")
+	expect(send("set n 0 0 2\r\n10\r\n", 1), "STORED\r\n")
+	expect(send("incr n 5\r\n", 1), "15\r\n")
+	expect(send("decr n 20\r\n", 1), "0\r\n")
+	expect(send("incr a 1\r\n", 1), "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	// incr and decr keep the flags and the expiration time of the item
+	expect(send("set m 7 10 1\r\n1\r\n", 1), "STORED\r\n")
+	expect(send("incr m 1\r\n", 1), "2\r\n")
+	expect(send("get m\r\n", 3), "VALUE m 7 1\r\n2\r\nEND\r\n")
+
+	// touch gives the key a TTL, the value is kept
+	expect(send("touch a 10\r\n", 1), "TOUCHED\r\n")
+	expect(send("touch missing 10\r\n", 1), "NOT_FOUND\r\n")
+	expect(send("get a\r\n", 3), "VALUE a 0 5\r\nworld\r\nEND\r\n")
+	start := time.Now()
+	now = func() time.Time { return start.Add(11 * time.Second) }
+	expect(send("get a\r\n", 1), "END\r\n")
+	expect(send("get m\r\n", 1), "END\r\n")
+	now = time.Now
+
+	expect(send("set e 0 -1 1\r\nx\r\n", 1), "STORED\r\n")
+	expect(send("get e\r\n", 1), "END\r\n")
+	expect(send("delete b\r\n", 1), "DELETED\r\n")
+	expect(send("delete b\r\n", 1), "NOT_FOUND\r\n")
+	expect(send("set q 0 0 1 noreply\r\nq\r\nget q\r\n", 3), "VALUE q 0 1\r\nq\r\nEND\r\n")
+	expect(send("bogus\r\n", 1), "ERROR\r\n")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+var (
+	// ErrUnknownOperator is returned when a merge names an operator that is not registered.
+	ErrUnknownOperator = errors.New("unknown merge operator")
+	// ErrInvalidOperand is returned when a merge operand is refused by its operator, such as a number
+	// that is not an integer for "add".
+	ErrInvalidOperand = errors.New("invalid merge operand")
+	// errMergePending is returned by the SSTable search when the key holds merge operands
+	// that can only be resolved together with the older values of the key.
+	errMergePending = errors.New("key has pending merge operands")
+)
+
+// A MergeOperator combines the current value of a key with an operand, so that
+// read-modify-write updates such as counters can be written without reading the key first.
+// Operands are stored as they are written and only resolved when the key is read or when
+// compaction finds the value they apply to.
+type MergeOperator interface {
+	// Name identifies the operator in the wal and in the SSTables, it must not change
+	// once operands have been written with it.
+	Name() string
+	// Merge returns the new value of the key. existing is nil when the key does not exist.
+	Merge(key, existing, operand []byte) ([]byte, error)
+}
+
+// operand is a merge operand together with the name of the operator that applies it.
+type operand struct {
+	name  string
+	value []byte
+}
+
+// RegisterMergeOperator makes the operator available to Merge under its name.
+// The built-in operators "add", "append" and "json" are registered by NewDB.
+func (db *DB) RegisterMergeOperator(op MergeOperator) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.operators[op.Name()] = op
+}
+
+// Merge records a merge operand for the key of the default column family, see ColumnFamily.Merge.
+func (db *DB) Merge(key []byte, name string, value []byte) error {
+	return db.def.Merge(key, name, value)
+}
+
+// resolve computes the value of a key from the entries found for it, newest first.
+// Only the last entry can hold the base value, the others are merge operands on top of it.
+func resolve(operators map[string]MergeOperator, key []byte, chain []*Node) ([]byte, error) {
+	if len(chain) == 0 {
+		return nil, ErrKeynotfound
+	}
+	var value []byte
+	last := chain[len(chain)-1]
+	found := !last.unresolved && last.marker && !last.expired(now().UnixNano())
+	if found {
+		value = last.Value
+	}
+	var err error
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, op := range chain[i].operands {
+			value, err = apply(operators, key, value, op)
+			if err != nil {
+				return nil, err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrKeynotfound
+	}
+	return value, nil
+}
+
+// A baseValidator is a MergeOperator that refuses, when an operand is written, some of the values that its
+// Merge still accepts when they are read, such as a json null for JSONMerge.
+type baseValidator interface {
+	validate(key, existing, operand []byte) error
+}
+
+// checkOperand applies the operand to the current value of the key, nil if the key does not exist, and
+// returns the result, so that an operand its operator cannot apply, to a base of the wrong kind or with an
+// overflow, is refused when it is written instead of making the key unreadable when it is resolved.
+func checkOperand(operators map[string]MergeOperator, key, existing []byte, op operand) ([]byte, error) {
+	operator, ok := operators[op.name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownOperator, op.name)
+	}
+	if v, ok := operator.(baseValidator); ok {
+		if err := v.validate(key, existing, op.value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidOperand, err)
+		}
+	}
+	value, err := operator.Merge(key, existing, op.value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOperand, err)
+	}
+	return value, nil
+}
+
+func apply(operators map[string]MergeOperator, key, existing []byte, op operand) ([]byte, error) {
+	operator, ok := operators[op.name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownOperator, op.name)
+	}
+	return operator.Merge(key, existing, op.value)
+}
+
+// resolveNode replaces the operands of the node by their result when the node also holds
+// the value they apply to. When bottom is set there is nothing older than the node, so
+// operands without a base value are applied to a missing key.
+// A node that cannot be resolved keeps its operands, nothing is lost.
+func resolveNode(operators map[string]MergeOperator, n *Node, bottom bool) {
+	if n.operands == nil {
+		return
+	}
+	if n.unresolved {
+		if !bottom {
+			return
+		}
+		n.unresolved = false
+		n.marker = false
+		n.Value = nil
+	}
+	// an expired value is gone, the operands apply to a missing key
+	if n.marker && n.expired(now().UnixNano()) {
+		n.marker = false
+		n.Value = nil
+		n.expiresAt = 0
+	}
+	value, err := resolve(operators, n.Key, []*Node{n})
+	if err != nil {
+		return
+	}
+	n.Value = value
+	n.marker = true
+	n.operands = nil
+}
+
+// encodeOperand writes the length of the operator name, the name,
+// the length of the operand and the operand.
+func encodeOperand(op operand) []byte {
+	res := make([]byte, 0, len(op.name)+len(op.value)+6)
+	res = append(res, encodeNum(len(op.name))...)
+	res = append(res, op.name...)
+	res = append(res, encodeInt(len(op.value))...)
+	return append(res, op.value...)
+}
+
+func decodeOperand(r io.Reader) (operand, error) {
+	var nameLen [2]byte
+	if _, err := io.ReadFull(r, nameLen[:]); err != nil {
+		return operand{}, err
+	}
+	name := make([]byte, decodeNum(nameLen[:]))
+	if _, err := io.ReadFull(r, name); err != nil {
+		return operand{}, err
+	}
+	var valueLen [4]byte
+	if _, err := io.ReadFull(r, valueLen[:]); err != nil {
+		return operand{}, err
+	}
+	value := make([]byte, decodeInt(valueLen[:]))
+	if _, err := io.ReadFull(r, value); err != nil {
+		return operand{}, err
+	}
+	return operand{name: string(name), value: value}, nil
+}
+
+// The built-in operators.
+
+// Int64Add adds the operand to the value, both being decimal integers. A missing key counts as 0.
+// A value that is not an integer or a sum that does not fit in an int64 is an error, the operand is
+// refused when it is written.
+type Int64Add struct{}
+
+func (Int64Add) Name() string { return "add" }
+
+func (Int64Add) Merge(key, existing, operand []byte) ([]byte, error) {
+	var current int64
+	if existing != nil {
+		n, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("add: value of %q is not an integer", key)
+		}
+		current = n
+	}
+	delta, err := strconv.ParseInt(string(operand), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("add: operand %q is not an integer", operand)
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return nil, fmt.Errorf("add: %d + %d overflows the value of %q", current, delta, key)
+	}
+	return []byte(strconv.FormatInt(current+delta, 10)), nil
+}
+
+// StringAppend appends the operand to the value.
+type StringAppend struct{}
+
+func (StringAppend) Name() string { return "append" }
+
+func (StringAppend) Merge(key, existing, operand []byte) ([]byte, error) {
+	res := make([]byte, 0, len(existing)+len(operand))
+	res = append(res, existing...)
+	return append(res, operand...), nil
+}
+
+// JSONMerge merges the fields of the operand object into the value object. The merge is shallow:
+// a field of the operand replaces the field of the same name, nested objects are not merged.
+// An operand is refused on a value that is not an object, null included, but a null value stored
+// before counts as an empty object when it is read.
+type JSONMerge struct{}
+
+func (JSONMerge) Name() string { return "json" }
+
+func (JSONMerge) Merge(key, existing, operand []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if existing != nil {
+		if err := json.Unmarshal(existing, &fields); err != nil {
+			return nil, fmt.Errorf("json: value of %q is not an object", key)
+		}
+		// null unmarshals to a nil map
+		if fields == nil {
+			fields = map[string]json.RawMessage{}
+		}
+	}
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(operand, &patch); err != nil || patch == nil {
+		return nil, fmt.Errorf("json: operand is not an object")
+	}
+	for k, v := range patch {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+func (JSONMerge) validate(key, existing, operand []byte) error {
+	if existing != nil && bytes.Equal(bytes.TrimSpace(existing), []byte("null")) {
+		return fmt.Errorf("json: value of %q is not an object", key)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// openTestDB opens the database stored in dir, it is closed at the end of the test.
+func openTestDB(t *testing.T, dir string) *DB {
+	t.Helper()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal("Failed to open the database:", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMergeOperators(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Operator MergeOperator
+		Existing []byte
+		Operand  []byte
+		ExError  bool
+		ExOutput string
+	}{
+		{Name: "add to missing key", Operator: Int64Add{}, Operand: []byte("5"), ExOutput: "5"},
+		{Name: "add negative", Operator: Int64Add{}, Existing: []byte("5"), Operand: []byte("-7"), ExOutput: "-2"},
+		{Name: "add to non integer", Operator: Int64Add{}, Existing: []byte("abc"), Operand: []byte("1"), ExError: true},
+		{Name: "add overflow", Operator: Int64Add{}, Existing: []byte("9223372036854775807"), Operand: []byte("1"), ExError: true},
+		{Name: "add underflow", Operator: Int64Add{}, Existing: []byte("-9223372036854775808"), Operand: []byte("-1"), ExError: true},
+		{Name: "add up to the max", Operator: Int64Add{}, Existing: []byte("9223372036854775806"), Operand: []byte("1"), ExOutput: "9223372036854775807"},
+		{Name: "append", Operator: StringAppend{}, Existing: []byte("foo"), Operand: []byte("bar"), ExOutput: "foobar"},
+		{Name: "json merge", Operator: JSONMerge{}, Existing: []byte(`{"a":1,"b":2}`), Operand: []byte(`{"b":3,"c":{"d":4}}`), ExOutput: `{"a":1,"b":3,"c":{"d":4}}`},
+		{Name: "json merge into non object", Operator: JSONMerge{}, Existing: []byte(`[1]`), Operand: []byte(`{"a":1}`), ExError: true},
+		{Name: "json merge into null", Operator: JSONMerge{}, Existing: []byte(`null`), Operand: []byte(`{"a":1}`), ExOutput: `{"a":1}`},
+		{Name: "json null operand", Operator: JSONMerge{}, Existing: []byte(`{"a":1}`), Operand: []byte(`null`), ExError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			res, err := test.Operator.Merge([]byte("key"), test.Existing, test.Operand)
+			if test.ExError {
+				if err == nil {
+					t.Fatal("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Unexpected error:", err)
+			}
+			if string(res) != test.ExOutput {
+				t.Fatalf("Expected value %s, but got %s", test.ExOutput, res)
+			}
+		})
+	}
+}
+
+func TestDBMerge(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	key := []byte("counter")
+	expect := func(want string) {
+		t.Helper()
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if string(value) != want {
+			t.Fatalf("Expected value %s, but got %s", want, value)
+		}
+	}
+
+	if err := db.Put(key, []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	// the base value is now only in the SSTables
+	if err := db.Merge(key, "add", []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	expect("15")
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	expect("15")
+	if err := db.Merge(key, "add", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	expect("16")
+
+	// the operands are replayed from the wal
+	db.Close()
+	db = openTestDB(t, dir)
+	expect("16")
+
+	if err := db.def.sst.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.def.sst.sstables) != 1 {
+		t.Fatalf("Expected one SSTable after compaction, but found %d", len(db.def.sst.sstables))
+	}
+	value, err := db.def.sst.Search(key)
+	if err != nil || string(value) != "15" {
+		t.Fatalf("Expected the compaction to resolve the operands, got %s (%v)", value, err)
+	}
+	expect("16")
+
+	if err := db.Merge(key, "unknown", []byte("1")); err == nil {
+		t.Fatal("Expected an error for an unknown operator")
+	}
+	// an operand that the operator refuses is not written, the key stays readable
+	for _, bad := range []struct{ operator, operand string }{{"add", "abc"}, {"json", "not json"}, {"json", "[1]"}} {
+		if err := db.Merge(key, bad.operator, []byte(bad.operand)); !errors.Is(err, ErrInvalidOperand) {
+			t.Fatalf("Expected ErrInvalidOperand for %s %q, but got %v", bad.operator, bad.operand, err)
+		}
+	}
+	b := &WriteBatch{}
+	b.Put("", []byte("other"), []byte("1"))
+	b.Merge("", key, "add", []byte("1.5"))
+	if err := db.Write(b); !errors.Is(err, ErrInvalidOperand) {
+		t.Fatalf("Expected the batch to be refused, but got %v", err)
+	}
+	if _, err := db.Get([]byte("other")); err != ErrKeynotfound {
+		t.Fatalf("Expected nothing of the refused batch to be written, but got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"key": "counter", "value": "x", "operator": "add"}`)
+	MergeHandler(rec, httptest.NewRequest(http.MethodPost, "/merge", body), db)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid operand, but got %d", rec.Code)
+	}
+	expect("16")
+
+	// the operand is checked against the current value: a base of the wrong kind or an overflow is refused
+	db.Put([]byte("big"), []byte("9223372036854775807"))
+	db.Put([]byte("text"), []byte("abc"))
+	db.Put([]byte("doc"), []byte("null"))
+	for _, bad := range []struct{ key, operator, operand string }{{"big", "add", "1"}, {"text", "add", "1"}, {"doc", "json", `{"a":1}`}} {
+		if err := db.Merge([]byte(bad.key), bad.operator, []byte(bad.operand)); !errors.Is(err, ErrInvalidOperand) {
+			t.Fatalf("Expected ErrInvalidOperand for %s on %s, but got %v", bad.operator, bad.key, err)
+		}
+		if _, err := db.Get([]byte(bad.key)); err != nil {
+			t.Fatalf("Expected %s to stay readable, but got %v", bad.key, err)
+		}
+	}
+	// in a batch, against the value that the writes before it leave
+	b = &WriteBatch{}
+	b.Put("", []byte("near"), []byte("9223372036854775806"))
+	b.Merge("", []byte("near"), "add", []byte("1"))
+	b.Merge("", []byte("near"), "add", []byte("1"))
+	if err := db.Write(b); !errors.Is(err, ErrInvalidOperand) {
+		t.Fatalf("Expected the batch that overflows to be refused, but got %v", err)
+	}
+
+	if err := db.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(key, "append", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	expect("x")
+}
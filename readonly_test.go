@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// snapshotDir returns the size of every file under dir.
+func snapshotDir(t *testing.T, dir string) map[string]int64 {
+	t.Helper()
+	files := map[string]int64{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files[path] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	db.Put([]byte("flushed"), []byte("sst"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("replayed"), []byte("wal"))
+	// the lock is not taken, so a read-only database opens beside a writer
+	ro, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.Close()
+	db.Close()
+	// an orphan and an unfinished file, which a writable open would delete
+	os.WriteFile(filepath.Join(dir, "sstFiles", "orphan.sst"), []byte("garbage"), 0644)
+	os.WriteFile(filepath.Join(dir, "sstFiles", "unfinished"+tmpSuffix), []byte("garbage"), 0644)
+	before := snapshotDir(t, dir)
+
+	ro, err = OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"flushed": "sst", "replayed": "wal"} {
+		if value, err := ro.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s for %s, but got %s (%v)", want, key, value, err)
+		}
+	}
+	if err := ro.Put([]byte("k"), []byte("v")); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly for a put, but got %v", err)
+	}
+	if err := ro.Delete([]byte("flushed")); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly for a delete, but got %v", err)
+	}
+	b := &WriteBatch{}
+	b.Put("", []byte("k"), []byte("v"))
+	if err := ro.Write(b); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly for a batch, but got %v", err)
+	}
+	if _, err := ro.CreateColumnFamily("users", FamilyOptions{}); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly when creating a family, but got %v", err)
+	}
+	if err := ro.Flush(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly for a flush, but got %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after := snapshotDir(t, dir)
+	if len(after) != len(before) {
+		t.Fatalf("Expected the directory to be left as it was, but got %v instead of %v", after, before)
+	}
+	for name, size := range before {
+		if after[name] != size {
+			t.Fatalf("Expected %s to be left as it was, but its size went from %d to %d", name, size, after[name])
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	ReadOnlyHandler(rec, httptest.NewRequest(http.MethodPost, "/set", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 from a read-only server, but got %d", rec.Code)
+	}
+}
+
+func TestReadOnlyErrors(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	db.Put([]byte("a"), []byte("1"))
+	db.Close()
+	ro, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	// every http route that writes answers 403 Forbidden
+	for _, c := range []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		method  string
+		path    string
+		body    string
+	}{
+		{"PUT /v1/keys", func(w http.ResponseWriter, r *http.Request) { KeysHandler(w, r, ro) }, http.MethodPut, "/v1/keys/a", "2"},
+		{"DELETE /v1/keys", func(w http.ResponseWriter, r *http.Request) { KeysHandler(w, r, ro) }, http.MethodDelete, "/v1/keys/a", ""},
+		{"/v1/batch", func(w http.ResponseWriter, r *http.Request) { BatchHandler(w, r, ro) }, http.MethodPost, "/v1/batch", `{"ops": [{"op": "put", "key": "YQ==", "value": "Mg=="}]}`},
+		{"/set", func(w http.ResponseWriter, r *http.Request) { SetHandler(w, r, ro) }, http.MethodPost, "/set", `{"key": "a", "value": "2"}`},
+		{"/del", func(w http.ResponseWriter, r *http.Request) { DelHandler(w, r, ro) }, http.MethodDelete, "/del?key=a", ""},
+		{"/merge", func(w http.ResponseWriter, r *http.Request) { MergeHandler(w, r, ro) }, http.MethodPost, "/merge", `{"key": "a", "value": "2", "operator": "append"}`},
+		{"/admin/cf", func(w http.ResponseWriter, r *http.Request) { FamiliesHandler(w, r, ro) }, http.MethodPost, "/admin/cf", `{"name": "users"}`},
+	} {
+		rec := httptest.NewRecorder()
+		c.handler(rec, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("Expected 403 from %s, but got %d (%s)", c.name, rec.Code, rec.Body)
+		}
+	}
+
+	// exchange starts a server on a listener, sends a command and reads the first line of the reply
+	exchange := func(serve func(net.Listener, *DB) error, cmd string) string {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go serve(ln, ro)
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+	if got := exchange(ServeRESP, "SET a 2\r\n"); got != "-READONLY You can't write against a read only replica.\r\n" {
+		t.Fatalf("Expected a READONLY error from the RESP server, but got %q", got)
+	}
+	if got := exchange(ServeMemcache, "set a 0 0 1\r\n2\r\n"); got != "SERVER_ERROR read only\r\n" {
+		t.Fatalf("Expected SERVER_ERROR read only from the memcached server, but got %q", got)
+	}
+}
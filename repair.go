@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// The repair command salvages what can be read from a damaged database, which must not be open; it takes
+// the lock of the directory and fails if a process has the database open:
+//
+//	kvstore repair DIR
+//
+// Every SSTable of every column family is checked. A file that cannot be opened, or whose entries cannot
+// all be read, is moved to DIR/lost and replaced, under the same name so that it keeps its place among
+// the SSTables, by a file holding the entries that could be read. An entry that cannot be read is skipped
+// and the reading resumes at the next entry that can be found, except in a compressed file where it stops.
+// When the file does not match its checksum, nothing tells which of the entries that could be read are
+// damaged: they are salvaged all the same but reported as suspect, and repair then fails with
+// ErrDataSuspect so that the salvaged keys are checked before the database is trusted again. The wal is decoded
+// record by record like waldump does; if some records are damaged the original is moved to DIR/lost and
+// the wal is rewritten with the records that could be decoded. The registry of the column families is
+// rebuilt from their directories when a family is missing from it. The files that are no longer there are
+// removed from the manifest; a manifest that cannot be read is dropped, the next open then takes the
+// SSTables of the directories in the order of their names. What was lost is written to a report in DIR/lost
+// and printed.
+
+func repair(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: kvstore repair DIR")
+	}
+	dir := fs.Arg(0)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	lock, err := vfs.Default.Lock(filepath.Join(dir, "LOCK"))
+	if errors.Is(err, vfs.ErrLocked) {
+		return fmt.Errorf("%w: the database in %s is open", ErrLocked, dir)
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	rep := &repairer{
+		dir:  dir,
+		lost: filepath.Join(dir, "lost", time.Now().UTC().Format("20060102T150405")),
+	}
+	if err := rep.run(); err != nil {
+		return err
+	}
+	report := strings.Join(rep.report, "\n") + "\n"
+	fmt.Fprint(out, report)
+	if !rep.moved {
+		return nil
+	}
+	name := filepath.Join(rep.lost, "REPORT")
+	fmt.Fprintf(out, "report written to %s\n", name)
+	if err := os.WriteFile(name, []byte(report), 0644); err != nil {
+		return err
+	}
+	if rep.suspect > 0 {
+		return fmt.Errorf("%w: %d SSTables were salvaged from files that fail their checksum", ErrDataSuspect, rep.suspect)
+	}
+	return nil
+}
+
+// ErrDataSuspect is returned by repair when entries were salvaged from SSTables that do not match their checksum.
+var ErrDataSuspect = errors.New("salvaged data is suspect")
+
+// repairer holds the state of a repair.
+type repairer struct {
+	dir string
+	// lost is the directory that receives the damaged files
+	lost string
+	// moved is set once a file was moved to lost
+	moved bool
+	// suspect is the number of SSTables salvaged from files that fail their checksum
+	suspect int
+	// walMoves are the offsets of the records of a rewritten wal in the original and in the new wal,
+	// ending with the ends of both, nil if the wal was not rewritten
+	walMoves [][2]int64
+	report   []string
+}
+
+func (rep *repairer) logf(format string, args ...interface{}) {
+	rep.report = append(rep.report, fmt.Sprintf(format, args...))
+}
+
+func (rep *repairer) run() error {
+	db := &DB{dir: rep.dir, families: map[string]*ColumnFamily{}, fs: vfs.Default}
+	options, err := db.loadFamilies()
+	if err != nil {
+		// the registry is rebuilt below from the directories of the families
+		rep.logf("families.json: %v, rebuilt from the directories", err)
+		options = nil
+	}
+	if options == nil {
+		options = map[string]FamilyOptions{}
+	}
+	rebuild := err != nil
+	dirs, err := os.ReadDir(filepath.Join(rep.dir, "families"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, d := range dirs {
+		if _, ok := options[d.Name()]; d.IsDir() && !ok && validFamilyName(d.Name()) == nil {
+			rep.logf("family %s: missing from families.json, added with the default options", d.Name())
+			options[d.Name()] = FamilyOptions{}
+			rebuild = true
+		}
+	}
+	names := []string{defaultFamily}
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	for _, name := range names {
+		if err := rep.repairFamily(name, db.familyPath(name), options[name]); err != nil {
+			return err
+		}
+	}
+	// the wal is repaired first, the offsets of the flushes in the manifest follow its records
+	if err := rep.repairWal(filepath.Join(rep.dir, "wal.log")); err != nil {
+		return err
+	}
+	if err := rep.repairManifest(db, names); err != nil {
+		return err
+	}
+	if rebuild {
+		for name, opts := range options {
+			db.families[name] = &ColumnFamily{name: name, opts: opts}
+		}
+		if err := db.saveFamilies(); err != nil {
+			return err
+		}
+		rep.logf("families.json: rewritten with %d families", len(options))
+	}
+	if !rep.moved {
+		rep.logf("nothing was lost")
+	}
+	return nil
+}
+
+// moveToLost moves the file to the lost directory, under its path relative to the database.
+func (rep *repairer) moveToLost(path string) error {
+	rel, err := filepath.Rel(rep.dir, path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(rep.lost, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	rep.moved = true
+	return os.Rename(path, dst)
+}
+
+func (rep *repairer) repairFamily(name, path string, opts FamilyOptions) error {
+	files, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sst := &SStables{path: path, compression: opts.Compression, fs: vfs.Default}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".sst" {
+			continue
+		}
+		name := filepath.Join(path, file.Name())
+		_, openErr := openSStable(vfs.Default, name)
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		nodes, total, readErr := salvageSStable(content)
+		if openErr == nil && readErr == nil {
+			continue
+		}
+		if openErr == nil {
+			openErr = readErr
+		}
+		if err := rep.moveToLost(name); err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			rep.logf("%s: %v, no entry could be read, moved to lost", name, openErr)
+			continue
+		}
+		// the salvaged file keeps the name of the damaged one, the newer files still shadow it
+		if _, err := sst.writeFile(name, nodes); err != nil {
+			return err
+		}
+		if !checksumMatches(content) {
+			rep.suspect++
+			rep.logf("%s: %v, DATA SUSPECT: salvaged %d entries that the checksum cannot vouch for, "+
+				"their keys and values may be damaged, the original was moved to lost", name, openErr, len(nodes))
+			continue
+		}
+		if total >= 0 {
+			rep.logf("%s: %v, salvaged %d of %d entries, the original was moved to lost", name, openErr, len(nodes), total)
+		} else {
+			rep.logf("%s: %v, salvaged %d entries, the original was moved to lost", name, openErr, len(nodes))
+		}
+	}
+	return nil
+}
+
+// repairManifest removes the files that are missing from the manifest, after the damaged ones were moved to lost.
+// If the wal was rewritten, the offsets of the flushes are moved to the same records in the new wal.
+func (rep *repairer) repairManifest(db *DB, names []string) error {
+	m, err := loadManifest(vfs.Default, rep.dir)
+	if err != nil {
+		if err := rep.moveToLost(filepath.Join(rep.dir, "CURRENT")); err != nil {
+			return err
+		}
+		rep.logf("CURRENT: %v, the manifest is rebuilt from the SSTables at the next open", err)
+		return nil
+	}
+	if m.bootstrap {
+		return nil
+	}
+	defer m.Close()
+	missing := 0
+	for _, name := range names {
+		e := &versionEdit{family: name}
+		for _, f := range m.files[name] {
+			if _, err := os.Stat(filepath.Join(db.familyPath(name), f.name)); os.IsNotExist(err) {
+				e.removed = append(e.removed, f.name)
+			}
+		}
+		m.apply(e)
+		missing += len(e.removed)
+	}
+	moved := false
+	for family, offset := range m.walOffsets {
+		if n := rep.movedWalOffset(offset); n != offset {
+			m.walOffsets[family] = n
+			moved = true
+		}
+	}
+	if missing == 0 && !moved {
+		return nil
+	}
+	if err := m.rotate(); err != nil {
+		return err
+	}
+	if missing > 0 {
+		rep.logf("MANIFEST: %d missing SSTables removed", missing)
+	}
+	if moved {
+		rep.logf("MANIFEST: the offsets of the flushes moved to the rewritten wal")
+	}
+	return nil
+}
+
+// movedWalOffset returns the offset in the rewritten wal of the first record at or after the offset of the
+// original wal. The offset is returned as it is if the wal was not rewritten.
+func (rep *repairer) movedWalOffset(offset int64) int64 {
+	if rep.walMoves == nil {
+		return offset
+	}
+	for _, move := range rep.walMoves {
+		if move[0] >= offset {
+			return move[1]
+		}
+	}
+	return rep.walMoves[len(rep.walMoves)-1][1]
+}
+
+// checksumMatches reports whether the content of an SSTable ends with the checksum of what precedes it.
+func checksumMatches(content []byte) bool {
+	return len(content) >= 4 && crc32.ChecksumIEEE(content[:len(content)-4]) == uint32(decodeInt(content[len(content)-4:]))
+}
+
+// salvageSStable returns the entries of an SSTable that can be read, in key order, along with the
+// number of entries of its header (-1 if the header cannot be read) and the first error of the reading.
+func salvageSStable(content []byte) ([]*Node, int, error) {
+	h, err := readSSTHeader(content)
+	if err != nil || len(content) < h.size+4 {
+		return nil, -1, ErrCorrupt
+	}
+	body := content[h.size : len(content)-4]
+	var nodes []*Node
+	var firstErr error
+	switch h.version {
+	case 1:
+		nodes, firstErr = salvageEntries(body, h)
+	case 2:
+		// a compressed stream cannot be resumed after a damaged part, the reading stops there
+		r := flate.NewReader(bytes.NewReader(body))
+		for {
+			node, err := readNode(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				firstErr = err
+				break
+			}
+			// an entry out of order is damaged, the file must stay sorted
+			if len(nodes) > 0 && bytes.Compare(nodes[len(nodes)-1].Key, node.Key) >= 0 {
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+	default:
+		return nil, h.entryCount, fmt.Errorf("%w: unknown version %d", ErrCorrupt, h.version)
+	}
+	if firstErr != nil {
+		return nodes, h.entryCount, firstErr
+	}
+	if len(nodes) != h.entryCount {
+		return nodes, h.entryCount, fmt.Errorf("%w: %d entries instead of %d", ErrCorrupt, len(nodes), h.entryCount)
+	}
+	return nodes, h.entryCount, nil
+}
+
+// salvageEntries reads the entries of an uncompressed SSTable body. After an entry that cannot be read, the
+// reading resumes at the next offset where an entry can be read that is in order, within the keys of the
+// header, and followed by another such entry or by the end of the body.
+func salvageEntries(body []byte, h *sstHeader) ([]*Node, error) {
+	var nodes []*Node
+	var firstErr error
+	inOrder := func(node *Node) bool {
+		if bytes.Compare(node.Key, h.smallestKey) < 0 || bytes.Compare(node.Key, h.largestKey) > 0 {
+			return false
+		}
+		return len(nodes) == 0 || bytes.Compare(nodes[len(nodes)-1].Key, node.Key) < 0
+	}
+	// entryAt reads the entry at the offset and returns its size
+	entryAt := func(pos int) (*Node, int, error) {
+		r := bytes.NewReader(body[pos:])
+		node, err := readNode(r)
+		if err == nil && !inOrder(node) {
+			err = fmt.Errorf("%w: key %q out of order", ErrCorrupt, node.Key)
+		}
+		return node, len(body) - pos - r.Len(), err
+	}
+	for pos := 0; pos < len(body); {
+		node, n, err := entryAt(pos)
+		if err == nil {
+			nodes = append(nodes, node)
+			pos += n
+			continue
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("offset %d: %w", h.size+pos, err)
+		}
+		for pos++; pos < len(body); pos++ {
+			node, n, err := entryAt(pos)
+			if err != nil {
+				continue
+			}
+			// the entry that follows must be in order after this one, the entry is read again by the loop
+			nodes = append(nodes, node)
+			_, _, err = entryAt(pos + n)
+			nodes = nodes[:len(nodes)-1]
+			if pos+n == len(body) || err == nil {
+				break
+			}
+		}
+	}
+	return nodes, firstErr
+}
+
+func (rep *repairer) repairWal(name string) error {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s := scanWal(data)
+	if len(s.corrupt) == 0 && s.torn < 0 {
+		return nil
+	}
+	var content bytes.Buffer
+	var moves [][2]int64
+	for _, rec := range s.records {
+		moves = append(moves, [2]int64{rec.offset, int64(content.Len())})
+		if rec.watermark {
+			content.Write(walWatermark)
+			continue
+		}
+		entry, err := encodeEntry(rec.entry)
+		if err != nil {
+			return err
+		}
+		content.Write(entry)
+	}
+	if err := rep.moveToLost(name); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, content.Bytes(), 0755); err != nil {
+		return err
+	}
+	rep.walMoves = append(moves, [2]int64{int64(len(data)), int64(content.Len())})
+	for i, c := range s.corrupt {
+		rep.logf("%s: corrupt records at offset %d (%v), %d bytes lost", name, c[0], s.errs[i], c[1]-c[0])
+	}
+	if s.torn >= 0 {
+		rep.logf("%s: torn record at offset %d, %d bytes lost", name, s.torn, int64(len(data))-s.torn)
+	}
+	rep.logf("%s: rewritten with %d records, the original was moved to lost", name, len(s.records))
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	users, err := db.CreateColumnFamily("users", FamilyOptions{Compression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("old"))
+	}
+	users.Put([]byte("u"), []byte("1"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	// the newer file shadows k0 of the older one
+	db.Put([]byte("k0"), []byte("new"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("w"), []byte("wal"))
+	older := db.def.sst.sstables[0].name
+	db.Close()
+
+	// the older file loses its last entries, the wal gets garbage in the middle
+	// and the registry of the families is lost
+	content, _ := os.ReadFile(older)
+	os.WriteFile(older, content[:len(content)-30], 0644)
+	wal := filepath.Join(dir, "wal.log")
+	data, _ := os.ReadFile(wal)
+	os.WriteFile(wal, append([]byte{0x7f, 0x7f, 0, 0}, data...), 0644)
+	os.Remove(filepath.Join(dir, "families.json"))
+
+	// the truncated file does not match its checksum, what is salvaged from it is suspect
+	var out bytes.Buffer
+	if err := repair([]string{dir}, &out); !errors.Is(err, ErrDataSuspect) {
+		t.Fatalf("Expected ErrDataSuspect, but got %v", err)
+	}
+	for _, want := range []string{"DATA SUSPECT: salvaged 8 entries", "corrupt records at offset 0", "family users: missing", "report written"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("Expected %q in the report:\n%s", want, out.String())
+		}
+	}
+	lost, _ := filepath.Glob(filepath.Join(dir, "lost", "*", "sstFiles", "*.sst"))
+	if len(lost) != 1 {
+		t.Fatalf("Expected the damaged sstable in lost, but found %v", lost)
+	}
+
+	db = openTestDB(t, dir)
+	if value, err := db.Get([]byte("k0")); err != nil || string(value) != "new" {
+		t.Fatalf("Expected the salvaged file to stay older than the newer one, but got %s (%v)", value, err)
+	}
+	if value, err := db.Get([]byte("k7")); err != nil || string(value) != "old" {
+		t.Fatalf("Expected k7 to be salvaged, but got %s (%v)", value, err)
+	}
+	if _, err := db.Get([]byte("k9")); err != ErrKeynotfound {
+		t.Fatalf("Expected k9 to be lost, but got %v", err)
+	}
+	if value, err := db.Get([]byte("w")); err != nil || string(value) != "wal" {
+		t.Fatalf("Expected the wal to be salvaged, but got %s (%v)", value, err)
+	}
+	users, err = db.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := users.Get([]byte("u")); err != nil || string(value) != "1" {
+		t.Fatalf("Expected the family to be found again, but got %s (%v)", value, err)
+	}
+	db.Close()
+
+	out.Reset()
+	if err := repair([]string{dir}, &out); err != nil || !strings.Contains(out.String(), "nothing was lost") {
+		t.Fatalf("Expected a sound database, but got %v\n%s", err, out.String())
+	}
+}
+
+func TestRepairResync(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("old"))
+	}
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	name := db.def.sst.sstables[0].name
+	db.Close()
+
+	// the marker of the fourth entry is damaged, the entries are 15 bytes long
+	content, _ := os.ReadFile(name)
+	h, err := readSSTHeader(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[h.size+3*15] = 0xff
+	os.WriteFile(name, content, 0644)
+
+	var out bytes.Buffer
+	if err := repair([]string{dir}, &out); !errors.Is(err, ErrDataSuspect) {
+		t.Fatalf("Expected ErrDataSuspect, but got %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "DATA SUSPECT: salvaged 9 entries") {
+		t.Fatalf("Expected the entries after the damaged one to be salvaged:\n%s", out.String())
+	}
+	db = openTestDB(t, dir)
+	if _, err := db.Get([]byte("k3")); err != ErrKeynotfound {
+		t.Fatalf("Expected k3 to be lost, but got %v", err)
+	}
+	for _, key := range []string{"k2", "k4", "k9"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != "old" {
+			t.Fatalf("Expected %s to be salvaged, but got %s (%v)", key, value, err)
+		}
+	}
+}
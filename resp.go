@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The RESP server lets redis-cli and the Redis client libraries use the database. It speaks RESP2:
+// a command is an array of bulk strings (or an inline command, a line of words), and a reply is a simple
+// string (+), an error (-), an integer (:), a bulk string ($, $-1 being nil) or an array (*).
+// Only the default column family is served.
+
+var (
+	errRespProtocol = errors.New("ERR Protocol error")
+	errRespSyntax   = errors.New("ERR syntax error")
+	errRespNotInt   = errors.New("ERR value is not an integer or out of range")
+	// errRespReadOnly is the reply of Redis to a write on a read-only replica, the clients know it
+	errRespReadOnly = errors.New("READONLY You can't write against a read only replica.")
+)
+
+// respMaxBulk is the largest bulk string accepted from a client.
+const respMaxBulk = 512 << 20
+
+// respMaxCursors is the number of SCAN cursors kept by a server, the oldest ones are forgotten first.
+const respMaxCursors = 4096
+
+// respCursors remembers the last key visited by the SCAN calls in progress. Redis clients expect an
+// integer cursor, so the cursor is the number of an entry and the key stays on the server. The cursors
+// are shared by the connections of a server, like in Redis a scan may continue on another connection.
+type respCursors struct {
+	mu   sync.Mutex
+	last uint64
+	keys map[uint64][]byte
+}
+
+// add returns a new cursor for the key, forgetting the oldest one if there are too many.
+func (c *respCursors) add(key []byte) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last++
+	c.keys[c.last] = key
+	if c.last > respMaxCursors {
+		delete(c.keys, c.last-respMaxCursors)
+	}
+	return c.last
+}
+
+// get returns the key of the cursor, which is forgotten since a cursor is used once.
+func (c *respCursors) get(cursor uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[cursor]
+	delete(c.keys, cursor)
+	return key, ok
+}
+
+// ServeRESP accepts the connections of the listener and serves the Redis commands of each of them
+// until the listener is closed.
+func ServeRESP(ln net.Listener, db *DB) error {
+	cursors := &respCursors{keys: map[uint64][]byte{}}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveRESPConn(conn, db, cursors)
+	}
+}
+
+func serveRESPConn(conn net.Conn, db *DB, cursors *respCursors) {
+	defer conn.Close()
+	// a command that panics closes its own connection, not the server
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Println("RESP connection from ", conn.RemoteAddr(), " fails: ", err)
+		}
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeRESP(w, errRespProtocol)
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(string(args[0]))
+		if name == "QUIT" {
+			writeRESP(w, "OK")
+			w.Flush()
+			return
+		}
+		writeRESP(w, execRESP(db, cursors, name, args[1:]))
+		// the replies of pipelined commands are sent together
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readRESPCommand reads a command sent as an array of bulk strings, or an inline command.
+func readRESPCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, f := range strings.Fields(string(line)) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > 1024*1024 {
+		return nil, errRespProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRespProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, errRespProtocol
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, unexpected(err)
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, errRespProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// writeRESP writes a reply: a string is a simple string, []byte a bulk string and nil a nil bulk string.
+func writeRESP(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case error:
+		if errors.Is(v, ErrReadOnly) {
+			v = errRespReadOnly
+		}
+		msg := v.Error()
+		if !strings.HasPrefix(msg, "ERR ") && !strings.HasPrefix(msg, "WRONGTYPE ") && !strings.HasPrefix(msg, "READONLY ") {
+			msg = "ERR " + msg
+		}
+		// a simple string cannot hold a line break
+		w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+	case string:
+		w.WriteString("+" + v + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case []byte:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, e := range v {
+			writeRESP(w, e)
+		}
+	default:
+		writeRESP(w, fmt.Errorf("ERR unsupported reply %T", reply))
+	}
+}
+
+// respArity is the smallest and the largest number of arguments of the commands, -1 for no limit.
+var respArity = map[string][2]int{
+	"PING": {0, 1}, "ECHO": {1, 1}, "GET": {1, 1}, "SET": {2, -1}, "DEL": {1, -1}, "EXISTS": {1, -1},
+	"MGET": {1, -1}, "MSET": {2, -1}, "SCAN": {1, -1}, "INCRBY": {2, 2}, "INFO": {0, -1}, "COMMAND": {0, -1},
+}
+
+// execRESP runs a command and returns its reply.
+func execRESP(db *DB, cursors *respCursors, name string, args [][]byte) interface{} {
+	n, ok := respArity[name]
+	if !ok {
+		return fmt.Errorf("ERR unknown command '%s'", strings.ToLower(name))
+	}
+	if len(args) < n[0] || (n[1] >= 0 && len(args) > n[1]) {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+	}
+	switch name {
+	case "PING":
+		if len(args) == 1 {
+			return args[0]
+		}
+		return "PONG"
+	case "ECHO":
+		return args[0]
+	case "GET":
+		return respValue(db.Get(args[0]))
+	case "SET":
+		return respSet(db, args)
+	case "DEL":
+		count := 0
+		for _, key := range args {
+			err := db.Delete(key)
+			if err == nil {
+				count++
+			} else if err != ErrKeynotfound {
+				return err
+			}
+		}
+		return count
+	case "EXISTS":
+		count := 0
+		for _, key := range args {
+			_, err := db.Get(key)
+			if err == nil {
+				count++
+			} else if err != ErrKeynotfound {
+				return err
+			}
+		}
+		return count
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			value, err := db.Get(key)
+			if err == nil {
+				values[i] = value
+			}
+		}
+		return values
+	case "MSET":
+		if len(args)%2 != 0 {
+			return fmt.Errorf("ERR wrong number of arguments for 'mset' command")
+		}
+		batch := &WriteBatch{}
+		for i := 0; i < len(args); i += 2 {
+			batch.Put("", args[i], args[i+1])
+		}
+		if err := db.Write(batch); err != nil {
+			return err
+		}
+		return "OK"
+	case "SCAN":
+		return respScan(db, cursors, args)
+	case "INCRBY":
+		delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return errRespNotInt
+		}
+		value, err := incrBy(db, args[0], delta)
+		if err != nil {
+			return err
+		}
+		return value
+	case "INFO":
+		return []byte(respInfo(db))
+	case "COMMAND":
+		// redis-cli asks for the documentation of the commands when it starts, there is none
+		return []interface{}{}
+	}
+	return nil
+}
+
+// respValue turns the result of a Get into a reply, a missing key is nil.
+func respValue(value []byte, err error) interface{} {
+	if err == ErrKeynotfound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return value
+}
+
+// respSet runs SET key value [EX seconds | PX milliseconds] [NX | XX].
+// It replies nil when the NX or XX condition prevents the write.
+func respSet(db *DB, args [][]byte) interface{} {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if ttl != 0 || i+1 == len(args) {
+				return errRespSyntax
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return errRespNotInt
+			}
+			if n <= 0 {
+				return errors.New("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if strings.ToUpper(string(args[i])) == "PX" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			return errRespSyntax
+		}
+	}
+	if nx && xx {
+		return errRespSyntax
+	}
+	if !nx && !xx {
+		if err := db.PutWithTTL(key, value, ttl); err != nil {
+			return err
+		}
+		return "OK"
+	}
+	ok, err := db.PutIf(key, value, ttl, func(current []byte, found bool) bool {
+		return found == xx
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return "OK"
+}
+
+// respScan runs SCAN cursor [MATCH pattern] [COUNT count]. A scan visits the keys in order and the cursor
+// stands for the last key visited, so the next call starts after it: a scan sees the keys that exist for
+// its whole duration whatever is written meanwhile, and each call only reads the keys it visits.
+// COUNT is the number of keys visited, MATCH filters them.
+func respScan(db *DB, cursors *respCursors, args [][]byte) interface{} {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return errors.New("ERR invalid cursor")
+	}
+	var pattern []byte
+	count := 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errRespSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				return errRespSyntax
+			}
+		default:
+			return errRespSyntax
+		}
+	}
+	var start []byte
+	if cursor != 0 {
+		last, ok := cursors.get(cursor)
+		if !ok {
+			return errors.New("ERR invalid cursor")
+		}
+		// the smallest key after the last one
+		start = append(append([]byte{}, last...), 0)
+	}
+	it, err := db.def.iterate(start, nil)
+	if err != nil {
+		return err
+	}
+	keys := []interface{}{}
+	var last []byte
+	visited := 0
+	for visited < count && it.Next() {
+		visited++
+		last = it.Key()
+		if pattern == nil || globMatch(pattern, last) {
+			keys = append(keys, last)
+		}
+	}
+	more := visited == count && it.Next()
+	err = it.Err()
+	if err1 := it.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	// the cursor 0 ends the scan
+	var next uint64
+	if more {
+		next = cursors.add(last)
+	}
+	return []interface{}{[]byte(strconv.FormatUint(next, 10)), keys}
+}
+
+// globMatch reports whether s matches the glob pattern of Redis: * is any string, / included, ? is any
+// byte, [abc] is one of the bytes, [^abc] one that is not, [a-z] a range and \ escapes the next byte.
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					match = match || pattern[1] == s[0]
+					pattern = pattern[2:]
+				case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (s[0] >= lo && s[0] <= hi)
+					pattern = pattern[3:]
+				default:
+					match = match || pattern[0] == s[0]
+					pattern = pattern[1:]
+				}
+			}
+			// an unclosed bracket ends the pattern, like in Redis
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// incrBy adds delta to the integer value of the key, a missing key counts as 0, and returns
+// the new value. The new value keeps the TTL of the old one, like in Redis.
+func incrBy(db *DB, key []byte, delta int64) (int64, error) {
+	var n int64
+	_, err := db.Update(key, KeepTTL, func(current []byte, found bool) ([]byte, error) {
+		n = 0
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+				return nil, errRespNotInt
+			}
+		}
+		if (delta > 0 && n > (1<<63-1)-delta) || (delta < 0 && n < (-1<<63)-delta) {
+			return nil, errors.New("ERR increment or decrement would overflow")
+		}
+		n += delta
+		return []byte(strconv.FormatInt(n, 10)), nil
+	})
+	return n, err
+}
+
+// respInfo is the reply of INFO, a few fields in the format of Redis.
+func respInfo(db *DB) string {
+	var b strings.Builder
+	b.WriteString("# Server\r\nredis_version:7.0.0\r\nredis_mode:standalone\r\nserver:kvstore\r\n")
+	b.WriteString("\r\n# Keyspace\r\n")
+	for _, s := range db.Stats() {
+		fmt.Fprintf(&b, "%s:memtable_keys=%d,sstables=%d,sstable_entries=%d,sstable_bytes=%d,quarantined_sstables=%d\r\n",
+			s.Name, s.MemtableKeys, s.SSTables, s.SSTableEntries, s.SSTableBytes, s.QuarantinedSSTables)
+	}
+	return b.String()
+}
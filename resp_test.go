@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRESP(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeRESP(ln, db)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// send writes the command as an array of bulk strings and reads a reply made of lines lines
+	send := func(lines int, args ...string) string {
+		t.Helper()
+		var b strings.Builder
+		b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, a := range args {
+			b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+		}
+		if _, err := conn.Write([]byte(b.String())); err != nil {
+			t.Fatal(err)
+		}
+		var reply strings.Builder
+		for i := 0; i < lines; i++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.WriteString(line)
+		}
+		return reply.String()
+	}
+	expect := func(got, want string) {
+		t.Helper()
+		if got != want {
+			t.Fatalf("Expected reply %q, but got %q", want, got)
+		}
+	}
+
+	expect(send(1, "PING"), "+PONG\r\n")
+	expect(send(1, "SET", "a", "1"), "+OK\r\n")
+	expect(send(2, "GET", "a"), "$1\r\n1\r\n")
+	expect(send(1, "GET", "missing"), "$-1\r\n")
+	expect(send(1, "SET", "a", "2", "NX"), "$-1\r\n")
+	expect(send(1, "SET", "b", "2", "XX"), "$-1\r\n")
+	expect(send(1, "SET", "b", "2", "NX", "EX", "100"), "+OK\r\n")
+	expect(send(1, "MSET", "c", "3", "d", "a\r\nb"), "+OK\r\n")
+	expect(send(7, "MGET", "a", "missing", "d"), "*3\r\n$1\r\n1\r\n$-1\r\n$4\r\na\r\nb\r\n")
+	expect(send(1, "EXISTS", "a", "b", "missing"), ":2\r\n")
+	expect(send(1, "INCRBY", "counter", "5"), ":5\r\n")
+	expect(send(1, "INCRBY", "counter", "-7"), ":-2\r\n")
+	expect(send(1, "INCRBY", "d", "1"), "-ERR value is not an integer or out of range\r\n")
+	expect(send(1, "DEL", "a", "missing", "c"), ":2\r\n")
+	expect(send(1, "NOPE"), "-ERR unknown command 'nope'\r\n")
+	expect(send(1, "GET"), "-ERR wrong number of arguments for 'get' command\r\n")
+
+	// the keys are now b, counter and d, scanned two at a time
+	expect(send(8, "SCAN", "0", "COUNT", "2"), "*2\r\n$1\r\n1\r\n*2\r\n$1\r\nb\r\n$7\r\ncounter\r\n")
+	// deleting a key already returned does not make the scan skip the next ones
+	expect(send(1, "DEL", "b"), ":1\r\n")
+	expect(send(6, "SCAN", "1", "COUNT", "2"), "*2\r\n$1\r\n0\r\n*1\r\n$1\r\nd\r\n")
+	expect(send(1, "SCAN", "1"), "-ERR invalid cursor\r\n")
+	expect(send(6, "SCAN", "0", "MATCH", "c*"), "*2\r\n$1\r\n0\r\n*1\r\n$7\r\ncounter\r\n")
+	// * goes over the / of the keys
+	expect(send(1, "SET", "user/1/name", "x"), "+OK\r\n")
+	expect(send(6, "SCAN", "0", "MATCH", "u*name"), "*2\r\n$1\r\n0\r\n*1\r\n$11\r\nuser/1/name\r\n")
+
+	// INCRBY keeps the TTL of the key
+	expect(send(1, "SET", "ttl", "1", "EX", "100"), "+OK\r\n")
+	expect(send(1, "INCRBY", "ttl", "1"), ":2\r\n")
+	if _, expiresAt, err := db.def.lookup([]byte("ttl")); err != nil || expiresAt == 0 {
+		t.Fatalf("Expected INCRBY to keep the TTL, but got %d (%v)", expiresAt, err)
+	}
+
+	// an inline command, as typed in telnet
+	if _, err := conn.Write([]byte("ECHO hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, _ := r.ReadString('\n')
+	line2, _ := r.ReadString('\n')
+	expect(line+line2, "$5\r\nhello\r\n")
+	expect(send(1, "QUIT"), "+OK\r\n")
+
+	// a negative array length is a protocol error that closes the connection, the server goes on
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	bad.Write([]byte("*-1\r\n"))
+	badReader := bufio.NewReader(bad)
+	line, _ = badReader.ReadString('\n')
+	expect(line, "-ERR Protocol error\r\n")
+	if _, err := badReader.ReadString('\n'); err == nil {
+		t.Fatal("Expected the connection to be closed after a protocol error")
+	}
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	expect(send(1, "PING"), "+PONG\r\n")
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"a*", "a/b/c", true},
+		{"*c", "a/b/c", true},
+		{"a?c", "a/c", true},
+		{"a?c", "ac", false},
+		{"h[ae]llo", "hello", true},
+		{"h[^e]llo", "hello", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hello", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a**b", "axyb", true},
+		{"abc", "abcd", false},
+	} {
+		if got := globMatch([]byte(c.pattern), []byte(c.s)); got != c.match {
+			t.Errorf("Expected globMatch(%q, %q) to be %v", c.pattern, c.s, c.match)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// A scanIterator visits the live keys of a column family in ascending order, merging the SSTables and the
+// tree as it goes instead of loading them first. It reads a snapshot of the family: the tree is copied and
+// the SSTables are opened when it is created, so the lock of the database is only held for that. The files
+// stay readable through their handles when a compaction deletes them. Close releases the files, after
+// reading the rest of the files that the iterator did not reach the end of, to check their checksums.
+// The checksum of a file is only known once the file was read to its end, so a scan may yield entries
+// of a corrupt file before it fails with a *CorruptionError. With Options.Paranoid every file is read
+// and checked when the iterator is created, and no entry of a corrupt file is ever yielded.
+type scanIterator struct {
+	operators map[string]MergeOperator
+	// sources are the entries of the SSTables from the oldest to the newest, then those of the tree
+	sources []entrySource
+	// heads are the next entries of the sources, nil once a source is done
+	heads []*Node
+	end   []byte
+	key   []byte
+	value []byte
+	// expiresAt is when the key expires in unix nanoseconds, 0 if it does not
+	expiresAt int64
+	err       error
+}
+
+// An entrySource gives the entries of an SSTable or of a tree in ascending order of their keys,
+// nil once there is none left.
+type entrySource interface {
+	next() (*Node, error)
+	Close() error
+}
+
+// iterate returns an iterator of the keys of the family from start, included, to end, excluded. A nil
+// start or end leaves the range open on that side.
+func (cf *ColumnFamily) iterate(start, end []byte) (*scanIterator, error) {
+	cf.db.mu.RLock()
+	defer cf.db.mu.RUnlock()
+	if cf.dropped {
+		return nil, ErrFamilyNotFound
+	}
+	it := &scanIterator{operators: cf.db.operators, end: end}
+	for _, sst := range cf.sst.sstables {
+		if (end != nil && bytes.Compare(sst.smallestKey, end) >= 0) || (start != nil && bytes.Compare(sst.largestKey, start) < 0) {
+			continue
+		}
+		c, err := openSSTCursor(sst, cf.db.opts.Paranoid)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.sources = append(it.sources, c)
+	}
+	it.sources = append(it.sources, copyTree(cf.tree, start, end))
+	for _, source := range it.sources {
+		head, err := seek(source, start)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.heads = append(it.heads, head)
+	}
+	return it, nil
+}
+
+// seek returns the first entry of the source whose key is not smaller than start.
+func seek(source entrySource, start []byte) (*Node, error) {
+	for {
+		n, err := source.next()
+		if err != nil || n == nil || start == nil || bytes.Compare(n.Key, start) >= 0 {
+			return n, err
+		}
+	}
+}
+
+// Next moves to the next live key and reports whether there is one. It returns false at the end of the
+// range or on an error, which Err returns.
+func (it *scanIterator) Next() bool {
+	for it.err == nil {
+		var key []byte
+		for _, head := range it.heads {
+			if head != nil && (key == nil || bytes.Compare(head.Key, key) < 0) {
+				key = head.Key
+			}
+		}
+		if key == nil || (it.end != nil && bytes.Compare(key, it.end) >= 0) {
+			return false
+		}
+		// the entries of the key are put on top of each other from the oldest source, like Tree.put does
+		var n *Node
+		for i, head := range it.heads {
+			if head == nil || !bytes.Equal(head.Key, key) {
+				continue
+			}
+			if n != nil && head.unresolved {
+				n.operands = append(n.operands, head.operands...)
+			} else {
+				n = &Node{
+					Key:        head.Key,
+					Value:      head.Value,
+					marker:     head.marker,
+					operands:   append([]operand(nil), head.operands...),
+					unresolved: head.unresolved,
+					expiresAt:  head.expiresAt,
+				}
+			}
+			if it.heads[i], it.err = it.sources[i].next(); it.err != nil {
+				return false
+			}
+		}
+		// everything older than the node is already in it, operands left unresolved apply to a missing key
+		value, err := resolve(it.operators, n.Key, []*Node{n})
+		if err == ErrKeynotfound {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.key, it.value, it.expiresAt = n.Key, value, 0
+		// the expiry is that of the value the operands apply to, like in ColumnFamily.lookup
+		if !n.unresolved && n.marker {
+			it.expiresAt = n.expiresAt
+		}
+		return true
+	}
+	return false
+}
+
+// Key returns the key that Next moved to.
+func (it *scanIterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the key that Next moved to.
+func (it *scanIterator) Value() []byte {
+	return it.value
+}
+
+// ExpiresAt returns when the key that Next moved to expires in unix nanoseconds, 0 if it does not.
+func (it *scanIterator) ExpiresAt() int64 {
+	return it.expiresAt
+}
+
+// Err returns the error that stopped Next, if any.
+func (it *scanIterator) Err() error {
+	return it.err
+}
+
+// Close closes the SSTables of the iterator. It returns a *CorruptionError if one of them does not
+// match its checksum.
+func (it *scanIterator) Close() error {
+	var err error
+	for _, source := range it.sources {
+		if err1 := source.Close(); err == nil {
+			err = err1
+		}
+	}
+	it.sources = nil
+	it.heads = nil
+	return err
+}
+
+// treeSource is the copy of the entries of a tree in a range.
+type treeSource struct {
+	nodes []*Node
+}
+
+// copyTree copies the entries of the tree from start to end, so that the writes that change the tree
+// afterwards are not seen.
+func copyTree(tree *Tree, start, end []byte) *treeSource {
+	s := &treeSource{}
+	for it := tree.Iterator(); it.HasNext(); {
+		n, err := it.Next()
+		if err != nil {
+			break
+		}
+		if (start != nil && bytes.Compare(n.Key, start) < 0) || (end != nil && bytes.Compare(n.Key, end) >= 0) {
+			continue
+		}
+		s.nodes = append(s.nodes, &Node{
+			Key:        n.Key,
+			Value:      n.Value,
+			marker:     n.marker,
+			operands:   append([]operand(nil), n.operands...),
+			unresolved: n.unresolved,
+			expiresAt:  n.expiresAt,
+		})
+	}
+	return s
+}
+
+func (s *treeSource) next() (*Node, error) {
+	if len(s.nodes) == 0 {
+		return nil, nil
+	}
+	n := s.nodes[0]
+	s.nodes = s.nodes[1:]
+	return n, nil
+}
+
+func (s *treeSource) Close() error {
+	return nil
+}
+
+// sstCursor reads the entries of an SSTable one at a time. The checksum is computed while the file is
+// read and checked after the last entry, a file that does not match it ends the scan with a *CorruptionError.
+// The entries read before are not checked yet, unless the cursor was opened paranoid.
+type sstCursor struct {
+	sst  *SStable
+	file vfs.File
+	// body is the file up to the checksum, it goes through crc
+	body      io.Reader
+	crc       hash.Hash32
+	entries   *bufio.Reader
+	r         io.Reader
+	remaining int
+}
+
+// openSSTCursor opens a cursor on the entries of the SSTable. A paranoid cursor reads the whole file and checks
+// its checksum first, then reads the entries again from the start.
+func openSSTCursor(sst *SStable, paranoid bool) (*sstCursor, error) {
+	f, err := sst.filesystem().Open(sst.name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	header := 4 + 4 + 4 + 4 + 2 + len(sst.smallestKey) + len(sst.largestKey)
+	if info.Size() < int64(header)+4 {
+		f.Close()
+		return nil, &CorruptionError{File: sst.name, Reason: "the file is truncated"}
+	}
+	c := &sstCursor{sst: sst, file: f, crc: crc32.NewIEEE(), remaining: sst.entryCount}
+	c.body = io.TeeReader(io.LimitReader(f, info.Size()-4), c.crc)
+	// the header was read when the SSTable was opened, it only goes through the checksum
+	if _, err := io.CopyN(io.Discard, c.body, int64(header)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.entries = bufio.NewReader(c.body)
+	if paranoid {
+		if err := c.finish(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.Seek(int64(header), io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		c.body = io.LimitReader(f, info.Size()-4-int64(header))
+		c.entries = bufio.NewReader(c.body)
+	}
+	c.r = c.entries
+	if sst.version == 2 {
+		c.r = flate.NewReader(c.entries)
+	}
+	return c, nil
+}
+
+func (c *sstCursor) next() (*Node, error) {
+	if c.remaining == 0 {
+		return nil, c.finish()
+	}
+	n, err := readNode(c.r)
+	if err != nil {
+		reason := fmt.Sprintf("entry %d: %v", c.sst.entryCount-c.remaining, err)
+		// the file is already known to be corrupt, its checksum is not checked
+		c.remaining = 0
+		c.crc = nil
+		return nil, &CorruptionError{File: c.sst.name, Reason: reason}
+	}
+	c.remaining--
+	return n, nil
+}
+
+// finish reads what is left of the file and checks its checksum, once.
+func (c *sstCursor) finish() error {
+	if c.crc == nil {
+		return nil
+	}
+	crc := c.crc
+	c.crc = nil
+	if _, err := io.Copy(io.Discard, c.entries); err != nil {
+		return err
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(c.file, sum[:]); err != nil {
+		return &CorruptionError{File: c.sst.name, Reason: "the checksum is missing"}
+	}
+	if crc.Sum32() != uint32(decodeInt(sum[:])) || crc.Sum32() != uint32(c.sst.checksum) {
+		return &CorruptionError{File: c.sst.name, Reason: "checksum mismatch"}
+	}
+	return nil
+}
+
+func (c *sstCursor) Close() error {
+	err := c.finish()
+	if err1 := c.file.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// countingFS counts the files opened for reading.
+type countingFS struct {
+	vfs.FS
+	opens map[string]int
+}
+
+func (fs *countingFS) Open(name string) (vfs.File, error) {
+	fs.opens[name]++
+	return fs.FS.Open(name)
+}
+
+func TestScanIterator(t *testing.T) {
+	fs := &countingFS{FS: vfs.NewMemFS(), opens: map[string]int{}}
+	db, err := OpenWithOptions("db", Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := map[string]string{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		db.Put([]byte(key), []byte("v1"))
+		want[key] = "v1"
+		if i%100 == 99 {
+			if err := FlushToDisk(db); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// newer files and the tree replace, delete and merge into the keys of the older files
+	for i := 0; i < 300; i += 7 {
+		key := fmt.Sprintf("k%03d", i)
+		db.Put([]byte(key), []byte("v2"))
+		want[key] = "v2"
+	}
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 300; i += 5 {
+		key := fmt.Sprintf("k%03d", i)
+		db.Delete([]byte(key))
+		delete(want, key)
+	}
+	db.Merge([]byte("k000"), "append", []byte("+"))
+	want["k000"] = "v2+"
+
+	count := 0
+	for name := range fs.opens {
+		fs.opens[name] = 0
+	}
+	it, err := db.def.iterate([]byte("k000"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each SSTable is opened once, when the iterator is created, for the whole scan
+	for name, n := range fs.opens {
+		if n > 1 {
+			t.Fatalf("Expected %s to be opened once, but it was opened %d times", name, n)
+		}
+	}
+	// the writes after the iterator was created are not seen, even once flushed and compacted
+	db.Put([]byte("k002"), []byte("later"))
+	db.Delete([]byte("k003"))
+	for i := 0; i < maxFiles; i++ {
+		if err := FlushToDisk(db); err != nil {
+			t.Fatal(err)
+		}
+		db.Put([]byte(fmt.Sprintf("later%d", i)), []byte("x"))
+	}
+	opens := 0
+	for name := range fs.opens {
+		opens += fs.opens[name]
+	}
+	var last string
+	for it.Next() {
+		key := string(it.Key())
+		if key <= last {
+			t.Fatalf("Expected the keys in order, but got %s after %s", key, last)
+		}
+		last = key
+		if want[key] != string(it.Value()) {
+			t.Fatalf("Expected %q for %s, but got %q", want[key], key, it.Value())
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(want) {
+		t.Fatalf("Expected %d keys, but got %d", len(want), count)
+	}
+	for name := range fs.opens {
+		opens -= fs.opens[name]
+	}
+	if opens != 0 {
+		t.Fatalf("Expected the scan not to open the SSTables again, but it opened %d files", -opens)
+	}
+
+	// a corrupt value is found by the checksum, also when the scan stops before the end of the file
+	if err := db.def.sst.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	name := db.def.sst.sstables[0].name
+	content, _ := vfs.ReadFile(fs, name)
+	content[len(content)-6] ^= 0xff
+	f, _ := fs.Create(name)
+	f.Write(content)
+	f.Close()
+	err = db.Scan(nil, nil, func(key, value []byte) bool { return false })
+	var corrupt *CorruptionError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &corrupt) || corrupt.File != name {
+		t.Fatalf("Expected a CorruptionError for %s, but got %v", name, err)
+	}
+}
+
+func TestScanParanoid(t *testing.T) {
+	for _, paranoid := range []bool{false, true} {
+		t.Run(fmt.Sprintf("paranoid=%v", paranoid), func(t *testing.T) {
+			fs := vfs.NewMemFS()
+			db, err := OpenWithOptions("db", Options{FS: fs, Paranoid: paranoid})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for _, key := range []string{"a", "b", "c"} {
+				db.Put([]byte(key), []byte("value-"+key))
+			}
+			if err := FlushToDisk(db); err != nil {
+				t.Fatal(err)
+			}
+			// the value of the first entry is damaged, the entry can still be read
+			name := db.def.sst.sstables[0].name
+			content, _ := vfs.ReadFile(fs, name)
+			content[bytes.Index(content, []byte("value-a"))] ^= 0xff
+			f, _ := fs.Create(name)
+			f.Write(content)
+			f.Close()
+
+			var keys []string
+			err = db.Scan(nil, nil, func(key, value []byte) bool {
+				keys = append(keys, string(key))
+				return true
+			})
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("Expected the scan to fail with ErrCorrupt, but got %v", err)
+			}
+			// without paranoid the entries come before the checksum is checked, with it none of them does
+			if paranoid && len(keys) != 0 {
+				t.Fatalf("Expected no key of the corrupt file, but got %v", keys)
+			}
+			if !paranoid && (len(keys) == 0 || keys[0] != "a") {
+				t.Fatalf("Expected the damaged entry to be yielded before the checksum is checked, but got %v", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+)
+
+// servers are the listeners of the process, stopped by shutdown. The ones that were not started are nil.
+type servers struct {
+	http *http.Server
+	grpc *grpc.Server
+	// listeners are the ones of the Redis and memcached servers
+	listeners []net.Listener
+}
+
+// shutdown stops the process cleanly: the servers stop accepting connections, the http and gRPC requests
+// in flight are served until ctx is done, the wal is synced, the trees are flushed if flush is set and the
+// database is closed. The flushes and the compactions hold the lock of the database, so syncing the wal
+// waits for the one that is running. The connections of the Redis and memcached servers that are still
+// open are not waited for, their next command fails once the database is closed.
+func shutdown(ctx context.Context, s servers, db *DB, flush bool) error {
+	var errs []error
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	if s.grpc != nil {
+		done := make(chan struct{})
+		go func() {
+			s.grpc.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.grpc.Stop()
+		}
+	}
+	if s.http != nil {
+		if err := s.http.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("http shutdown: %w", err))
+			s.http.Close()
+		}
+	}
+	if err := db.Sync(); err != nil {
+		errs = append(errs, fmt.Errorf("wal sync: %w", err))
+	}
+	if flush {
+		fmt.Println("Flushes the memtable before exiting")
+		if err := db.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("flush: %w", err))
+		}
+	}
+	if err := db.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("close: %w", err))
+	}
+	return errors.Join(errs...)
+}
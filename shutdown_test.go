@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		if err := db.Put([]byte("slow"), []byte("done")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := servers{http: &http.Server{Handler: mux}}
+	go srv.http.Serve(ln)
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	<-entered
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- shutdown(context.Background(), srv, db, true)
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("Expected the shutdown to wait for the request in flight, but it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if code := <-status; code != http.StatusOK {
+		t.Fatalf("Expected the request in flight to be served, but got %d", code)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String() + "/slow"); err == nil {
+		t.Fatal("Expected the server to refuse new requests after the shutdown")
+	}
+
+	// the write of the drained request was flushed, there is nothing left to replay
+	db = openTestDB(t, dir)
+	if db.def.tree.Len() != 0 {
+		t.Fatalf("Expected the memtable to be flushed by the shutdown, but it has %d keys", db.def.tree.Len())
+	}
+	if value, err := db.Get([]byte("slow")); err != nil || string(value) != "done" {
+		t.Fatalf("Expected the write of the drained request, but got %s (%v)", value, err)
+	}
+}
+
+func TestShutdownClose(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background(), servers{}, db, false); err != nil {
+		t.Fatal(err)
+	}
+	// the database is opened again while main still has the first one to close on its way out
+	reopened := openTestDB(t, dir)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Expected the second close to do nothing, but got %v", err)
+	}
+	if _, err := Open(dir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected the second close to leave the lock of the new database, but got %v", err)
+	}
+	if err := reopened.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Expected the new database to work after the second close, but got %v", err)
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
 	// "encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"time"
+
+	"github.com/um6p/kvstore/vfs"
 )
 //todo read in compact read the whole content 
 var (
@@ -28,219 +33,376 @@ type SStable struct {
 	version     int
 	checksum    int
 	name        string
+	// level and the sequence range of the file are recorded in the manifest, see manifest.go
+	level       int
+	smallestSeq int64
+	largestSeq  int64
+	// fs is the filesystem of the file, the one of the operating system if it is nil
+	fs vfs.FS
 }
 type SStables struct {
 	sstables     []*SStable
 	path         string //path to the sstable directory
 	numOfSStable int
+	// operators resolve merge operands during compaction, they are shared with the DB
+	operators map[string]MergeOperator
+	// compression compresses the key-value pairs of the new sstables
+	compression bool
+	// quarantined are the paths of the corrupt files moved to the quarantine directory when they were loaded
+	quarantined []string
+	// manifest records the files added and removed by the flushes and the compactions, under the name of
+	// the column family. Without a manifest the files are the ones of the directory.
+	manifest *manifest
+	family   string
+	// fs is the filesystem of the directory
+	fs vfs.FS
 }
 
+// tmpSuffix is added to the name of an SSTable while it is written, see writeFile.
+const tmpSuffix = ".tmp"
+
+// crashPoint is called at the steps of the creation of an SSTable, a flush stops at the step where it
+// returns an error. The tests use it to simulate a crash at that step.
+var crashPoint = func(step string) error { return nil }
+
+// quarantineDir is the directory, inside the directory of the sstables, where the corrupt files are moved.
+const quarantineDir = "quarantine"
+
 // The NewSST function creates a new SStables object by checking if the directory where we store the sstfiles exists, creating it if
-// it doesn't, and then loading any existing sstable files.
+// it doesn't, and then loading any existing sstable files. Corrupt files are quarantined.
 func NewSST(path string) (*SStables, error) {
+	return newSST(path, Options{FS: vfs.Default}, nil, "")
+}
+
+// newSST is NewSST with the options of the database: in paranoid mode a corrupt file is an error instead of
+// being quarantined, and in read-only mode nothing is created, moved or deleted, a corrupt file is only skipped.
+// With a manifest, the files are the live files of the family in the manifest and the other files
+// of the directory are deleted.
+func newSST(path string, opts Options, m *manifest, family string) (*SStables, error) {
+	fs := opts.FS
 	// Open the directory
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+	if _, err := fs.Stat(path); os.IsNotExist(err) && opts.ReadOnly {
+		// a read-only database has no file in a directory that is not there
+		return &SStables{path: path, manifest: m, family: family, fs: fs}, nil
+	} else if os.IsNotExist(err) {
 		// Directory does not exist, create it
-		err := os.Mkdir(path, 0755)
+		err := fs.MkdirAll(path, 0755)
 		if err != nil {
 			return nil, err
 		}
 	} else if err != nil {
 		return nil, err
 	}
-	//opening the directory
-	dir, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	var sstabless []*SStable
+	var quarantined []string
+	var err error
+	if m == nil || m.bootstrap {
+		sstabless, quarantined, err = loadSStable(path, opts)
+	} else {
+		sstabless, quarantined, err = loadLiveSStables(path, opts, m.files[family])
 	}
-	// Read the directory contents
-	files, _ := dir.Readdir(-1)
 	if err != nil {
 		return nil, err
 	}
-	// Count the number of files
-	numOfSst := 0
-	for _, fileInfo := range files {
-		if !fileInfo.IsDir() {
-			numOfSst++
+	if m != nil {
+		if m.bootstrap {
+			// the files of a database without a manifest are ordered by their names, as they used to be
+			for _, sstable := range sstabless {
+				m.lastSequence++
+				sstable.smallestSeq = m.lastSequence
+				sstable.largestSeq = m.lastSequence
+			}
+		}
+		var live []*SStable
+		for _, sstable := range sstabless {
+			live = append(live, sstable.meta())
+		}
+		m.files[family] = live
+	}
+	return &SStables{
+		path:         path,
+		numOfSStable: len(sstabless),
+		sstables:     sstabless,
+		quarantined:  quarantined,
+		manifest:     m,
+		family:       family,
+		fs:           fs,
+	}, nil
+}
+
+// loadLiveSStables loads the live files of the manifest, quarantining the corrupt ones like loadSStable,
+// and deletes the other SSTables of the directory unless the database is read-only. A live file that is
+// missing is an error.
+func loadLiveSStables(path string, opts Options, files []*SStable) ([]*SStable, []string, error) {
+	fs := opts.FS
+	var sstables []*SStable
+	var quarantined []string
+	live := map[string]bool{}
+	for _, f := range files {
+		live[f.name] = true
+		path1 := filepath.Join(path, f.name)
+		sstable, err := openSStable(fs, path1)
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("%w: %s is missing, run kvstore repair", ErrCorruptManifest, path1)
+		}
+		if errors.Is(err, ErrCorrupt) && !opts.Paranoid && opts.ReadOnly {
+			fmt.Println("Skips corrupt sstable: ", path1, " ", err)
+			quarantined = append(quarantined, path1)
+			continue
+		}
+		if errors.Is(err, ErrCorrupt) && !opts.Paranoid {
+			moved, err1 := quarantine(fs, path, f.name)
+			if err1 != nil {
+				return nil, nil, err1
+			}
+			fmt.Println("Quarantines sstable: ", moved, " ", err)
+			quarantined = append(quarantined, moved)
+			continue
 		}
+		if err != nil {
+			return nil, nil, err
+		}
+		sstable.name = path1
+		sstable.level = f.level
+		sstable.smallestSeq = f.smallestSeq
+		sstable.largestSeq = f.largestSeq
+		sstables = append(sstables, sstable)
+	}
+	if opts.ReadOnly {
+		return sstables, quarantined, nil
 	}
-	//closing the directory
-	err = dir.Close()
+	entries, err := fs.ReadDir(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if numOfSst == 0 {
-		return &SStables{
-			path:         path,
-			numOfSStable: 0,
-		}, nil
-	} else {
-		sstabless, err := loadSStable(path)
-		if err != nil {
-			return nil, err
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == tmpSuffix {
+			if err := removeTemp(fs, path, entry.Name()); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".sst" || live[entry.Name()] {
+			continue
+		}
+		// an orphan is the output of an interrupted flush or compaction, or an input of a finished compaction
+		if err := fs.Remove(filepath.Join(path, entry.Name())); err != nil {
+			return nil, nil, err
 		}
+		fmt.Println("Deletes orphan sstable: ", filepath.Join(path, entry.Name()))
+	}
+	return sstables, quarantined, nil
+}
+
+// removeTemp deletes a file left by a crash while an SSTable was written, before it was renamed.
+func removeTemp(fs vfs.FS, path, name string) error {
+	if err := fs.Remove(filepath.Join(path, name)); err != nil {
+		return err
+	}
+	fmt.Println("Deletes unfinished sstable: ", filepath.Join(path, name))
+	return nil
+}
 
-		return &SStables{
-			path:         path,
-			numOfSStable: numOfSst,
-			sstables:     sstabless,
-		}, nil
+// meta returns the description of the file recorded in the manifest, with its name relative to its directory.
+func (s *SStable) meta() *SStable {
+	return &SStable{
+		name:        filepath.Base(s.name),
+		level:       s.level,
+		smallestSeq: s.smallestSeq,
+		largestSeq:  s.largestSeq,
+		smallestKey: s.smallestKey,
+		largestKey:  s.largestKey,
 	}
 }
 
-// Load all SSTables from a given directory
-func loadSStable(path string) ([]*SStable, error) {
-	var sstables []*SStable
-	dir, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// logEdit records the added and removed files in the manifest, if there is one. A flush passes the offset of the
+// wal before which the entries of the family are in the added file, the other edits pass 0.
+func (s *SStables) logEdit(added, removed []*SStable, walOffset int64) error {
+	if s.manifest == nil {
+		return nil
 	}
-	defer dir.Close()
-	files, err := dir.Readdir(-1)
+	e := &versionEdit{family: s.family, walOffset: walOffset}
+	for _, sstable := range added {
+		e.added = append(e.added, sstable.meta())
+		if sstable.largestSeq > e.lastSequence {
+			e.lastSequence = sstable.largestSeq
+		}
+	}
+	for _, sstable := range removed {
+		e.removed = append(e.removed, filepath.Base(sstable.name))
+	}
+	return s.manifest.log(e)
+}
+
+// Load all SSTables from a given directory.
+// A corrupt file is moved to the quarantine directory, so that it is neither read nor compacted, and the
+// system continues processing with the intact files. The paths of the quarantined files are returned.
+// In paranoid mode the first corrupt file is returned as an error instead. In read-only mode a corrupt
+// file is skipped but left in place, and the unfinished files are not deleted.
+func loadSStable(path string, opts Options) ([]*SStable, []string, error) {
+	fs := opts.FS
+	var sstables []*SStable
+	var quarantined []string
+	files, err := fs.ReadDir(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	// the names are timestamps, sorting them puts the oldest file first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
 	for _, file := range files {
-		if file.IsDir() {
+		if !file.IsDir() && filepath.Ext(file.Name()) == tmpSuffix && opts.ReadOnly {
+			continue
+		}
+		if !file.IsDir() && filepath.Ext(file.Name()) == tmpSuffix {
+			if err := removeTemp(fs, path, file.Name()); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		// the directory can also hold the directories of the column families
+		if file.IsDir() || filepath.Ext(file.Name()) != ".sst" {
 			continue
 		}
 		path1 := fmt.Sprintf(path + "/" + file.Name())
-		sstable, err := openSStable(path1)
-		// In the case of a corrupted file, it is ignored, and the system continues processing with the intact files.
-		if err == ErrCorrupt {
+		sstable, err := openSStable(fs, path1)
+		if errors.Is(err, ErrCorrupt) && !opts.Paranoid && opts.ReadOnly {
+			fmt.Println("Skips corrupt sstable: ", path1, " ", err)
+			quarantined = append(quarantined, path1)
+			continue
+		}
+		if errors.Is(err, ErrCorrupt) && !opts.Paranoid {
+			moved, err1 := quarantine(fs, path, file.Name())
+			if err1 != nil {
+				return nil, nil, err1
+			}
+			fmt.Println("Quarantines sstable: ", moved, " ", err)
+			quarantined = append(quarantined, moved)
 			continue
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		sstable.name = path1
 		sstables = append(sstables, sstable)
 	}
-	return sstables, nil
+	return sstables, quarantined, nil
+}
+
+// quarantine moves the file name of the directory path to its quarantine directory and returns its new path.
+func quarantine(fs vfs.FS, path, name string) (string, error) {
+	dir := filepath.Join(path, quarantineDir)
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	moved := filepath.Join(dir, name)
+	if err := fs.Rename(filepath.Join(path, name), moved); err != nil {
+		return "", err
+	}
+	return moved, nil
+}
+
+// CorruptionError is returned when an SSTable file is corrupt. It matches ErrCorrupt with errors.Is.
+type CorruptionError struct {
+	// File is the path of the SSTable file
+	File string
+	// Reason tells what is wrong with the file
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt sstable %s: %s", e.File, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
 }
+
+// corrupt returns the *CorruptionError of the SSTable for the reason.
+func (s *SStable) corrupt(format string, args ...interface{}) error {
+	return &CorruptionError{File: s.name, Reason: fmt.Sprintf(format, args...)}
+}
+
 // Given a file path, the function attempts to read the content of the file.
 // Initially, it extracts the checksum from the file and compares it with the checksum
 // written in the file. If the checksums differ, indicating file corruption, an error is returned.
 // If the checksums match, the function proceeds to extract additional information from the file,
 // such as the magic number, entry count...
-func openSStable(path string) (*SStable, error) {
-	var content bytes.Buffer
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
-	// We read the file up to its size minus four, as the checksum within the file
-	// was calculated only for the content that precedes its writing.
-	f := io.LimitReader(file, fileInfo.Size()-4)
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(&content, f)
-	if err != nil {
-		return nil, err
+// A file that is corrupt, too short for its header included, gives a *CorruptionError.
+func openSStable(fs vfs.FS, path string) (*SStable, error) {
+	corrupt := func(reason string) error {
+		return &CorruptionError{File: path, Reason: reason}
 	}
-	checksum := crc32.ChecksumIEEE(content.Bytes())
-
-	_, err = file.Seek(0, io.SeekStart)
+	content, err := vfs.ReadFile(fs, path)
 	if err != nil {
 		return nil, err
 	}
-	//read magic number
-	var magicNumber [4]byte
-	if _, err := file.Read(magicNumber[:]); err != nil {
-		return nil, err
-	}
-	if decodeInt(magicNumber[:]) != 1234 {
-		return nil, ErrCorrupt
+	// the smallest file holds the magic number, the entry count, the lengths of two keys,
+	// the version and the checksum
+	if len(content) < 4+4+4+4+2+4 {
+		return nil, corrupt("the file is truncated")
 	}
-	//read the entry count
-	var entryCount [4]byte
-	if _, err := file.Read(entryCount[:]); err != nil {
-		return nil, err
-	}
-	//read the smallest key
-	var smallestKeyL [4]byte
-	if _, err := file.Read(smallestKeyL[:]); err != nil {
-		return nil, err
-	}
-	smallestKeyLen := decodeInt(smallestKeyL[:])
-	smallestKey := make([]byte, smallestKeyLen)
-	if _, err = file.Read(smallestKey); err != nil {
-		return nil, err
-	}
-	//read the largest key
-	var largestKeyL [4]byte
-	if _, err := file.Read(largestKeyL[:]); err != nil {
-		return nil, err
-	}
-	largestKeyLen := decodeInt(largestKeyL[:])
-	largestKey := make([]byte, largestKeyLen)
-	if _, err = file.Read(largestKey); err != nil {
-		return nil, err
-	}
-	//read the version
-	var versionEncoded [2]byte
-	if _, err := file.Read(versionEncoded[:]); err != nil {
-		return nil, err
+	// The checksum within the file was calculated only for the content that precedes its writing.
+	checksumUint32 := decodeInt(content[len(content)-4:])
+	checksum := crc32.ChecksumIEEE(content[:len(content)-4])
+	if checksum != uint32(checksumUint32) {
+		return nil, corrupt("checksum mismatch")
 	}
-	version := decodeNum(versionEncoded[:])
 
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, err
+	h, err := readSSTHeader(content)
+	if err != nil || h.size > len(content)-4 {
+		return nil, corrupt("the header is truncated")
 	}
-
-	offset := fileInfo.Size() - 4
-	_, err = file.Seek(offset, 0)
-	if err != nil {
-		return nil, err
+	if h.magic != 1234 {
+		return nil, corrupt(fmt.Sprintf("bad magic number %d", h.magic))
 	}
-	var fileChecksum [4]byte
-	if _, err := file.Read(fileChecksum[:]); err != nil {
-
-		return nil, err
-	}
-	checksumUint32 := decodeInt(fileChecksum[:])
-
-	if checksum != uint32(checksumUint32) {
-		return nil, errors.New("corrupt sstable")
+	if h.version != 1 && h.version != 2 {
+		return nil, corrupt(fmt.Sprintf("unknown version %d", h.version))
 	}
+	var magicNumber [4]byte
+	copy(magicNumber[:], content)
 
 	sstable := &SStable{
 		magicNumber: magicNumber,
-		smallestKey: smallestKey,
-		largestKey:  largestKey,
-		entryCount:  decodeInt(entryCount[:]),
-		version:     version,
+		smallestKey: h.smallestKey,
+		largestKey:  h.largestKey,
+		entryCount:  h.entryCount,
+		version:     h.version,
 		checksum:    checksumUint32,
+		fs:          fs,
 	}
 
 	return sstable, nil
 }
 // The format function is used to format the nodes of the tree in a way that they can be written to disk.
 // The format of a node is as follows:
-// 1. A marker that indicates whether the node is a deleted node or not. If the node is deleted, the marker is set to 1, otherwise 0.
+// 1. A marker that indicates whether the node is a deleted node or not. If the node is deleted, the marker is set to 0, otherwise 1.
+//    A node holding merge operands has the marker 2 and a value with a TTL has the marker 3.
 // 2. The length of the key.
 // 3. The key.
 // 4. The length of the value.
-// 5. The value.
+// 5. The value, for merge operands it is encoded by encodeMergeValue and a value with a TTL
+//    is preceded by the 8 bytes of its expiry time.
 func (node *Node) format() []byte {
 	var marker []byte
-	if node.marker {
+	value := node.Value
+	if node.operands != nil {
+		marker = encodeNum(2)
+		value = node.encodeMergeValue()
+	} else if node.marker && node.expiresAt != 0 {
+		marker = encodeNum(3)
+		value = append(encodeInt64(node.expiresAt), node.Value...)
+	} else if node.marker {
 		marker = encodeNum(1)
 	} else {
 		marker = encodeNum(0)
 	}
 	len1 := len(node.Key)
-	len2 := len(node.Value)
+	len2 := len(value)
 	keyLen := encodeInt(len1)
 	valueLen := encodeInt(len2)
 	key := node.Key
-	value := node.Value
 	res := make([]byte, len1+len2+10)
 	copy(res[0:2], marker)
 	copy(res[2:6], keyLen)
@@ -250,110 +412,328 @@ func (node *Node) format() []byte {
 	return res
 }
 
-// When flushing to disk, a new SSTable is created to store the content of the tree.
-// The content is written in a specific order, including the magic number, entry count,
-// smallest key, largest key, version, and key-value pairs, maintaining the order from the tree.
-// then the checksum of the file is calculated and appended to the end of the file.
-// The new SSTable is then added to the list of SSTables.
-// If the count of SSTables reaches the maximum allowable number of files (maxFiles),
-// the compaction process is triggered.
-func (s *SStables) Flush(tree *Tree) error {
-	//create a new sstable
-	path := fmt.Sprintf(s.path + "/" + s.Name())
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		return err
+// encodeMergeValue encodes what the operands of a node apply to followed by the operands:
+// the kind of base (0 if it is in older data, 1 if the key was deleted, 2 if it is a value,
+// 3 if it is a value with a TTL), the length of the base value, the base value (preceded by its expiry time
+// for kind 3), the number of operands and the operands.
+func (node *Node) encodeMergeValue() []byte {
+	var base int
+	switch {
+	case node.unresolved:
+		base = 0
+	case !node.marker:
+		base = 1
+	case node.expiresAt == 0:
+		base = 2
+	default:
+		base = 3
+	}
+	var res []byte
+	res = append(res, encodeNum(base)...)
+	if base == 2 {
+		res = append(res, encodeInt(len(node.Value))...)
+		res = append(res, node.Value...)
+	} else if base == 3 {
+		res = append(res, encodeInt(len(node.Value)+8)...)
+		res = append(res, encodeInt64(node.expiresAt)...)
+		res = append(res, node.Value...)
+	} else {
+		res = append(res, encodeInt(0)...)
 	}
-	//write the magic number
-	magicNumber := encodeInt(1234)
-	if _, err := file.Write(magicNumber); err != nil {
-		return err
+	res = append(res, encodeInt(len(node.operands))...)
+	for _, op := range node.operands {
+		res = append(res, encodeOperand(op)...)
 	}
-	//write the entry count
-	entryCount := encodeInt(tree.Len())
-	if _, err := file.Write(entryCount); err != nil {
+	return res
+}
+
+func (node *Node) decodeMergeValue(value []byte) error {
+	r := bytes.NewReader(value)
+	var base [2]byte
+	if _, err := io.ReadFull(r, base[:]); err != nil {
 		return err
 	}
-	//write the smallest key
-	minKey := encodeInt(len(tree.Min()))
-	if _, err := file.Write(minKey); err != nil {
+	var baseLen [4]byte
+	if _, err := io.ReadFull(r, baseLen[:]); err != nil {
 		return err
 	}
-	_, err = file.Write(tree.Min())
+	baseValue, err := readN(r, decodeInt(baseLen[:]))
 	if err != nil {
 		return err
 	}
-
-	//write the largest key
-	maxKey := encodeInt(len((tree.Max())))
-	if _, err := file.Write(maxKey); err != nil {
+	var count [4]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil {
 		return err
 	}
-	_, err = file.Write((tree.Max()))
+	// a damaged count must not allocate more operands than the bytes left could hold
+	if decodeInt(count[:]) > r.Len() {
+		return fmt.Errorf("%w: %d operands in %d bytes", ErrCorrupt, decodeInt(count[:]), r.Len())
+	}
+	operands := make([]operand, decodeInt(count[:]))
+	for i := range operands {
+		op, err := decodeOperand(r)
+		if err != nil {
+			return err
+		}
+		operands[i] = op
+	}
+	switch decodeNum(base[:]) {
+	case 0:
+		node.unresolved = true
+		node.marker = true
+	case 1:
+		node.marker = false
+	case 2:
+		node.marker = true
+		node.Value = baseValue
+	case 3:
+		if len(baseValue) < 8 {
+			return fmt.Errorf("%w: the expiry of the merge base is too short", ErrCorrupt)
+		}
+		node.marker = true
+		node.expiresAt = decodeInt64(baseValue[:8])
+		node.Value = baseValue[8:]
+	default:
+		return fmt.Errorf("%w: unknown merge base %d", ErrCorrupt, decodeNum(base[:]))
+	}
+	node.operands = operands
+	return nil
+}
+
+// readNode reads an entry written by format.
+func readNode(r io.Reader) (*Node, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return nil, err
+	}
+	var keyLen [4]byte
+	if _, err := io.ReadFull(r, keyLen[:]); err != nil {
+		return nil, err
+	}
+	key, err := readN(r, decodeInt(keyLen[:]))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var valueLen [4]byte
+	if _, err := io.ReadFull(r, valueLen[:]); err != nil {
+		return nil, err
 	}
+	value, err := readN(r, decodeInt(valueLen[:]))
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{Key: key}
+	switch decodeNum(marker[:]) {
+	case 0:
+		node.Value = value
+	case 1:
+		node.Value = value
+		node.marker = true
+	case 2:
+		if err := node.decodeMergeValue(value); err != nil {
+			return nil, err
+		}
+	case 3:
+		if len(value) < 8 {
+			return nil, fmt.Errorf("%w: the expiry is too short", ErrCorrupt)
+		}
+		node.marker = true
+		node.expiresAt = decodeInt64(value[:8])
+		node.Value = value[8:]
+	default:
+		return nil, fmt.Errorf("%w: unknown marker %d", ErrCorrupt, decodeNum(marker[:]))
+	}
+	return node, nil
+}
 
-	//write the version
-	version := encodeNum(1)
-	if _, err := file.Write(version); err != nil {
+// When flushing to disk, a new SSTable is created to store the content of the tree.
+// The content is written in a specific order, including the magic number, entry count,
+// smallest key, largest key, version, and key-value pairs, maintaining the order from the tree.
+// then the checksum of the file is calculated and appended to the end of the file.
+// The new SSTable is then added to the list of SSTables.
+// If the count of SSTables reaches the maximum allowable number of files (maxFiles),
+// the compaction process is triggered.
+func (s *SStables) Flush(tree *Tree) error {
+	if err := s.flushUpTo(tree, 0); err != nil {
 		return err
 	}
-	// We iterate through the tree in ascending order, writing each node into the file
+	return s.compactIfFull()
+}
+
+// flushUpTo is Flush without the compaction, for a tree that holds the entries of the family up to the offset
+// walOffset of the wal. The manifest records the offset with the new file so that the replay skips these entries.
+// The tree is in the SSTables once flushUpTo returns nil, whatever happens to the compaction that follows.
+func (s *SStables) flushUpTo(tree *Tree, walOffset int64) error {
+	// We iterate through the tree in ascending order, the nodes are written in this order
+	var nodes []*Node
 	for it := tree.Iterator(); it.HasNext(); {
 		currNode, err := it.Next()
 		if err != nil {
 			return err
 		}
-		nodeFormat := currNode.format()
-		if _, err := file.Write(nodeFormat); err != nil {
-			return fmt.Errorf("failed to write to disk table %d: %w", s.numOfSStable, err)
-		}
+		nodes = append(nodes, currNode)
 	}
-	//calculating the checksum
-	_, err = file.Seek(0, io.SeekStart)
+	sstable, err := s.write(nodes)
 	if err != nil {
 		return err
 	}
-	var content bytes.Buffer
+	if s.manifest != nil {
+		sstable.smallestSeq = s.manifest.nextSequence()
+		sstable.largestSeq = sstable.smallestSeq
+	}
+	// the file is live once the manifest records it
+	if err := s.logEdit([]*SStable{sstable}, nil, walOffset); err != nil {
+		s.filesystem().Remove(sstable.name)
+		return err
+	}
+	s.numOfSStable++
+	//add the new sstable to the sstables
+	s.sstables = append(s.sstables, sstable)
+	return nil
+}
 
-	_, err = io.Copy(&content, file)
+// compactIfFull starts the compaction process when the count of sstfiles reaches the maximum
+// allowable number of files (maxFiles). A compaction that failed is started again by the next flush.
+func (s *SStables) compactIfFull() error {
+	if s.numOfSStable >= maxFiles {
+		return s.Compact()
+	}
+	return nil
+}
 
-	if err != nil {
-		return err
+// write creates a new SSTable file holding the nodes, sorted by key, in the layout described by Flush.
+// If compression is enabled, the key-value pairs are compressed with DEFLATE and the version is 2.
+func (s *SStables) write(nodes []*Node) (*SStable, error) {
+	//create a new sstable
+	return s.writeFile(fmt.Sprintf(s.path+"/"+s.Name()), nodes)
+}
+
+// writeFile is write to the given path, the position of the file among the SSTables depends on its name.
+func (s *SStables) writeFile(path string, nodes []*Node) (*SStable, error) {
+	var smallestKey, largestKey []byte
+	if len(nodes) > 0 {
+		smallestKey = nodes[0].Key
+		largestKey = nodes[len(nodes)-1].Key
+	}
+	version := 1
+	if s.compression {
+		version = 2
+	}
+	var content bytes.Buffer
+	//write the magic number
+	content.Write(encodeInt(1234))
+	//write the entry count
+	content.Write(encodeInt(len(nodes)))
+	//write the smallest key
+	content.Write(encodeInt(len(smallestKey)))
+	content.Write(smallestKey)
+	//write the largest key
+	content.Write(encodeInt(len(largestKey)))
+	content.Write(largestKey)
+	//write the version
+	content.Write(encodeNum(version))
+	var w io.Writer = &content
+	var zw *flate.Writer
+	if s.compression {
+		var err error
+		zw, err = flate.NewWriter(&content, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
 	}
+	for _, node := range nodes {
+		if _, err := w.Write(node.format()); err != nil {
+			return nil, err
+		}
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	//calculating the checksum
 	checksum := crc32.ChecksumIEEE(content.Bytes())
-	checksumBytes := encodeInt(int(checksum))
-	if _, err := file.Write(checksumBytes); err != nil {
-		return err
+	content.Write(encodeInt(int(checksum)))
+	// The file is written under a temporary name and synced before it is renamed, so that the name of an
+	// SSTable is never seen on a truncated file. The directory is synced to make the rename durable before
+	// the manifest records the file and the wal gets its watermark.
+	fs := s.filesystem()
+	tmp := path + tmpSuffix
+	file, err := fs.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(content.Bytes()); err != nil {
+		file.Close()
+		fs.Remove(tmp)
+		return nil, fmt.Errorf("failed to write to disk table %d: %w", s.numOfSStable, err)
+	}
+	if err := crashPoint("sstable written"); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		fs.Remove(tmp)
+		return nil, err
 	}
 	//close the file
 	if err := file.Close(); err != nil {
-		return err
+		fs.Remove(tmp)
+		return nil, err
 	}
-	s.numOfSStable++
-	//add the new sstable to the sstables
-	var magicNumber1 [4]byte
+	if err := fs.Rename(tmp, path); err != nil {
+		fs.Remove(tmp)
+		return nil, err
+	}
+	if err := crashPoint("sstable renamed"); err != nil {
+		return nil, err
+	}
+	if err := fs.Sync(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	var magicNumber [4]byte
 	copy(magicNumber[:], encodeInt(1234))
-
-	s.sstables = append(s.sstables, &SStable{
-		magicNumber: magicNumber1,
-		smallestKey: tree.Min(),
-		largestKey:  tree.Max(),
-		entryCount:  tree.Len(),
-		version:     1,
+	return &SStable{
+		magicNumber: magicNumber,
+		smallestKey: smallestKey,
+		largestKey:  largestKey,
+		entryCount:  len(nodes),
+		version:     version,
 		checksum:    int(checksum),
 		name:        path,
-	})
-	// If the count of sstfiles reaches the maximum allowable number of files (maxFiles)
-	// we initiate the  compaction process
-	if s.numOfSStable == maxFiles {
-		err = s.Compact()
-		if err != nil {
-			return err
-		}
+		fs:          fs,
+	}, nil
+}
+
+// filesystem returns the filesystem of the SSTables, the one of the operating system by default.
+func (s *SStables) filesystem() vfs.FS {
+	if s.fs == nil {
+		return vfs.Default
 	}
-	return nil
+	return s.fs
+}
+
+// filesystem returns the filesystem of the SSTable, the one of the operating system by default.
+func (s *SStable) filesystem() vfs.FS {
+	if s.fs == nil {
+		return vfs.Default
+	}
+	return s.fs
+}
+
+// entryReader returns a reader of the key-value pairs of the SSTable given its content without the checksum.
+func (s *SStable) entryReader(body []byte) (io.Reader, error) {
+	offset := 4 + 4 + 4 + 4 + 2 + len(s.largestKey) + len(s.smallestKey)
+	if offset > len(body) {
+		return nil, s.corrupt("the file is shorter than its header")
+	}
+	r := bytes.NewReader(body[offset:])
+	if s.version == 2 {
+		return flate.NewReader(r), nil
+	}
+	return r, nil
 }
 
 // this function generates a filename for an SSTable based on the current timestamp (UnixNano).
@@ -369,108 +749,107 @@ func (s *SStables) Name() string {
 // It checks if the key is present. If found, we check the marker if the marker is 0 
 // (indicating the key is deleted), an error is returned.
 // If the key is not found in the current file, the search continues in the next file.
+// A key holding merge operands cannot be resolved here, errMergePending is returned for it.
 func (s *SStables) Search(key []byte) ([]byte, error) {
+	var value []byte
+	err := ErrKeynotfound
+	findErr := s.find(key, func(n *Node) bool {
+		switch {
+		case n.operands != nil:
+			err = errMergePending
+		case !n.marker || n.expired(now().UnixNano()):
+			err = ErrDeleted
+		default:
+			value, err = n.Value, nil
+		}
+		return false
+	})
+	if findErr != nil {
+		return nil, findErr
+	}
+	return value, err
+}
+
+// find visits the entries of the key starting with the newest file, until visit returns false.
+func (s *SStables) find(key []byte, visit func(n *Node) bool) error {
 	// When searching for a key in the SSTables, we begin with the newest file and so on
 	for i := len(s.sstables) - 1; i >= 0; i-- {
 		// if the key is between the smallestkey and largestkey of the sstfile we search on this file if not we move to the next file
 		if bytes.Compare(key, s.sstables[i].smallestKey[:]) >= 0 && bytes.Compare(key, s.sstables[i].largestKey[:]) <= 0 {
-			value, err := s.sstables[i].search(key)
-			// If the key is marked as deleted, an error is returned.
-			if err == ErrDeleted {
-				return nil, err
-			}
+			node, err := s.sstables[i].find(key)
 			// search in the next SSTable
 			if err == ErrKeynotfound {
 				continue
 			}
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if !visit(node) {
+				return nil
 			}
-			return value, nil
 		}
 	}
-
-	return nil, ErrKeynotfound
+	return nil
 }
+
 // The search process in the SSTable begins by verifying that the file is not corrupt.
 // then it checks if the key is present in the file. If found, the corresponding value is returned.
 // If the key is not in the file, the function returns an ErrKeyNotFound.
 func (s *SStable) search(key []byte) ([]byte, error) {
-	f, err := os.OpenFile(s.name, os.O_RDONLY, 0644)
+	node, err := s.find(key)
+	if err != nil {
+		return nil, err
+	}
+	if node.operands != nil {
+		return nil, errMergePending
+	}
+	if !node.marker || node.expired(now().UnixNano()) {
+		return nil, ErrDeleted
+	}
+	return node.Value, nil
+}
+
+// find returns the entry of the key in the SSTable.
+func (s *SStable) find(key []byte) (*Node, error) {
+	f, err := s.filesystem().Open(s.name)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 	var content bytes.Buffer
 	fileInfo, err := f.Stat()
-	// We read the file up to its size minus four, as the checksum within the file
-	// was calculated only for the content that precedes its writing.
-	file := io.LimitReader(f, fileInfo.Size()-4)
 	if err != nil {
 		return nil, err
 	}
+	// We read the file up to its size minus four, as the checksum within the file
+	// was calculated only for the content that precedes its writing.
+	file := io.LimitReader(f, fileInfo.Size()-4)
 	_, err = io.Copy(&content, file)
 	if err != nil {
 		return nil, err
 	}
 	checksum := crc32.ChecksumIEEE(content.Bytes())
 	if checksum != uint32(s.checksum) {
-		return nil, ErrCorrupt
+		return nil, s.corrupt("checksum mismatch")
 	}
 	// go to the block where the keys and values are stored
-	offset := 4 + 4 + 4 + 4 + 2 + len(s.largestKey) + len(s.smallestKey)
-	_, err = f.Seek(int64(offset), io.SeekStart)
+	r, err := s.entryReader(content.Bytes())
 	if err != nil {
 		return nil, err
 	}
 	//check if the key is in the file
-	entryCount := s.entryCount
-	for i := 0; i < entryCount; i++ {
-		var marker [2]byte
-		_, err := f.Read(marker[:])
+	for i := 0; i < s.entryCount; i++ {
+		node, err := readNode(r)
 		if err != nil {
-			return nil, err
-		}
-		var keyLen [4]byte
-		if _, err := f.Read(keyLen[:]); err != nil {
-			return nil, err
-		}
-		keyLenInt := decodeInt(keyLen[:])
-		key1 := make([]byte, keyLenInt)
-		if _, err := f.Read(key1); err != nil {
-			return nil, err
+			return nil, s.corrupt("entry %d: %v", i, err)
 		}
 		//if the current key is bigger  than the key we are looking for then the key is not in this file
 		//as they are written in an ascending way
-		if bytes.Compare(key, key1) < 0 {
+		if bytes.Compare(key, node.Key) < 0 {
 			return nil, ErrKeynotfound
 		}
-		if bytes.Equal(key1, key) {
-			if decodeNum(marker[:]) == 1 {
-				var valueLen [4]byte
-				if _, err := f.Read(valueLen[:]); err != nil {
-					return nil, err
-				}
-				valueLenInt := decodeInt(valueLen[:])
-				value1 := make([]byte, valueLenInt)
-
-				if _, err := f.Read(value1); err != nil {
-					return nil, err
-				}
-				return value1, nil
-			} else {
-				return nil, ErrDeleted
-			}
-		}
-		var valueLen [4]byte
-		if _, err := f.Read(valueLen[:]); err != nil {
-			return nil, err
-		}
-		valueLenInt := decodeInt(valueLen[:])
-
-		value := make([]byte, valueLenInt)
-		if _, err := f.Read(value); err != nil {
-			return nil, err
+		if bytes.Equal(node.Key, key) {
+			return node, nil
 		}
 	}
 	return nil, ErrKeynotfound
@@ -484,330 +863,114 @@ func (s *SStables) Compact() error {
 	for i := 0; i <= s.numOfSStable-2; i += 2 {
 		// We ensure that the newest SST files are compacted with each other, 
 		// and the oldest with the oldest, following a level-based compaction strategy.
-		NewSst, err := s.merge(s.sstables[i], s.sstables[i+1])
+		// Only the oldest pair has nothing older below it.
+		NewSst, err := s.merge(s.sstables[i], s.sstables[i+1], i == 0)
 		if err != nil {
+			for _, sst := range newSSts {
+				s.filesystem().Remove(sst.name)
+			}
 			return err
 		}
 		newSSts = append(newSSts, NewSst)
 	}
-	s.numOfSStable = s.numOfSStable / 2
+	inputs := s.sstables[:len(newSSts)*2]
+	// with an odd number of files the newest one has no pair, it is kept as it is
+	newSSts = append(newSSts, s.sstables[len(newSSts)*2:]...)
+	// the outputs replace the inputs in a single edit of the manifest, the inputs can be deleted afterwards
+	if err := s.logEdit(newSSts[:len(inputs)/2], inputs, 0); err != nil {
+		for _, sst := range newSSts[:len(inputs)/2] {
+			s.filesystem().Remove(sst.name)
+		}
+		return err
+	}
+	// the edit is committed, the outputs are the live files whatever happens to the inputs
+	s.numOfSStable = len(newSSts)
 	s.sstables = newSSts
+	for _, sst := range inputs {
+		// an input that is left behind is not in the manifest, it is deleted as an orphan by the next Open
+		if err := s.filesystem().Remove(sst.name); err != nil {
+			fmt.Println("Fails to delete the compacted sstable: ", sst.name, err)
+		}
+	}
 
 	return nil
 }
 // merge merges two files by extracting the key-value pairs from each file,
-// placing them in a tree for sorting. The sorted pairs are then rewritten in an ordered manner,
+// placing them in a tree for sorting, s2 being newer than s1. The sorted pairs are then rewritten in an ordered manner,
 // along with additional information such as entry count and version...
-func (s *SStables) merge(s1 *SStable, s2 *SStable) (*SStable, error) {
-	//the new sstable will have the same magicnumber and version
-	//the smallest key will be the smallest key of the two sstables
-	//the largest key will be the largest key of the two sstables
-	//the entry count will be the sum of the entry count of the two sstables
-	path := fmt.Sprintf(s.path + "/" + s.Name())
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		return nil, err
-	}
-
-	f1, err := os.OpenFile(s1.name, os.O_RDONLY, 0644)
-	if err != nil {
-		return nil, err
-	}
-	defer f1.Close()
-	f2, err := os.OpenFile(s2.name, os.O_RDONLY, 0644)
-	if err != nil {
-		return nil, err
-	}
-	defer f2.Close()
-	//check if the file was not corrupted
-
-	var content1 bytes.Buffer
-	fileInfo1, err := f1.Stat()
-	//check if the files were not corrupted
-	file1 := io.LimitReader(f1, fileInfo1.Size()-4)
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(&content1, file1)
-	if err != nil {
-		return nil, err
-	}
-	checksum1 := crc32.ChecksumIEEE(content1.Bytes())
-	if checksum1 != uint32(s1.checksum) {
-		return nil, ErrCorrupt
-	}
-	_, err = f1.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, err
-	}
-	//checksum
-	var content2 bytes.Buffer
-	fileInfo2, err := f2.Stat()
-	file2 := io.LimitReader(f2, fileInfo2.Size()-4)
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(&content2, file2)
-	if err != nil {
-		return nil, err
-	}
-	checksum2 := crc32.ChecksumIEEE(content2.Bytes())
-	if checksum2 != uint32(s2.checksum) {
-		return nil, ErrCorrupt
-	}
-	_, err = f2.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, err
-	}
-	// read the magicnumber
-	var magicNumber [4]byte
-	if _, err := f1.Read(magicNumber[:]); err != nil {
-		return nil, err
-	}
-	//write it in the new file
-	if _, err := file.Write(magicNumber[:]); err != nil {
-		return nil, err
-	}
-	var magicNumber2 [4]byte
-
-	if _, err := f2.Read(magicNumber2[:]); err != nil {
-		return nil, err
-	}
-	//read the entry count
-	var entryCount1 [4]byte
-	if _, err := f1.Read(entryCount1[:]); err != nil {
-		return nil, err
-	}
-	//decode
-	entryCountInt1 := decodeInt(entryCount1[:])
-	var entryCount2 [4]byte
-	if _, err := f2.Read(entryCount2[:]); err != nil {
-		return nil, err
-	}
-	//decode
-	entryCountInt2 := decodeInt(entryCount2[:])
-
-	entryCount := 0
-	//the smallest key
-	var smallestKey1 [4]byte
-	if _, err := f1.Read(smallestKey1[:]); err != nil {
-		return nil, err
-	}
-	smallestKeyLen1 := decodeInt(smallestKey1[:])
-	smallestKey1Bytes := make([]byte, smallestKeyLen1)
-	if _, err := f1.Read(smallestKey1Bytes); err != nil {
-		return nil, err
-	}
-	var smallestKey2 [4]byte
-	if _, err := f2.Read(smallestKey2[:]); err != nil {
-		return nil, err
-	}
-
-	smallestKeyLen2 := decodeInt(smallestKey2[:])
-	smallestKey2Bytes := make([]byte, smallestKeyLen2)
-	if _, err := f2.Read(smallestKey2Bytes); err != nil {
-		return nil, err
-	}
-	var smallestKey []byte
-	if bytes.Compare(smallestKey1Bytes, smallestKey2Bytes) < 0 {
-		smallestKey = smallestKey1Bytes
-	} else {
-		smallestKey = smallestKey2Bytes
-	}
-
-	//the largest key
-	var largestKey1 [4]byte
-	if _, err := f1.Read(largestKey1[:]); err != nil {
-		return nil, err
-	}
-	largestKeyLen1 := decodeInt(largestKey1[:])
-	largestKey1Bytes := make([]byte, largestKeyLen1)
-	if _, err := f1.Read(largestKey1Bytes); err != nil {
-		return nil, err
-	}
-	var largestKey2 [4]byte
-	if _, err := f2.Read(largestKey2[:]); err != nil {
-		return nil, err
-	}
-	largestKeyLen2 := decodeInt(largestKey2[:])
-	largestKey2Bytes := make([]byte, largestKeyLen2)
-	if _, err := f2.Read(largestKey2Bytes); err != nil {
-		return nil, err
-	}
-	var largestKey []byte
-	if bytes.Compare(largestKey1Bytes, largestKey2Bytes) > 0 {
-		largestKey = largestKey1Bytes
-	} else {
-		largestKey = largestKey2Bytes
-	}
-
-	//the version
-	var version [2]byte
-	if _, err := f1.Read(version[:]); err != nil {
-		return nil, err
-	}
-
-	_, err = f2.Seek(2, io.SeekCurrent)
-	if err != nil {
-		return nil, err
-	}
+// Merge operands are resolved when the value they apply to is found. Expired values are turned into
+// deleted keys, and deleted keys are kept unless bottom is set, in which case no older file can hold
+// a value that the deletion has to hide.
+func (s *SStables) merge(s1 *SStable, s2 *SStable, bottom bool) (*SStable, error) {
 	tree := Tree{}
-	//write the keyvalues in an ordred way as it already is in f1 and f2
-	for i := 0; i < entryCountInt1; i++ {
-		var marker [2]byte
-		if _, err := f1.Read(marker[:]); err != nil {
-			return nil, err
-		}
-		//decode marker
-		markerInt := decodeNum(marker[:])
-		//read the key length
-		var keyLen [4]byte
-		if _, err := f1.Read(keyLen[:]); err != nil {
-			return nil, err
-		}
-		//decode key length
-		keyLenInt := decodeInt(keyLen[:])
-		//read the key
-		key := make([]byte, keyLenInt)
-		if _, err := f1.Read(key); err != nil {
-			return nil, err
-		}
-		//read the value length
-		var valueLen [4]byte
-		if _, err := f1.Read(valueLen[:]); err != nil {
-			return nil, err
-		}
-		//decode value length
-		valueLenInt := decodeInt(valueLen[:])
-		//read the value
-		value := make([]byte, valueLenInt)
-		if _, err := f1.Read(value); err != nil {
-			return nil, err
-		}
-
-		if markerInt == 1 {
-			tree.Set(key, value)
-
-		}
-	}
-
-	for i := 0; i < entryCountInt2; i++ {
-		var marker [2]byte
-		if _, err := f2.Read(marker[:]); err != nil {
-			return nil, err
-		}
-		//decode marker
-		markerInt := decodeNum(marker[:])
-		//read the key length
-		var keyLen [4]byte
-		if _, err := f2.Read(keyLen[:]); err != nil {
-			return nil, err
-		}
-		//decode key length
-		keyLenInt := decodeInt(keyLen[:])
-		//read the key
-		key := make([]byte, keyLenInt)
-		if _, err := f2.Read(key); err != nil {
-			return nil, err
-		}
-
-		//read the value length
-		var valueLen [4]byte
-		if _, err := f2.Read(valueLen[:]); err != nil {
-			return nil, err
-		}
-		//decode value length
-		valueLenInt := decodeInt(valueLen[:])
-		//read the value
-		value := make([]byte, valueLenInt)
-		if _, err := f2.Read(value); err != nil {
+	//the entries of s2 are put after the ones of s1 so that they replace them
+	for _, sst := range []*SStable{s1, s2} {
+		nodes, err := sst.entries()
+		if err != nil {
 			return nil, err
 		}
-
-		if markerInt == 1 {
-			tree.Set(key, value)
+		for _, node := range nodes {
+			if err := tree.put(node); err != nil {
+				return nil, err
+			}
 		}
 	}
-	entryCount = tree.Len()
-	//write the entry count
-	if _, err := file.Write(encodeInt(entryCount)); err != nil {
-		return nil, err
-	}
-	//smallest key
-	smallestKeyLen := encodeInt(len(smallestKey))
-	if _, err := file.Write(smallestKeyLen); err != nil {
-		return nil, err
-	}
-	if _, err := file.Write(smallestKey); err != nil {
-		return nil, err
-	}
-	//largest key
-	largestKeyLen := encodeInt(len(largestKey))
-	if _, err := file.Write(largestKeyLen); err != nil {
-		return nil, err
-	}
-	if _, err := file.Write(largestKey); err != nil {
-		return nil, err
-	}
-	if _, err := file.Write(version[:]); err != nil {
-		return nil, err
-	}
-	//write the keyvalues in an ordred way as it already is in f1 and f2
+	var nodes []*Node
 	for it := tree.Iterator(); it.HasNext(); {
 		currNode, err := it.Next()
 		if err != nil {
 			return nil, err
 		}
-		nodeFormat := currNode.format()
-		if _, err := file.Write(nodeFormat); err != nil {
-			return nil, fmt.Errorf("failed to write to disk table %d: %w", s.numOfSStable, err)
+		resolveNode(s.operators, currNode, bottom)
+		if currNode.operands == nil && currNode.expired(now().UnixNano()) {
+			currNode.marker = false
+			currNode.Value = nil
+			currNode.expiresAt = 0
+		}
+		if bottom && !currNode.marker && currNode.operands == nil {
+			continue
 		}
+		nodes = append(nodes, currNode)
 	}
-	_, err = file.Seek(0, io.SeekStart)
+	//the smallest key and the largest key of the new sstable are the ones of the entries that were kept
+	newSSt, err := s.write(nodes)
 	if err != nil {
 		return nil, err
 	}
-	var content bytes.Buffer
-
-	_, err = io.Copy(&content, file)
+	// the inputs are deleted by Compact once the manifest no longer holds them
+	newSSt.level = s1.level + 1
+	if s2.level >= s1.level {
+		newSSt.level = s2.level + 1
+	}
+	newSSt.smallestSeq = s1.smallestSeq
+	newSSt.largestSeq = s2.largestSeq
+	return newSSt, nil
+}
 
+// entries reads all the entries of the SSTable after checking that the file was not corrupted.
+func (s *SStable) entries() ([]*Node, error) {
+	content, err := vfs.ReadFile(s.filesystem(), s.name)
 	if err != nil {
 		return nil, err
 	}
-	checksum := crc32.ChecksumIEEE(content.Bytes())
-	checksumBytes := encodeInt(int(checksum))
-	if _, err := file.Write(checksumBytes); err != nil {
-		return nil, err
+	if len(content) < 4 {
+		return nil, s.corrupt("the file is truncated")
 	}
-	//close the file
-	if err := file.Close(); err != nil {
-		return nil, err
+	body := content[:len(content)-4]
+	if crc32.ChecksumIEEE(body) != uint32(s.checksum) {
+		return nil, s.corrupt("checksum mismatch")
 	}
-	newSSt := SStable{
-		magicNumber: magicNumber,
-		smallestKey: smallestKey,
-		largestKey:  largestKey,
-		entryCount:  entryCountInt1 + entryCountInt2,
-		version:     s1.version,
-		checksum:    int(checksum),
-		name:        path,
-	}
-	//close f1 and f2
-	err = f1.Close()
+	r, err := s.entryReader(body)
 	if err != nil {
 		return nil, err
 	}
-	err = f2.Close()
-	if err != nil {
-		return nil, err
-	}
-	err = os.Remove(s1.name)
-	if err != nil {
-		return nil, err
-	}
-	err = os.Remove(s2.name)
-	if err != nil {
-		return nil, err
+	nodes := make([]*Node, 0, s.entryCount)
+	for i := 0; i < s.entryCount; i++ {
+		node, err := readNode(r)
+		if err != nil {
+			return nil, s.corrupt("entry %d: %v", i, err)
+		}
+		nodes = append(nodes, node)
 	}
-	return &newSSt, nil
+	return nodes, nil
 }
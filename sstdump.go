@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// The sstdump command prints what an SSTable file holds, without opening the database:
+//
+//	kvstore sstdump [-entries] [-values] FILE...
+//
+// It prints the header (magic number, entry count, smallest and largest key, version, checksum),
+// verifies the checksum and reports statistics on the entries. With -entries every entry is printed
+// with its marker, and -values adds the values. A file that is corrupt or of a version it does not know
+// is still described as far as it can be read, which is what loadSStable cannot do.
+
+// errDumpFailed is returned by sstdump when one of the files is corrupt.
+var errDumpFailed = errors.New("sstdump: corrupt sstable")
+
+func sstdump(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("sstdump", flag.ContinueOnError)
+	entries := fs.Bool("entries", false, "print every entry")
+	values := fs.Bool("values", false, "print the values of the entries, implies -entries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: kvstore sstdump [-entries] [-values] FILE...")
+	}
+	failed := false
+	for i, name := range fs.Args() {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if !dumpSStable(name, content, *entries || *values, *values, out) {
+			failed = true
+		}
+	}
+	if failed {
+		return errDumpFailed
+	}
+	return nil
+}
+
+// sstHeader is the header of an SSTable file as it is written by SStables.write.
+type sstHeader struct {
+	magic       int
+	entryCount  int
+	smallestKey []byte
+	largestKey  []byte
+	version     int
+	// size is the length of the header in bytes, the entries follow it
+	size int
+}
+
+// readSSTHeader reads the header of an SSTable file from its content, without checking it.
+func readSSTHeader(content []byte) (*sstHeader, error) {
+	r := bytes.NewReader(content)
+	var buf [4]byte
+	readInt := func() (int, error) {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return decodeInt(buf[:]), nil
+	}
+	readKey := func() ([]byte, error) {
+		n, err := readInt()
+		if err != nil {
+			return nil, err
+		}
+		if n > r.Len() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		key := make([]byte, n)
+		io.ReadFull(r, key)
+		return key, nil
+	}
+	h := &sstHeader{}
+	var err error
+	if h.magic, err = readInt(); err != nil {
+		return nil, err
+	}
+	if h.entryCount, err = readInt(); err != nil {
+		return nil, err
+	}
+	if h.smallestKey, err = readKey(); err != nil {
+		return nil, err
+	}
+	if h.largestKey, err = readKey(); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	h.version = decodeNum(buf[:2])
+	h.size = len(content) - r.Len()
+	return h, nil
+}
+
+// dumpSStable describes the SSTable file and reports whether it is sound.
+func dumpSStable(name string, content []byte, entries, values bool, out io.Writer) bool {
+	fmt.Fprintf(out, "file: %s\n", name)
+	fmt.Fprintf(out, "size: %d bytes\n", len(content))
+	h, err := readSSTHeader(content)
+	if err != nil || len(content) < h.size+4 {
+		fmt.Fprintf(out, "error: the header is truncated\n")
+		return false
+	}
+	ok := true
+	magic := "ok"
+	if h.magic != 1234 {
+		magic = "bad, expected 1234"
+		ok = false
+	}
+	fmt.Fprintf(out, "magic: %d (%s)\n", h.magic, magic)
+	fmt.Fprintf(out, "entry count: %d\n", h.entryCount)
+	fmt.Fprintf(out, "smallest key: %q\n", h.smallestKey)
+	fmt.Fprintf(out, "largest key: %q\n", h.largestKey)
+	body := content[:len(content)-4]
+	stored := uint32(decodeInt(content[len(content)-4:]))
+	computed := crc32.ChecksumIEEE(body)
+	if stored == computed {
+		fmt.Fprintf(out, "checksum: %08x (ok)\n", stored)
+	} else {
+		fmt.Fprintf(out, "checksum: %08x (mismatch, computed %08x)\n", stored, computed)
+		ok = false
+	}
+	var r io.Reader = bytes.NewReader(body[h.size:])
+	switch h.version {
+	case 1:
+		fmt.Fprintf(out, "version: 1 (uncompressed)\n")
+	case 2:
+		fmt.Fprintf(out, "version: 2 (DEFLATE compressed entries)\n")
+		r = flate.NewReader(r)
+	default:
+		// the entries of a version this build does not know cannot be decoded
+		fmt.Fprintf(out, "version: %d (unknown, the entries are not decoded)\n", h.version)
+		return false
+	}
+
+	var count, keyBytes, valueBytes, expired int
+	markers := map[string]int{}
+	var first, prev []byte
+	nowNano := now().UnixNano()
+	for {
+		node, marker, err := readRawNode(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(out, "error: entry %d cannot be read: %v\n", count, err)
+			ok = false
+			break
+		}
+		if count > 0 && bytes.Compare(prev, node.Key) >= 0 {
+			fmt.Fprintf(out, "error: entry %d: key %q is not after %q\n", count, node.Key, prev)
+			ok = false
+		}
+		if count == 0 {
+			first = node.Key
+		}
+		prev = node.Key
+		count++
+		keyBytes += len(node.Key)
+		valueBytes += len(node.Value)
+		markers[marker]++
+		if node.marker && node.expired(nowNano) {
+			expired++
+		}
+		if entries {
+			fmt.Fprintf(out, "  %-7s %q value %d bytes", marker, node.Key, len(node.Value))
+			if node.expiresAt != 0 {
+				fmt.Fprintf(out, " expires %s", time.Unix(0, node.expiresAt).UTC().Format(time.RFC3339))
+			}
+			if node.operands != nil {
+				fmt.Fprintf(out, " %d operands", len(node.operands))
+			}
+			if values {
+				fmt.Fprintf(out, " %q", node.Value)
+				for _, op := range node.operands {
+					fmt.Fprintf(out, " %s(%q)", op.name, op.value)
+				}
+			}
+			fmt.Fprintln(out)
+		}
+	}
+	if count != h.entryCount {
+		fmt.Fprintf(out, "error: the header counts %d entries but %d were read\n", h.entryCount, count)
+		ok = false
+	}
+	if count > 0 && (!bytes.Equal(first, h.smallestKey) || !bytes.Equal(prev, h.largestKey)) {
+		fmt.Fprintf(out, "error: the keys go from %q to %q, not as in the header\n", first, prev)
+		ok = false
+	}
+	fmt.Fprintf(out, "entries: %d (set %d, ttl %d, merge %d, deleted %d), %d expired\n",
+		count, markers["set"], markers["ttl"], markers["merge"], markers["deleted"], expired)
+	fmt.Fprintf(out, "key bytes: %d, value bytes: %d, header bytes: %d, entries block: %d bytes\n",
+		keyBytes, valueBytes, h.size, len(body)-h.size)
+	return ok
+}
+
+// readRawNode reads an entry like readNode and also returns the name of its marker.
+func readRawNode(r io.Reader) (*Node, string, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return nil, "", err
+	}
+	node, err := readNode(io.MultiReader(bytes.NewReader(marker[:]), r))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	names := map[int]string{0: "deleted", 1: "set", 2: "merge", 3: "ttl"}
+	return node, names[decodeNum(marker[:])], nil
+}
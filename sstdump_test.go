@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSSTDump(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		sst, err := NewSST(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sst.compression = compression
+		tree := &Tree{}
+		tree.Set([]byte("a"), []byte("1"))
+		tree.SetExpiring([]byte("b"), []byte("2"), now().Add(-1).UnixNano())
+		tree.SetDeletedKey([]byte("c"), nil)
+		tree.Merge([]byte("d"), operand{name: "add", value: []byte("5")})
+		if err := sst.Flush(tree); err != nil {
+			t.Fatal(err)
+		}
+		name := sst.sstables[0].name
+
+		var out bytes.Buffer
+		if err := sstdump([]string{"-values", name}, &out); err != nil {
+			t.Fatalf("Expected a sound sstable, but got %v\n%s", err, out.String())
+		}
+		for _, want := range []string{
+			"magic: 1234 (ok)", "entry count: 4", `smallest key: "a"`, `largest key: "d"`, "(ok)",
+			"entries: 4 (set 1, ttl 1, merge 1, deleted 1), 1 expired", `add("5")`,
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Fatalf("Expected %q in the output:\n%s", want, out.String())
+			}
+		}
+
+		// a flipped byte in the entries is a checksum mismatch
+		content, _ := os.ReadFile(name)
+		content[len(content)-6] ^= 0xff
+		os.WriteFile(name, content, 0644)
+		out.Reset()
+		if err := sstdump([]string{name}, &out); err != errDumpFailed || !strings.Contains(out.String(), "mismatch") {
+			t.Fatalf("Expected a checksum mismatch, but got %v\n%s", err, out.String())
+		}
+	}
+
+	// the header of a version that does not exist yet is still printed
+	sst, err := NewSST(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := &Tree{}
+	tree.Set([]byte("k"), []byte("v"))
+	if err := sst.Flush(tree); err != nil {
+		t.Fatal(err)
+	}
+	name := sst.sstables[0].name
+	content, _ := os.ReadFile(name)
+	copy(content[4+4+4+1+4+1:], encodeNum(9))
+	os.WriteFile(name, content, 0644)
+	var out bytes.Buffer
+	if err := sstdump([]string{name}, &out); err != errDumpFailed || !strings.Contains(out.String(), "version: 9 (unknown") ||
+		!strings.Contains(out.String(), `largest key: "k"`) {
+		t.Fatalf("Expected the header of an unknown version, but got %v\n%s", err, out.String())
+	}
+}
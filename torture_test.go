@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+// The torture test runs random workloads against a database on a FaultFS, crashes the filesystem at a random
+// operation and checks that the database recovers every acknowledged write. Before a crash the workload may
+// also fill the disk or cut a write short; the database must then go on with the operations that follow.
+// A run syncs the wal after every write or not, chosen by its seed: without SyncWAL the database may come
+// back in the state of any write since the wal was last synced. The workload merges counters with "add" and
+// writes values with a TTL; the clock of the database moves a second with every operation, so that some of
+// these values expire during the run. A failing run prints its seed, it is replayed with
+// go test -run TestTorture -torture.seed=<seed>.
+
+var (
+	tortureSeed    = flag.Int64("torture.seed", 0, "seed of the single torture run to replay, 0 runs -torture.runs seeds")
+	tortureRuns    = flag.Int("torture.runs", 20, "number of seeds of the torture test")
+	tortureCrashes = flag.Int("torture.crashes", 4, "number of crashes of each torture run")
+)
+
+const tortureKeys = 40
+
+// tortureModel is the expected content of the database: the value of every key of the families, missing if the
+// key does not exist. pending holds the writes of the operation that failed, which may or may not have reached
+// the wal, a nil value deletes the key; they are applied all together or not at all. history holds the contents
+// since the wal was last synced, from the oldest to the newest.
+type tortureModel struct {
+	values  map[string]tortureValue
+	pending map[string]tortureValue
+	history []map[string]tortureValue
+}
+
+// tortureValue is a value of the model and the time in unix nanoseconds when it expires, 0 if it does not.
+type tortureValue struct {
+	value     []byte
+	expiresAt int64
+}
+
+// live reports whether the value has not expired.
+func (v tortureValue) live() bool {
+	return v.expiresAt == 0 || now().UnixNano() < v.expiresAt
+}
+
+func (v tortureValue) equal(o tortureValue) bool {
+	return string(v.value) == string(o.value) && v.expiresAt == o.expiresAt
+}
+
+func (v tortureValue) String() string {
+	if v.expiresAt != 0 {
+		return fmt.Sprintf("%q (expires at %d)", v.value, v.expiresAt)
+	}
+	return strconv.Quote(string(v.value))
+}
+
+func tortureKey(family string, i int) string {
+	return fmt.Sprintf("%s/k%02d", family, i)
+}
+
+func TestTorture(t *testing.T) {
+	oldMax := max
+	max = 25
+	defer func() { max = oldMax }()
+	defer func() { now = time.Now }()
+	seeds := []int64{*tortureSeed}
+	if *tortureSeed == 0 {
+		seeds = nil
+		for i := 1; i <= *tortureRuns; i++ {
+			seeds = append(seeds, int64(i))
+		}
+	}
+	for _, seed := range seeds {
+		if err := tortureRun(seed, *tortureCrashes); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func tortureRun(seed int64, crashes int) error {
+	rng := rand.New(rand.NewSource(seed))
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := Options{FS: fs, SyncWAL: rng.Intn(2) == 0}
+	db, err := OpenWithOptions("db", opts)
+	if err != nil {
+		return err
+	}
+	if _, err := db.CreateColumnFamily("users", FamilyOptions{FlushSize: 10, Compression: true}); err != nil {
+		return err
+	}
+	families := []string{defaultFamily, "users"}
+	model := &tortureModel{values: map[string]tortureValue{}}
+	model.synced()
+	op := 0
+	for crash := 0; crash < crashes; crash++ {
+		// every operation on the filesystem can be the one of the crash
+		crashed := false
+		crashAfter := 1 + rng.Intn(400)
+		fs.SetFault(func(string, string) error {
+			if crashed {
+				return vfs.ErrInjected
+			}
+			crashAfter--
+			if crashAfter == 0 {
+				crashed = true
+				return vfs.ErrInjected
+			}
+			return nil
+		})
+		// or the disk fills up, or a write is cut short, and the crash comes later
+		switch rng.Intn(3) {
+		case 1:
+			fs.SetFault(nil)
+			fs.SetSpace(rng.Int63n(4 << 10))
+		case 2:
+			shortAfter := 1 + rng.Intn(200)
+			fs.SetFault(func(op, name string) error {
+				if op != "shortwrite" {
+					return nil
+				}
+				shortAfter--
+				if shortAfter == 0 {
+					return vfs.ErrInjected
+				}
+				return nil
+			})
+		}
+		end := (crash + 1) * 300
+		for !crashed && op < end {
+			op++
+			clock = clock.Add(time.Second)
+			err := tortureStep(rng, db, families, model, op)
+			if err != nil && !crashed && (errors.Is(err, syscall.ENOSPC) || errors.Is(err, vfs.ErrInjected)) {
+				// the failed operation happened whole or not at all, and the database goes on
+				fs.SetSpace(-1)
+				fs.SetFault(nil)
+				if checkErr := model.check(db, families, false); checkErr != nil {
+					return fmt.Errorf("after the failure of operation %d (%v): %v", op, err, checkErr)
+				}
+				model.history = append(model.history, model.snapshot())
+				// the crash comes before a flush moves the wal past what the failure left in it
+				if soon := op + 1 + rng.Intn(5); soon < end {
+					end = soon
+				}
+				continue
+			}
+			if err != nil {
+				if !crashed {
+					return fmt.Errorf("operation %d: %v", op, err)
+				}
+				break
+			}
+			model.pending = nil
+			model.history = append(model.history, model.snapshot())
+		}
+		fs.SetSpace(-1)
+		fs.SetFault(nil)
+		if err := fs.Crash(); err != nil {
+			return err
+		}
+		db.Close()
+		if db, err = OpenWithOptions("db", opts); err != nil {
+			return fmt.Errorf("reopening after the crash at operation %d: %v", op, err)
+		}
+		if err := model.check(db, families, !opts.SyncWAL); err != nil {
+			return fmt.Errorf("after the crash at operation %d: %v", op, err)
+		}
+		model.synced()
+	}
+	return db.Close()
+}
+
+// tortureStep runs a random operation and records it in the model once it is acknowledged.
+func tortureStep(rng *rand.Rand, db *DB, families []string, model *tortureModel, op int) error {
+	family := families[rng.Intn(len(families))]
+	cf, err := db.ColumnFamily(family)
+	if err != nil {
+		return err
+	}
+	i := rng.Intn(tortureKeys)
+	key := tortureKey(family, i)
+	value := []byte(fmt.Sprintf("v%d", op))
+	switch r := rng.Intn(100); {
+	case r < 30:
+		model.pending = map[string]tortureValue{key: {value: value}}
+		if err := cf.Put([]byte(fmt.Sprintf("k%02d", i)), value); err != nil {
+			return err
+		}
+		model.apply(model.pending)
+	case r < 36:
+		ttl := time.Duration(5+rng.Intn(120)) * time.Second
+		model.pending = map[string]tortureValue{key: {value: value, expiresAt: now().Add(ttl).UnixNano()}}
+		if err := cf.PutWithTTL([]byte(fmt.Sprintf("k%02d", i)), value, ttl); err != nil {
+			return err
+		}
+		model.apply(model.pending)
+	case r < 44:
+		operand := int64(1 + rng.Intn(9))
+		merged, ok := model.merged(key, operand)
+		if !ok {
+			return nil
+		}
+		model.pending = map[string]tortureValue{key: {value: merged}}
+		if err := cf.Merge([]byte(fmt.Sprintf("k%02d", i)), "add", []byte(strconv.FormatInt(operand, 10))); err != nil {
+			return err
+		}
+		model.apply(model.pending)
+	case r < 55:
+		if !model.visible(key) {
+			return nil
+		}
+		model.pending = map[string]tortureValue{key: {}}
+		if err := cf.Delete([]byte(fmt.Sprintf("k%02d", i))); err != nil {
+			return err
+		}
+		model.apply(model.pending)
+	case r < 75:
+		b := &WriteBatch{}
+		model.pending = map[string]tortureValue{}
+		for n := 2 + rng.Intn(4); n > 0; n-- {
+			family := families[rng.Intn(len(families))]
+			i := rng.Intn(tortureKeys)
+			key := []byte(fmt.Sprintf("k%02d", i))
+			switch rng.Intn(4) {
+			case 0:
+				b.Delete(family, key)
+				model.pending[tortureKey(family, i)] = tortureValue{}
+			case 1:
+				operand := int64(1 + rng.Intn(9))
+				if merged, ok := model.merged(tortureKey(family, i), operand); ok {
+					b.Merge(family, key, "add", []byte(strconv.FormatInt(operand, 10)))
+					model.pending[tortureKey(family, i)] = tortureValue{value: merged}
+					break
+				}
+				fallthrough
+			default:
+				b.Put(family, key, value)
+				model.pending[tortureKey(family, i)] = tortureValue{value: value}
+			}
+		}
+		if err := db.Write(b); err != nil {
+			return err
+		}
+		model.apply(model.pending)
+	case r < 85:
+		db.mu.Lock()
+		err := FlushToDisk(db)
+		db.mu.Unlock()
+		return err
+	case r < 90:
+		db.mu.Lock()
+		err := cf.sst.Compact()
+		db.mu.Unlock()
+		return err
+	case r < 93:
+		if err := db.Sync(); err != nil {
+			return err
+		}
+		model.synced()
+	default:
+		got, err := cf.Get([]byte(fmt.Sprintf("k%02d", i)))
+		if err == ErrKeynotfound {
+			got, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		var want []byte
+		if model.visible(key) {
+			want = model.values[key].value
+		}
+		if string(got) != string(want) {
+			return fmt.Errorf("%s is %q instead of %q", key, got, want)
+		}
+	}
+	return nil
+}
+
+// visible reports whether the key of the model exists and has not expired.
+func (m *tortureModel) visible(key string) bool {
+	v, ok := m.values[key]
+	return ok && v.live()
+}
+
+// merged returns the value of the key once the operand is added to it, taking the pending writes of the
+// operation into account. Only a missing key or a counter without a TTL is merged, ok is false for the others.
+func (m *tortureModel) merged(key string, operand int64) (value []byte, ok bool) {
+	v, found := m.pending[key]
+	if !found {
+		v, found = m.values[key]
+	}
+	if !found || v.value == nil {
+		return []byte(strconv.FormatInt(operand, 10)), true
+	}
+	if v.expiresAt != 0 {
+		return nil, false
+	}
+	n, err := strconv.ParseInt(string(v.value), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return []byte(strconv.FormatInt(n+operand, 10)), true
+}
+
+func (m *tortureModel) apply(writes map[string]tortureValue) {
+	for key, v := range writes {
+		if v.value == nil {
+			delete(m.values, key)
+		} else {
+			m.values[key] = v
+		}
+	}
+}
+
+// snapshot returns a copy of the values of the model.
+func (m *tortureModel) snapshot() map[string]tortureValue {
+	values := make(map[string]tortureValue, len(m.values))
+	for key, v := range m.values {
+		values[key] = v
+	}
+	return values
+}
+
+// synced records that the current values are durable, the database cannot come back in an older state.
+func (m *tortureModel) synced() {
+	m.history = []map[string]tortureValue{m.snapshot()}
+}
+
+// check compares the database with the model, the values and their expiry. The pending writes must have been
+// applied all together or not at all. After a crash without SyncWAL, the database may be in any state of the
+// history instead. The values of the model become the state that the database is in.
+func (m *tortureModel) check(db *DB, families []string, unsynced bool) error {
+	got := map[string]tortureValue{}
+	for _, family := range families {
+		cf, err := db.ColumnFamily(family)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < tortureKeys; i++ {
+			key := tortureKey(family, i)
+			db.mu.RLock()
+			value, expiresAt, err := cf.lookup([]byte(fmt.Sprintf("k%02d", i)))
+			db.mu.RUnlock()
+			if errors.Is(err, ErrKeynotfound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			got[key] = tortureValue{value: value, expiresAt: expiresAt}
+		}
+	}
+	states := []map[string]tortureValue{m.values}
+	if unsynced {
+		states = m.history
+	}
+	if m.pending != nil {
+		applied := m.snapshot()
+		for key, v := range m.pending {
+			if v.value == nil {
+				delete(applied, key)
+			} else {
+				applied[key] = v
+			}
+		}
+		states = append(states, applied)
+	}
+	for i := len(states) - 1; i >= 0; i-- {
+		if tortureEqual(got, states[i]) {
+			m.values = states[i]
+			m.pending = nil
+			return nil
+		}
+	}
+	want := tortureLive(m.values)
+	for key, v := range want {
+		if g, ok := got[key]; !ok || !g.equal(v) {
+			return fmt.Errorf("%s is %v instead of %v, the pending writes were %v", key, got[key], v, m.pending)
+		}
+	}
+	for key, v := range got {
+		if _, ok := want[key]; !ok {
+			return fmt.Errorf("%s is %v instead of missing, the pending writes were %v", key, v, m.pending)
+		}
+	}
+	return fmt.Errorf("the database matches none of the %d states it may be in, the pending writes were %v", len(states), m.pending)
+}
+
+// tortureLive returns the values of the state that have not expired.
+func tortureLive(state map[string]tortureValue) map[string]tortureValue {
+	live := map[string]tortureValue{}
+	for key, v := range state {
+		if v.live() {
+			live[key] = v
+		}
+	}
+	return live
+}
+
+// tortureEqual reports whether the values read from the database are the live values of the state.
+func tortureEqual(got, state map[string]tortureValue) bool {
+	live := tortureLive(state)
+	if len(got) != len(live) {
+		return false
+	}
+	for key, v := range got {
+		if w, ok := live[key]; !ok || !w.equal(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	if err := db.PutWithTTL([]byte("session"), []byte("abc"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("user"), []byte("bob")); err != nil {
+		t.Fatal(err)
+	}
+	scan := func() []string {
+		t.Helper()
+		var keys []string
+		err := db.Scan(nil, nil, func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		return keys
+	}
+
+	value, err := db.Get([]byte("session"))
+	if err != nil || string(value) != "abc" {
+		t.Fatalf("Expected value abc, but got %s (%v)", value, err)
+	}
+	if keys := scan(); len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, but got %v", keys)
+	}
+
+	// the expiry time is replayed from the wal
+	db.Close()
+	db = openTestDB(t, dir)
+	clock = clock.Add(2 * time.Minute)
+	if _, err := db.Get([]byte("session")); err != ErrKeynotfound {
+		t.Fatalf("Expected ErrKeynotfound for an expired key, but got %v", err)
+	}
+	if keys := scan(); len(keys) != 1 || keys[0] != "user" {
+		t.Fatalf("Expected only the key user, but got %v", keys)
+	}
+	if err := db.Delete([]byte("session")); err != ErrKeynotfound {
+		t.Fatalf("Expected ErrKeynotfound when deleting an expired key, but got %v", err)
+	}
+
+	// once on disk the expired key is dropped by the compaction
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.def.sst.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := db.def.sst.sstables[0].entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if string(n.Key) == "session" {
+			t.Fatal("Expected the expired key to be dropped by the compaction")
+		}
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("Expected 2 entries after compaction, but found %d", len(nodes))
+	}
+}
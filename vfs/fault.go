@@ -0,0 +1,482 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrInjected is the error a fault function can return to fail an operation.
+	ErrInjected = errors.New("vfs: injected fault")
+	// ErrCrashed is returned by the files that were open when FaultFS.Crash was called.
+	ErrCrashed = errors.New("vfs: the filesystem crashed")
+)
+
+// FaultFS wraps a filesystem to inject faults. A fault function can fail any operation, the free space can
+// be limited so that the writes fail with ENOSPC, and Crash simulates a crash of the machine: the data that
+// was not synced is dropped.
+//
+// Only what goes through the FaultFS is tracked. The content of a file is durable up to its length at its
+// last Sync, and the creation, the renaming or the removal of a file is durable once its directory is synced.
+// A truncation and the creation of a directory are durable at once.
+type FaultFS struct {
+	fs FS
+	mu sync.Mutex
+	// gen is incremented by Crash, the files opened before fail with ErrCrashed
+	gen   int
+	files map[string]*faultState
+	// pending are the creations, renames and removals that were not made durable by the sync of their directory
+	pending []faultOp
+	fault   func(op, name string) error
+	// space is the number of bytes that can still be written, negative if there is no limit
+	space int64
+}
+
+// faultState is the durable length of a file written through the FaultFS.
+type faultState struct {
+	synced int64
+}
+
+type faultOp struct {
+	// rename and remove are false for a creation
+	rename   bool
+	remove   bool
+	old, new string
+	// replaced is the content of the file that the rename replaced, nil if there was none
+	replaced []byte
+	// removed is the durable content of the removed file new
+	removed []byte
+	// dir is the directory whose sync makes the removal durable, the one of the name given to RemoveAll
+	dir string
+}
+
+// durableIn returns the directory whose sync makes the operation durable.
+func (op faultOp) durableIn() string {
+	if op.remove {
+		return op.dir
+	}
+	return filepath.Dir(filepath.Clean(op.new))
+}
+
+// NewFaultFS wraps the filesystem, without any fault until SetFault or SetSpace is called.
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs, files: map[string]*faultState{}, space: -1}
+}
+
+// SetFault sets the function called before every operation with its name ("create", "open", "write",
+// "sync", "rename", "link", "remove", "syncdir", "truncate") and the path of the file. The operation fails with the
+// error the function returns. A write that passes is then checked as "shortwrite": an error makes it write half
+// of its bytes and fail with the error. A nil function removes the faults.
+func (fs *FaultFS) SetFault(fault func(op, name string) error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.fault = fault
+}
+
+// SetSpace limits the number of bytes that can still be written. A write that does not fit writes what fits
+// and fails with ENOSPC. A negative space removes the limit.
+func (fs *FaultFS) SetSpace(space int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.space = space
+}
+
+// inject calls the fault function, the lock must be held.
+func (fs *FaultFS) inject(op, name string) error {
+	if fs.fault == nil {
+		return nil
+	}
+	return fs.fault(op, name)
+}
+
+// Crash simulates a crash: the files that are open fail from then on, the files are cut to their length at
+// their last sync and the creations, renames and removals that were not synced are undone. The filesystem can be used
+// again afterwards, like after a reboot.
+func (fs *FaultFS) Crash() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gen++
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for name, state := range fs.files {
+		info, err := fs.fs.Stat(name)
+		if err != nil || info.Size() <= state.synced {
+			continue
+		}
+		f, err := fs.fs.OpenAppend(name)
+		if err != nil {
+			keep(err)
+			continue
+		}
+		keep(f.Truncate(state.synced))
+		keep(f.Close())
+	}
+	for i := len(fs.pending) - 1; i >= 0; i-- {
+		op := fs.pending[i]
+		if op.remove {
+			keep(fs.fs.MkdirAll(filepath.Dir(op.new), 0755))
+			keep(WriteFile(fs.fs, op.new, op.removed))
+			continue
+		}
+		if !op.rename {
+			keep(fs.fs.Remove(op.new))
+			continue
+		}
+		keep(fs.fs.Rename(op.new, op.old))
+		if op.replaced != nil {
+			keep(WriteFile(fs.fs, op.new, op.replaced))
+		}
+	}
+	fs.files = map[string]*faultState{}
+	fs.pending = nil
+	return firstErr
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("open", name); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, fs: fs, name: name, gen: fs.gen}, nil
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("create", name); err != nil {
+		return nil, err
+	}
+	_, statErr := fs.fs.Stat(name)
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if os.IsNotExist(statErr) {
+		fs.pending = append(fs.pending, faultOp{new: name})
+	}
+	state := &faultState{}
+	fs.files[name] = state
+	return &faultFile{File: f, fs: fs, name: name, gen: fs.gen, state: state}, nil
+}
+
+func (fs *FaultFS) OpenAppend(name string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("open", name); err != nil {
+		return nil, err
+	}
+	info, statErr := fs.fs.Stat(name)
+	f, err := fs.fs.OpenAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	state, ok := fs.files[name]
+	if !ok {
+		state = &faultState{}
+		if statErr == nil {
+			state.synced = info.Size()
+		} else {
+			fs.pending = append(fs.pending, faultOp{new: name})
+		}
+		fs.files[name] = state
+	}
+	return &faultFile{File: f, fs: fs, name: name, gen: fs.gen, state: state}, nil
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("rename", oldname); err != nil {
+		return err
+	}
+	op := faultOp{rename: true, old: oldname, new: newname}
+	if _, err := fs.fs.Stat(newname); err == nil {
+		replaced, err := ReadFile(fs.fs, newname)
+		if err != nil {
+			return err
+		}
+		op.replaced = replaced
+	}
+	if err := fs.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	fs.pending = append(fs.pending, op)
+	if state, ok := fs.files[oldname]; ok {
+		delete(fs.files, oldname)
+		fs.files[newname] = state
+	} else {
+		delete(fs.files, newname)
+	}
+	return nil
+}
+
+func (fs *FaultFS) Link(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("link", oldname); err != nil {
+		return err
+	}
+	if err := fs.fs.Link(oldname, newname); err != nil {
+		return err
+	}
+	// like a creation, the new name is durable once its directory is synced, the content is the one of oldname
+	fs.pending = append(fs.pending, faultOp{new: newname})
+	if state, ok := fs.files[oldname]; ok {
+		fs.files[newname] = state
+	}
+	return nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("remove", name); err != nil {
+		return err
+	}
+	removals, err := fs.removals(name, filepath.Dir(filepath.Clean(name)))
+	if err != nil {
+		return err
+	}
+	if err := fs.fs.Remove(name); err != nil {
+		return err
+	}
+	fs.forget(name)
+	fs.pending = append(fs.pending, removals...)
+	return nil
+}
+
+func (fs *FaultFS) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("remove", name); err != nil {
+		return err
+	}
+	removals, err := fs.removals(name, filepath.Dir(filepath.Clean(name)))
+	if err != nil {
+		return err
+	}
+	if err := fs.fs.RemoveAll(name); err != nil {
+		return err
+	}
+	prefix := name + string(filepath.Separator)
+	for other := range fs.files {
+		if len(other) > len(prefix) && other[:len(prefix)] == prefix {
+			fs.forget(other)
+		}
+	}
+	for _, op := range removals {
+		fs.forget(op.new)
+	}
+	fs.forget(name)
+	fs.pending = append(fs.pending, removals...)
+	return nil
+}
+
+// removals returns the removals of the files under name, name included, to undo at a crash until dir is
+// synced. A file whose creation is not durable yet has nothing to undo. The lock must be held.
+func (fs *FaultFS) removals(name, dir string) ([]faultOp, error) {
+	info, err := fs.fs.Stat(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		infos, err := fs.fs.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		var ops []faultOp
+		for _, info := range infos {
+			sub, err := fs.removals(filepath.Join(name, info.Name()), dir)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, sub...)
+		}
+		return ops, nil
+	}
+	for _, op := range fs.pending {
+		if !op.rename && !op.remove && op.new == name {
+			return nil, nil
+		}
+	}
+	content, err := ReadFile(fs.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	if state, ok := fs.files[name]; ok && int64(len(content)) > state.synced {
+		content = content[:state.synced]
+	}
+	return []faultOp{{remove: true, new: name, removed: content, dir: dir}}, nil
+}
+
+// forget stops tracking a file that was removed, the lock must be held.
+func (fs *FaultFS) forget(name string) {
+	delete(fs.files, name)
+	pending := fs.pending[:0]
+	for _, op := range fs.pending {
+		// a creation that is not durable has nothing to undo once the file is removed
+		if op.rename || op.remove || op.new != name {
+			pending = append(pending, op)
+		}
+	}
+	fs.pending = pending
+}
+
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	return fs.fs.MkdirAll(dir, perm)
+}
+
+func (fs *FaultFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return fs.fs.ReadDir(dir)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return fs.fs.Stat(name)
+}
+
+func (fs *FaultFS) Sync(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.inject("syncdir", dir); err != nil {
+		return err
+	}
+	if err := fs.fs.Sync(dir); err != nil {
+		return err
+	}
+	dir = filepath.Clean(dir)
+	pending := fs.pending[:0]
+	for _, op := range fs.pending {
+		if op.durableIn() != dir {
+			pending = append(pending, op)
+		}
+	}
+	fs.pending = pending
+	return nil
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	return fs.fs.Lock(name)
+}
+
+// faultFile is a file opened through a FaultFS.
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+	gen  int
+	// state is nil for a file opened for reading
+	state *faultState
+}
+
+// check fails once the filesystem crashed, the lock must be held.
+func (f *faultFile) check() error {
+	if f.gen != f.fs.gen {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if err := f.fs.inject("write", f.name); err != nil {
+		return 0, err
+	}
+	limit, fault := int64(len(p)), f.fs.inject("shortwrite", f.name)
+	if fault != nil {
+		limit /= 2
+	}
+	if f.fs.space >= 0 && limit > f.fs.space {
+		limit, fault = f.fs.space, &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+	}
+	n, err := f.File.Write(p[:limit])
+	if f.fs.space >= 0 {
+		f.fs.space -= int64(n)
+	}
+	if err == nil {
+		err = fault
+	}
+	return n, err
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	if err := f.fs.inject("sync", f.name); err != nil {
+		return err
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	if f.state != nil {
+		info, err := f.File.Stat()
+		if err != nil {
+			return err
+		}
+		f.state.synced = info.Size()
+	}
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	if err := f.fs.inject("truncate", f.name); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	if f.state != nil && size < f.state.synced {
+		f.state.synced = size
+	}
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	// a file that was open at the crash can still be closed
+	return f.File.Close()
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile takes an exclusive LockFileEx lock on the first byte of the file, it is released when the file is
+// closed.
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,376 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is a filesystem held in memory. Everything written to it is durable at once, FaultFS adds crashes
+// on top of it. The zero value is not usable, use NewMemFS.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+type memNode struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFS returns an empty in-memory filesystem.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: map[string]*memNode{},
+		dirs:  map[string]bool{".": true, "/": true},
+		locks: map[string]bool{},
+	}
+}
+
+func memErr(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// checkDir returns an error if the directory of the file does not exist, the lock must be held.
+func (fs *MemFS) checkDir(op, name string) error {
+	if !fs.dirs[filepath.Dir(name)] {
+		return memErr(op, name, os.ErrNotExist)
+	}
+	return nil
+}
+
+func (fs *MemFS) Open(name string) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.files[name]
+	if !ok {
+		return nil, memErr("open", name, os.ErrNotExist)
+	}
+	return &memFile{fs: fs, name: name, node: node, readOnly: true}, nil
+}
+
+func (fs *MemFS) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.checkDir("open", name); err != nil {
+		return nil, err
+	}
+	node := &memNode{modTime: time.Now()}
+	fs.files[name] = node
+	return &memFile{fs: fs, name: name, node: node}, nil
+}
+
+func (fs *MemFS) OpenAppend(name string) (File, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.files[name]
+	if !ok {
+		if err := fs.checkDir("open", name); err != nil {
+			return nil, err
+		}
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	}
+	return &memFile{fs: fs, name: name, node: node, append: true}, nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if err := fs.checkDir("rename", newname); err != nil {
+		return err
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+// Link gives the file a second name, the two names share the content of the file.
+func (fs *MemFS) Link(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.files[newname]; ok || fs.dirs[newname] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if err := fs.checkDir("link", newname); err != nil {
+		return err
+	}
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		prefix := name + string(filepath.Separator)
+		for other := range fs.files {
+			if strings.HasPrefix(other, prefix) {
+				return memErr("remove", name, os.ErrExist)
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return memErr("remove", name, os.ErrNotExist)
+}
+
+func (fs *MemFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	prefix := name + string(filepath.Separator)
+	for other := range fs.files {
+		if other == name || strings.HasPrefix(other, prefix) {
+			delete(fs.files, other)
+		}
+	}
+	for dir := range fs.dirs {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(fs.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for ; !fs.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return memErr("mkdir", dir, os.ErrExist)
+		}
+		fs.dirs[dir] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[dir] {
+		return nil, memErr("open", dir, os.ErrNotExist)
+	}
+	var infos []os.FileInfo
+	for name, node := range fs.files {
+		if filepath.Dir(name) == dir {
+			infos = append(infos, &memInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime})
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			infos = append(infos, &memInfo{name: filepath.Base(name), dir: true})
+		}
+	}
+	sortInfos(infos)
+	return infos, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if node, ok := fs.files[name]; ok {
+		return &memInfo{name: filepath.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if fs.dirs[name] {
+		return &memInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, memErr("stat", name, os.ErrNotExist)
+}
+
+func (fs *MemFS) Sync(dir string) error {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[dir] {
+		return memErr("sync", dir, os.ErrNotExist)
+	}
+	return nil
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.locks[name] {
+		return nil, ErrLocked
+	}
+	if _, ok := fs.files[name]; !ok {
+		if err := fs.checkDir("open", name); err != nil {
+			return nil, err
+		}
+		fs.files[name] = &memNode{modTime: time.Now()}
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+// memFile is an open file of a MemFS. The node stays readable after the file was removed or replaced,
+// like an open file of the operating system.
+type memFile struct {
+	fs       *MemFS
+	name     string
+	node     *memNode
+	pos      int64
+	readOnly bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, memErr("read", f.name, os.ErrClosed)
+	}
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, memErr("write", f.name, os.ErrClosed)
+	}
+	if f.readOnly {
+		return 0, memErr("write", f.name, os.ErrPermission)
+	}
+	if f.append {
+		f.pos = int64(len(f.node.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, memErr("seek", f.name, os.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, memErr("seek", f.name, os.ErrInvalid)
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return memErr("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return &memInfo{name: filepath.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return memErr("sync", f.name, os.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed || f.readOnly {
+		return memErr("truncate", f.name, os.ErrPermission)
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		data := make([]byte, size)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	return nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+func (i *memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
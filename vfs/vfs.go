@@ -0,0 +1,80 @@
+// Package vfs is the filesystem used by the database. Default is the filesystem of the operating system,
+// MemFS keeps the files in memory for fast tests and FaultFS wraps another filesystem to inject faults:
+// failed writes, a full disk and crashes that drop the data that was not synced.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// ErrLocked is returned by Lock when the file is already locked.
+var ErrLocked = errors.New("vfs: file is locked")
+
+// File is an open file of a FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	// Sync makes the content of the file durable.
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is a filesystem. The names are paths in the syntax of the operating system.
+type FS interface {
+	// Open opens the file for reading.
+	Open(name string) (File, error)
+	// Create creates the file, or truncates it if it exists, and opens it for reading and writing.
+	Create(name string) (File, error)
+	// OpenAppend opens the file for reading and appending, creating it if it does not exist.
+	// The writes go to the end of the file.
+	OpenAppend(name string) (File, error)
+	// Rename renames the file, replacing newname if it exists.
+	Rename(oldname, newname string) error
+	// Link creates newname as a hard link to the file oldname, it fails if newname exists.
+	Link(oldname, newname string) error
+	Remove(name string) error
+	// RemoveAll removes the path and what it holds, it does nothing if the path does not exist.
+	RemoveAll(name string) error
+	MkdirAll(dir string, perm os.FileMode) error
+	// ReadDir returns the entries of the directory sorted by name.
+	ReadDir(dir string) ([]os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error)
+	// Sync makes the creations, renames and removals of files in the directory durable.
+	Sync(dir string) error
+	// Lock takes an exclusive lock on the file, creating it if needed. It fails with ErrLocked when the lock
+	// is held, by another process for the filesystem of the operating system. Closing the result releases it.
+	Lock(name string) (io.Closer, error)
+}
+
+// ReadFile returns the content of the file.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile replaces the content of the file with data, without syncing it.
+func WriteFile(fs FS, name string, data []byte) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortInfos(infos []os.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+}
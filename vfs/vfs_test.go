@@ -0,0 +1,179 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	if _, err := fs.Create("db/a"); !os.IsNotExist(err) {
+		t.Fatalf("Expected a missing directory to be an error, but got %v", err)
+	}
+	if err := fs.MkdirAll("db/sst", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(fs, "db/a", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenAppend("db/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(0, 0)
+	f.Write([]byte(" world"))
+	f.Close()
+	if data, err := ReadFile(fs, "db/a"); err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected the write to be appended, but got %q (%v)", data, err)
+	}
+	if err := fs.Rename("db/a", "db/sst/b"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := fs.ReadDir("db")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "sst" || !infos[0].IsDir() {
+		t.Fatalf("Expected only the sst directory, but got %v (%v)", infos, err)
+	}
+	if info, err := fs.Stat("db/sst/b"); err != nil || info.Size() != 11 {
+		t.Fatalf("Expected the renamed file, but got %v (%v)", info, err)
+	}
+	if err := fs.Link("db/sst/b", "db/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("db/sst/b", "db/c"); !os.IsExist(err) {
+		t.Fatalf("Expected linking over a file to fail, but got %v", err)
+	}
+	if err := fs.RemoveAll("db/sst"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open("db/sst/b"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the file to be removed, but got %v", err)
+	}
+	if data, err := ReadFile(fs, "db/c"); err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected the link to keep the content, but got %q (%v)", data, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	for name, fs := range map[string]FS{"os": Default, "mem": NewMemFS()} {
+		dir := t.TempDir()
+		fs.MkdirAll(dir, 0755)
+		lock := filepath.Join(dir, "LOCK")
+		l, err := fs.Lock(lock)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := fs.Lock(lock); err != ErrLocked {
+			t.Fatalf("%s: expected the second lock to fail, but got %v", name, err)
+		}
+		l.Close()
+		l, err = fs.Lock(lock)
+		if err != nil {
+			t.Fatalf("%s: expected the lock to be released, but got %v", name, err)
+		}
+		l.Close()
+	}
+}
+
+func TestFaultFSCrash(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	fs.MkdirAll("db", 0755)
+	// a synced file in a synced directory survives, with its content up to the sync
+	f, _ := fs.Create("db/wal")
+	f.Write([]byte("synced"))
+	f.Sync()
+	fs.Sync("db")
+	f.Write([]byte(" lost"))
+	// a rename that was not synced is undone, the replaced file comes back
+	c, _ := fs.Create("db/CURRENT")
+	c.Write([]byte("old"))
+	c.Sync()
+	c.Close()
+	fs.Sync("db")
+	// a removal that was not synced is undone, with the content of the file up to its sync
+	for _, name := range []string{"db/old.sst", "db/dir/a", "db/sub/done"} {
+		fs.MkdirAll(filepath.Dir(name), 0755)
+		r, _ := fs.Create(name)
+		r.Write([]byte("kept"))
+		r.Sync()
+		r.Write([]byte(" lost"))
+		r.Close()
+		fs.Sync(filepath.Dir(name))
+	}
+	fs.Remove("db/old.sst")
+	fs.RemoveAll("db/dir")
+	// a synced removal stays, and the file created again in its place is lost
+	fs.Remove("db/sub/done")
+	fs.Sync("db/sub")
+	WriteFile(fs, "db/sub/done", []byte("again"))
+	// a file whose creation was not synced is lost
+	g, _ := fs.Create("db/new")
+	g.Write([]byte("data"))
+	g.Sync()
+	WriteFile(fs, "db/CURRENT.tmp", []byte("new"))
+	fs.Rename("db/CURRENT.tmp", "db/CURRENT")
+
+	if err := fs.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err != ErrCrashed {
+		t.Fatalf("Expected the open files to fail after the crash, but got %v", err)
+	}
+	f.Close()
+	if data, _ := ReadFile(fs, "db/wal"); string(data) != "synced" {
+		t.Fatalf("Expected the unsynced data to be dropped, but got %q", data)
+	}
+	if _, err := fs.Stat("db/new"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the unsynced creation to be undone, but got %v", err)
+	}
+	if data, _ := ReadFile(fs, "db/CURRENT"); string(data) != "old" {
+		t.Fatalf("Expected the unsynced rename to be undone, but got %q", data)
+	}
+	for _, name := range []string{"db/old.sst", "db/dir/a"} {
+		if data, err := ReadFile(fs, name); string(data) != "kept" {
+			t.Fatalf("Expected the unsynced removal of %s to be undone, but got %q (%v)", name, data, err)
+		}
+	}
+	if _, err := fs.Stat("db/sub/done"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the synced removal to stay, but got %v", err)
+	}
+}
+
+func TestFaultFSFaults(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	fs.SetSpace(4)
+	f, _ := fs.Create("a")
+	n, err := f.Write([]byte("hello"))
+	if n != 4 || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected a partial write and ENOSPC, but got %d %v", n, err)
+	}
+	fs.SetSpace(-1)
+	fs.SetFault(func(op, name string) error {
+		if op == "sync" {
+			return ErrInjected
+		}
+		return nil
+	})
+	if err := f.Sync(); err != ErrInjected {
+		t.Fatalf("Expected the injected fault, but got %v", err)
+	}
+	fs.SetFault(nil)
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetFault(func(op, name string) error {
+		if op == "shortwrite" {
+			return ErrInjected
+		}
+		return nil
+	})
+	if n, err := f.Write([]byte("abcdef")); n != 3 || err != ErrInjected {
+		t.Fatalf("Expected a short write of 3 bytes, but got %d %v", n, err)
+	}
+	fs.SetFault(nil)
+	if data, _ := ReadFile(fs, "a"); string(data) != "hellabc" {
+		t.Fatalf("Expected the first half of the short write, but got %q", data)
+	}
+}
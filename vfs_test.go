@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/um6p/kvstore/vfs"
+)
+
+func TestMemFSDatabase(t *testing.T) {
+	fs := vfs.NewMemFS()
+	db, err := OpenWithOptions("db", Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := db.CreateColumnFamily("users", FamilyOptions{Compression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxFiles+1; i++ {
+		db.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+		users.Put([]byte(fmt.Sprintf("u%02d", i)), []byte("u"))
+		if err := FlushToDisk(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Put([]byte("wal"), []byte("only"))
+	db.Close()
+
+	db, err = OpenWithOptions("db", Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, _ = db.ColumnFamily("users")
+	for i := 0; i < maxFiles+1; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("k%02d", i))); err != nil {
+			t.Fatalf("Expected k%02d, but got %v", i, err)
+		}
+		if _, err := users.Get([]byte(fmt.Sprintf("u%02d", i))); err != nil {
+			t.Fatalf("Expected u%02d, but got %v", i, err)
+		}
+	}
+	if value, err := db.Get([]byte("wal")); err != nil || string(value) != "only" {
+		t.Fatalf("Expected the wal to be replayed, but got %s (%v)", value, err)
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	db, err := OpenWithOptions("db", Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put([]byte("a"), []byte("1"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("b"), []byte("2"))
+	fs.SetSpace(10)
+	if err := FlushToDisk(db); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected the flush to fail with ENOSPC, but got %v", err)
+	}
+	fs.SetSpace(-1)
+	db.Put([]byte("c"), []byte("3"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatalf("Expected the flush to work once there is space, but got %v", err)
+	}
+	db.Close()
+
+	db, err = OpenWithOptions("db", Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := db.Get([]byte(key)); err != nil {
+			t.Fatalf("Expected %s after the disk was full, but got %v", key, err)
+		}
+	}
+	if stats := db.Stats(); stats[0].QuarantinedSSTables != 0 {
+		t.Fatalf("Expected no corrupt sstable, but got %+v", stats[0])
+	}
+	db.Close()
+
+	// a write that does not fit in the wal leaves nothing of it there, the next entries can be replayed
+	db, err = OpenWithOptions("wal", Options{FS: fs, SyncWAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("x"), []byte("1"))
+	fs.SetSpace(5)
+	if err := db.Put([]byte("lost"), []byte("2")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected the write to fail with ENOSPC, but got %v", err)
+	}
+	fs.SetSpace(-1)
+	if err := db.Put([]byte("y"), []byte("3")); err != nil {
+		t.Fatalf("Expected the write to work once there is space, but got %v", err)
+	}
+	// the crash keeps the tree from being flushed, the keys come from the wal
+	if err := fs.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = OpenWithOptions("wal", Options{FS: fs})
+	if err != nil {
+		t.Fatalf("Expected the wal to be replayed, but got %v", err)
+	}
+	for key, want := range map[string]string{"x": "1", "y": "3"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %s to be %s, but got %s (%v)", key, want, value, err)
+		}
+	}
+	if _, err := db.Get([]byte("lost")); err != ErrKeynotfound {
+		t.Fatalf("Expected the failed write to be absent, but got %v", err)
+	}
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"os"
-	"strings"
+	"sync"
 )
 
 type Entry struct {
 	Key     []byte
 	Value   []byte
 	Command Cmd
+	// ExpiresAt is the expiry time of a SetExpiring command in unix nanoseconds
+	ExpiresAt int64
+	// Family is the name of the column family of the key, empty for the default family
+	Family string
+	// Batch holds the entries of a Batch command
+	Batch []*Entry
 }
 
 type Cmd int
@@ -18,17 +25,39 @@ type Cmd int
 const (
 	Set Cmd = iota
 	Del
+	// Merge records a merge operand, the value holds the operator name and the operand.
+	Merge
+	// SetExpiring is a Set with a TTL, the value is preceded by the expiry time.
+	SetExpiring
+	// Batch groups entries that are replayed all together or not at all.
+	Batch
 )
 
+// familyFlag is set in the command of an entry that belongs to a column family other than
+// the default one, the name of the family then follows the command.
+const familyFlag = 0x100
+
 var (
 	// ErrClosed is returned when an operation cannot be completed because
 	// the wal is closed.
 	ErrClosed = errors.New("wal closed")
+	// ErrWalBroken is returned by the writes to the wal after a write that failed and whose part that
+	// reached the file could not be removed. The database must be opened again.
+	ErrWalBroken = errors.New("wal broken by a failed write")
 )
 
 type Wal struct {
 	file io.ReadWriteSeeker
 	name string
+	// torn is the offset of an incomplete entry at the end of the wal found by Read, -1 if there is none
+	torn int64
+	// sync syncs the file after every entry, so that an acknowledged write survives a crash of the machine
+	sync bool
+	// broken is set when a failed write could not be undone, the wal refuses the writes from then on
+	broken error
+	// tailMu serializes the calls of tail, which run under the read lock of the database: a checkpoint
+	// and a backup, or two of them, would otherwise move the offset of the file under each other
+	tailMu sync.Mutex
 }
 
 func (w *Wal) begin() error {
@@ -37,48 +66,198 @@ func (w *Wal) begin() error {
 }
 
 // appendCommand write to the wal the command that has been executed it first
-// stores the command (0 if Set and 1 if Del ) then the length of the key then the key
-// then the length of the value
+// stores the command (0 if Set, 1 if Del, 2 if Merge, 3 if SetExpiring and 4 if Batch)
+// then the length of the family name and the name if the entry is not in the default family,
+// then the length of the key then the key then the length of the value and the value.
+// For SetExpiring the value starts with the 8 bytes of the expiry time and for a Batch
+// it holds the number of entries followed by the entries.
+// The entry is written with a single write so that a batch reaches the wal as a whole.
 func (w *Wal) AppendCommand(e *Entry) error {
 	if w == nil {
 		return ErrClosed
 	}
+	entry, err := encodeEntry(e)
+	if err != nil {
+		return err
+	}
+	if err := w.write(entry); err != nil {
+		return err
+	}
+	if w.sync {
+		return w.Sync()
+	}
+	return nil
+}
+
+// write writes p at the current offset of the wal. A write that fails, a disk full for instance, may leave a
+// part of p in the file: the file is then cut back to its length before the write, so that the next entries
+// do not follow a broken one and a reopened wal can be read to the end. If the file cannot be cut the wal
+// is broken and refuses the next writes; its broken end is then the last entry, dropped as torn at the next Open.
+func (w *Wal) write(p []byte) error {
+	if w.broken != nil {
+		return w.broken
+	}
+	offset, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	n, err := w.file.Write(p)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		return nil
+	}
+	if f, ok := w.file.(interface{ Truncate(size int64) error }); ok && f.Truncate(offset) == nil {
+		if _, seekErr := w.file.Seek(offset, io.SeekStart); seekErr == nil {
+			return err
+		}
+	}
+	w.broken = fmt.Errorf("%w: %v", ErrWalBroken, err)
+	return err
+}
+
+// Sync syncs the file of the wal if it can be synced, so that the entries written so far survive a crash of the machine.
+func (w *Wal) Sync() error {
+	if w == nil {
+		return ErrClosed
+	}
+	if f, ok := w.file.(interface{ Sync() error }); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+func encodeEntry(e *Entry) ([]byte, error) {
 	if e == nil {
-		return errors.New("nil entry")
+		return nil, errors.New("nil entry")
+	}
+	if e.Command < Set || e.Command > Batch {
+		return nil, errors.New("invalid command")
 	}
-	if e.Command != Set && e.Command != Del {
-		return errors.New("invalid command")
+	value := []byte(e.Value)
+	switch e.Command {
+	case SetExpiring:
+		value = append(encodeInt64(e.ExpiresAt), value...)
+	case Batch:
+		value = encodeInt(len(e.Batch))
+		for _, sub := range e.Batch {
+			if sub.Command == Batch {
+				return nil, errors.New("nested batch")
+			}
+			encoded, err := encodeEntry(sub)
+			if err != nil {
+				return nil, err
+			}
+			value = append(value, encoded...)
+		}
 	}
-	if e.Key == nil {
-		return errors.New("nil key")
+	if e.Key == nil && e.Command != Batch {
+		return nil, errors.New("nil key")
 	}
 	//the value could be nil if the command is del
-	if e.Value == nil && e.Command == Set {
-		return errors.New("nil value")
+	if value == nil && e.Command != Del {
+		return nil, errors.New("nil value")
+	}
+	command := int(e.Command)
+	var family []byte
+	if e.Family != "" {
+		command |= familyFlag
+		family = append(encodeNum(len(e.Family)), e.Family...)
 	}
 	keyLen := len(e.Key)
-	valueLen := len(e.Value)
-	keyLenn := encodeInt(keyLen)
-	valueLenn := encodeInt(valueLen)
-	key := []byte(e.Key)
-	value := []byte(e.Value)
-	var command []byte
-	if e.Command == Set {
-		command = encodeNum(0)
-	} else {
-		command = encodeNum(1)
-	}
-	len := keyLen + valueLen + 10
-	entry := make([]byte, len)
-	copy(entry[0:2], command)
-	copy(entry[2:6], keyLenn)
-	copy(entry[6:keyLen+6], key)
-	copy(entry[keyLen+6:keyLen+10], valueLenn)
-	copy(entry[keyLen+10:keyLen+valueLen+10], value)
-	if _, err := w.file.Write(entry); err != nil {
-		return err
+	valueLen := len(value)
+	entry := make([]byte, 0, len(family)+keyLen+valueLen+10)
+	entry = append(entry, encodeNum(command)...)
+	entry = append(entry, family...)
+	entry = append(entry, encodeInt(keyLen)...)
+	entry = append(entry, e.Key...)
+	entry = append(entry, encodeInt(valueLen)...)
+	entry = append(entry, value...)
+	return entry, nil
+}
+
+// readEntry reads an entry written by appendCommand. An entry cut short by the end of the
+// wal is reported as io.ErrUnexpectedEOF.
+func readEntry(r io.Reader) (*Entry, error) {
+	// Read command
+	var encodedCommandByte [2]byte
+	if _, err := io.ReadFull(r, encodedCommandByte[:]); err != nil {
+		return nil, err
 	}
-	return nil
+	commandByte := decodeNum(encodedCommandByte[:])
+	command := Cmd(commandByte &^ familyFlag)
+	if command < Set || command > Batch {
+		return nil, errors.New("invalid command")
+	}
+	e := &Entry{Command: command}
+	// Read family
+	if commandByte&familyFlag != 0 {
+		var familyLen [2]byte
+		if _, err := io.ReadFull(r, familyLen[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		family := make([]byte, decodeNum(familyLen[:]))
+		if _, err := io.ReadFull(r, family); err != nil {
+			return nil, unexpected(err)
+		}
+		e.Family = string(family)
+	}
+	// Read key length
+	var encodedKeyLen [4]byte
+	if _, err := io.ReadFull(r, encodedKeyLen[:]); err != nil {
+		return nil, unexpected(err)
+	}
+	keyLen := decodeInt(encodedKeyLen[:])
+	// Read key
+	key, err := readN(r, keyLen)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	// Read value length
+	var encodedValueLength [4]byte
+	if _, err := io.ReadFull(r, encodedValueLength[:]); err != nil {
+		return nil, unexpected(err)
+	}
+	valueLen := decodeInt(encodedValueLength[:])
+	// Read value
+	value, err := readN(r, valueLen)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	e.Key = key
+	e.Value = value
+	switch command {
+	case SetExpiring:
+		if len(value) < 8 {
+			return nil, errors.New("invalid expiring entry")
+		}
+		e.ExpiresAt = decodeInt64(value[:8])
+		e.Value = value[8:]
+	case Batch:
+		if len(value) < 4 {
+			return nil, errors.New("invalid batch entry")
+		}
+		sub := bytes.NewReader(value[4:])
+		for i := decodeInt(value[:4]); i > 0; i-- {
+			be, err := readEntry(sub)
+			if err != nil {
+				// the batch was written as a whole, a short batch is corrupt rather than torn
+				return nil, errors.New("invalid batch entry")
+			}
+			e.Batch = append(e.Batch, be)
+		}
+		e.Value = nil
+	}
+	return e, nil
+}
+
+// unexpected turns the end of the wal in the middle of an entry into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 // creating a new wal
@@ -86,144 +265,250 @@ func NewWal(f io.ReadWriteSeeker, name string) *Wal {
 	return &Wal{
 		file: f,
 		name: name,
+		torn: -1,
 	}
 }
 
 // After each flush to the disk, instead of creating a new WAL, we choose to delete the content of the WAL
 // using truncate, which reduces the size of the file, we should check if it's available for the WAL.
+// size returns the offset of the end of the wal, where the next entry is written.
+func (w *Wal) size() (int64, error) {
+	if w == nil {
+		return 0, ErrClosed
+	}
+	return w.file.Seek(0, io.SeekEnd)
+}
+
 func (w *Wal) WaterMark() error {
 	_, err := w.file.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
-	watermark := []byte("WATERMARK")
-	if _, err := w.file.Write(watermark); err != nil {
-		return err
-	}
-	return nil
+	return w.write(walWatermark)
 }
 
 // Read function will loop and  read firstly the command and encoded if its the EOF then
 // it will break if it not it will try and read it and associated to the specific command
-// then it will read the key length, the key, the value length and the value
+// then it will read the key length, the key, the value length and the value.
+// Only the entries after the last watermark are returned, the others are in the SSTables.
+// An entry cut short at the end of the wal is left out and its offset is kept in torn.
 func (w *Wal) Read() ([]*Entry, error) {
+	entries, _, err := w.read()
+	return entries, err
+}
 
+// read is Read that also returns the offset of each entry in the wal.
+func (w *Wal) read() ([]*Entry, []int64, error) {
 	if w == nil {
-		return nil, ErrClosed
+		return nil, nil, ErrClosed
 	}
 	var entries []*Entry
+	var offsets []int64
 	err := w.begin()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	//find the last watermark
-	lastWatermarkPos, err := w.findLastWatermarkPosition()
-
-	if lastWatermarkPos >= 0 {
-		if err != nil {
-			return nil, err
-		}
-		// Seek to the position after the last watermark
-		_, err = w.file.Seek(lastWatermarkPos+int64(watermarkSize), io.SeekStart)
-		if err != nil {
-			return nil, err
-		}
+	data, err := io.ReadAll(w.file)
+	if err != nil {
+		return nil, nil, err
 	}
-
+	start := lastWatermarkEnd(data)
+	r := bytes.NewReader(data[start:])
+	w.torn = -1
 	for {
-		// Read command
-		var encodedCommandByte [2]byte
-		if _, err := w.file.Read(encodedCommandByte[:]); err == io.EOF {
+		pos := start + int64(len(data[start:])-r.Len())
+		// a watermark cut short by a crash is torn like an entry, "WA" is not a command
+		if rest := data[pos:]; len(rest) > 0 && len(rest) < len(walWatermark) && bytes.HasPrefix(walWatermark, rest) {
+			w.torn = pos
 			break
-		} else if err != nil {
-			return nil, err
-		}
-		commandByte := decodeNum(encodedCommandByte[:])
-		command := Cmd(commandByte)
-		// Read key length
-		var encodedKeyLen [4]byte
-		if _, err := w.file.Read(encodedKeyLen[:]); err != nil {
-			return nil, err
 		}
-		keyLen := decodeInt(encodedKeyLen[:])
-		// Read key
-		key := make([]byte, keyLen)
-		if _, err := w.file.Read(key); err != nil {
-			return nil, err
-		}
-		// Read value length
-		var encodedValueLength [4]byte
-		if _, err := w.file.Read(encodedValueLength[:]); err != nil {
-			return nil, err
+		e, err := readEntry(r)
+		if err == io.EOF {
+			break
 		}
-		valueLen := decodeInt(encodedValueLength[:])
-		// Read value
-		value := make([]byte, valueLen)
-		if _, err := w.file.Read(value); err != nil {
-			return nil, err
+		// the last entry was cut short by a crash while it was written, it was never acknowledged
+		if err == io.ErrUnexpectedEOF {
+			w.torn = pos
+			break
 		}
-		e := &Entry{
-			Command: command,
-			Key:     key,
-			Value:   value,
+		if err != nil {
+			return nil, nil, err
 		}
-
 		entries = append(entries, e)
+		offsets = append(offsets, pos)
 	}
 
-	return entries, nil
+	return entries, offsets, nil
 }
 
-// we search for the last WaterMark written in the wal
-// A potential issue arises if someone uses "WATERMARK" as a value or key, as this could lead
-// to an incorrect position detection.
-func (w *Wal) findLastWatermarkPosition() (int64, error) {
-	var pos int64 = -1
-
-	buffer := make([]byte, watermarkSize)
-
-	// Get the size of the file
-	fileInfo, err := os.Stat(w.name)
+// tail returns the content of the wal after its last watermark, the entries that are not in the SSTables yet.
+// flushed are the offsets of the manifest, the entries of a family before its offset are left out as well.
+func (w *Wal) tail(flushed map[string]int64) ([]byte, error) {
+	if w == nil {
+		return nil, ErrClosed
+	}
+	w.tailMu.Lock()
+	defer w.tailMu.Unlock()
+	if err := w.begin(); err != nil {
+		return nil, err
+	}
+	// the offset is left at the end of the wal, where the next entry is written
+	data, err := io.ReadAll(w.file)
 	if err != nil {
-		return pos, err
+		return nil, err
 	}
-	fileSize := fileInfo.Size()
-
-	// Start reading from the end of the file
-	for offset := int64(0); offset <= fileSize-watermarkSize; offset++ {
-		_, err := w.file.Seek(fileSize-offset-watermarkSize, io.SeekStart)
-		if err != nil {
-			return 0, err
+	start := lastWatermarkEnd(data)
+	skip := false
+	for _, offset := range flushed {
+		if offset > start {
+			skip = true
+		}
+	}
+	if !skip {
+		return data[start:], nil
+	}
+	// a flush was interrupted before its watermark, the entries that are left are encoded again
+	var res []byte
+	for _, rec := range scanWal(data[start:]).records {
+		if rec.watermark {
+			continue
 		}
-		_, err = w.file.Read(buffer)
+		e := unflushed(rec.entry, start+rec.offset, flushed)
+		if e == nil {
+			continue
+		}
+		buf, err := encodeEntry(e)
 		if err != nil {
-			return pos, err
+			return nil, err
 		}
+		res = append(res, buf...)
+	}
+	return res, nil
+}
 
-		// Check if the current buffer contains the watermark
-		if strings.EqualFold(string(buffer), "WATERMARK") { // Change "mark" to your actual watermark
-			pos = fileSize - offset - watermarkSize
-			break
+// lastWatermarkEnd returns the offset that follows the last watermark of the wal, 0 if there is none.
+// The records are walked from the start of the wal, so a watermark is only recognized where a record
+// begins and a key or a value that holds the bytes of one is not taken for it.
+func lastWatermarkEnd(data []byte) int64 {
+	var end int64
+	for _, rec := range scanWal(data).records {
+		if rec.watermark {
+			end = rec.offset + int64(len(walWatermark))
 		}
 	}
-
-	return pos, nil
+	return end
 }
 
 // In case of a crash, we use this function to redo the previous commands that were recorded
 // before the crash but weren't uploaded to the SSTables.
+// Only the entries of the default family are replayed into the tree.
 func Recover(w *Wal, t *Tree) error {
-	entries, err := w.Read()
+	return replay(w, map[string]*Tree{"": t}, nil)
+}
+
+// replay redoes the commands of the wal into the tree of their family. The entries of families
+// that are not in trees were written before the family was dropped and are skipped. flushed are
+// the offsets of the wal recorded in the manifest, the entries of a family before its offset are
+// in its SSTables already and are skipped too.
+func replay(w *Wal, trees map[string]*Tree, flushed map[string]int64) error {
+	entries, offsets, err := w.read()
 	if err != nil {
 		return err
 	}
-	for _, entry := range entries {
-		switch entry.Command {
-		case Set:
-			t.Set(entry.Key, entry.Value)
-		case Del:
-			t.Del(entry.Key)
+	for i, entry := range entries {
+		entry = unflushed(entry, offsets[i], flushed)
+		if entry == nil {
+			continue
+		}
+		if err := redo(entry, trees); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unflushed returns the entry at the offset of the wal without the entries of the families whose
+// offset in flushed is after it, nil if nothing is left. A batch keeps the entries of the other families.
+func unflushed(e *Entry, offset int64, flushed map[string]int64) *Entry {
+	if e.Command == Batch {
+		var batch []*Entry
+		for _, sub := range e.Batch {
+			if unflushed(sub, offset, flushed) != nil {
+				batch = append(batch, sub)
+			}
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if len(batch) < len(e.Batch) {
+			return &Entry{Command: Batch, Batch: batch}
+		}
+		return e
+	}
+	family := e.Family
+	if family == "" {
+		family = defaultFamily
+	}
+	if offset < flushed[family] {
+		return nil
+	}
+	return e
+}
+
+func redo(entry *Entry, trees map[string]*Tree) error {
+	if entry.Command == Batch {
+		for _, e := range entry.Batch {
+			if err := redo(e, trees); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	t, ok := trees[entry.Family]
+	if !ok {
+		return nil
+	}
+	switch entry.Command {
+	case Set:
+		t.Set(entry.Key, entry.Value)
+	case SetExpiring:
+		t.SetExpiring(entry.Key, entry.Value, entry.ExpiresAt)
+	case Del:
+		// a key that is only in the SSTables still needs a deleted node to hide it
+		if err := t.Del(entry.Key); err == ErrKeynotfound {
+			t.SetDeletedKey(entry.Key, nil)
 		}
+	case Merge:
+		op, err := decodeOperand(bytes.NewReader(entry.Value))
+		if err != nil {
+			return err
+		}
+		t.Merge(entry.Key, op)
+	}
+	return nil
+}
+
+// truncateTorn removes the incomplete entry found at the end of the wal by Read, so that
+// the next entries are not written after it. It does nothing if the file cannot be truncated.
+func (w *Wal) truncateTorn() error {
+	if w.torn < 0 {
+		return nil
+	}
+	f, ok := w.file.(interface{ Truncate(size int64) error })
+	if !ok {
+		return nil
+	}
+	if err := f.Truncate(w.torn); err != nil {
+		return err
+	}
+	w.torn = -1
+	return nil
+}
+
+// Close closes the file of the wal if it can be closed.
+func (w *Wal) Close() error {
+	if c, ok := w.file.(io.Closer); ok {
+		return c.Close()
 	}
 	return nil
 }
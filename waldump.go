@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The waldump command prints the records of a wal, without opening the database:
+//
+//	kvstore waldump [-values] [-replay DIR] [-unflushed] FILE
+//
+// The records are decoded with the framing of Wal.Read. Every record is printed with its offset, command,
+// family, key and value length, and so are the watermarks. A torn record at the end of the file and corrupt
+// records are flagged; after a corrupt record the dump resumes at the next watermark.
+// With -replay the records are applied to a new database in DIR, the column families they name being
+// created with the default options. -unflushed limits the replay to the records after the last watermark,
+// the ones that were not flushed to the SSTables yet.
+
+// errWalDamaged is returned by waldump when the wal holds corrupt records.
+var errWalDamaged = errors.New("waldump: corrupt records in the wal")
+
+var walWatermark = []byte("WATERMARK")
+
+// walRecord is a record of the wal with its offset, either an entry or a watermark.
+type walRecord struct {
+	offset    int64
+	entry     *Entry
+	watermark bool
+}
+
+// walScan is the result of the decoding of a whole wal.
+type walScan struct {
+	records []walRecord
+	// torn is the offset of a record cut short at the end of the wal, -1 if there is none
+	torn int64
+	// corrupt are the ranges [start, end) of the bytes that could not be decoded
+	corrupt [][2]int64
+	errs    []error
+}
+
+// scanWal decodes every record of the wal, unlike Wal.Read which starts after the last watermark.
+func scanWal(data []byte) *walScan {
+	s := &walScan{torn: -1}
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		pos := int64(len(data) - r.Len())
+		if bytes.HasPrefix(data[pos:], walWatermark) {
+			s.records = append(s.records, walRecord{offset: pos, watermark: true})
+			r.Seek(int64(len(walWatermark)), io.SeekCurrent)
+			continue
+		}
+		e, err := readEntry(r)
+		if err == io.ErrUnexpectedEOF {
+			s.torn = pos
+			break
+		}
+		if err != nil {
+			// the length of the record is unknown, the next record that can be found is a watermark
+			next := bytes.Index(data[pos+1:], walWatermark)
+			end := int64(len(data))
+			if next >= 0 {
+				end = pos + 1 + int64(next)
+			}
+			s.corrupt = append(s.corrupt, [2]int64{pos, end})
+			s.errs = append(s.errs, err)
+			r.Seek(end, io.SeekStart)
+			continue
+		}
+		s.records = append(s.records, walRecord{offset: pos, entry: e})
+	}
+	return s
+}
+
+func waldump(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("waldump", flag.ContinueOnError)
+	values := fs.Bool("values", false, "print the values of the records")
+	replayDir := fs.String("replay", "", "directory of a new database to replay the records into")
+	unflushed := fs.Bool("unflushed", false, "replay only the records after the last watermark")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: kvstore waldump [-values] [-replay DIR] [-unflushed] FILE")
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	s := scanWal(data)
+	commands := map[string]int{}
+	watermarks := 0
+	lastWatermark := -1
+	corrupt := 0
+	for i, rec := range s.records {
+		// the corrupt ranges are printed in the order of the offsets
+		for corrupt < len(s.corrupt) && s.corrupt[corrupt][0] < rec.offset {
+			printCorrupt(out, s, corrupt)
+			corrupt++
+		}
+		if rec.watermark {
+			fmt.Fprintf(out, "%8d  WATERMARK\n", rec.offset)
+			watermarks++
+			lastWatermark = i
+			continue
+		}
+		fmt.Fprintf(out, "%8d  ", rec.offset)
+		printEntry(out, rec.entry, *values)
+		commands[commandName(rec.entry.Command)]++
+		for _, sub := range rec.entry.Batch {
+			fmt.Fprintf(out, "%8s    ", "")
+			printEntry(out, sub, *values)
+		}
+	}
+	for ; corrupt < len(s.corrupt); corrupt++ {
+		printCorrupt(out, s, corrupt)
+	}
+	if s.torn >= 0 {
+		fmt.Fprintf(out, "%8d  torn record, %d bytes until the end of the wal\n", s.torn, int64(len(data))-s.torn)
+	}
+	fmt.Fprintf(out, "records: %d (set %d, ttl %d, merge %d, del %d, batch %d), watermarks: %d, unflushed records: %d\n",
+		len(s.records)-watermarks, commands["set"], commands["ttl"], commands["merge"], commands["del"], commands["batch"],
+		watermarks, len(s.records)-lastWatermark-1)
+
+	if *replayDir != "" {
+		records := s.records
+		if *unflushed {
+			records = records[lastWatermark+1:]
+		}
+		n, err := replayInto(*replayDir, records)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "replayed %d records into %s\n", n, *replayDir)
+	}
+	if len(s.corrupt) > 0 {
+		return errWalDamaged
+	}
+	return nil
+}
+
+func printCorrupt(out io.Writer, s *walScan, i int) {
+	c := s.corrupt[i]
+	fmt.Fprintf(out, "%8d  corrupt record (%v), %d bytes skipped\n", c[0], s.errs[i], c[1]-c[0])
+}
+
+func commandName(c Cmd) string {
+	switch c {
+	case Set:
+		return "set"
+	case Del:
+		return "del"
+	case Merge:
+		return "merge"
+	case SetExpiring:
+		return "ttl"
+	case Batch:
+		return "batch"
+	}
+	return fmt.Sprintf("command %d", c)
+}
+
+func printEntry(out io.Writer, e *Entry, values bool) {
+	fmt.Fprintf(out, "%-5s", commandName(e.Command))
+	if e.Family != "" {
+		fmt.Fprintf(out, " family %s", e.Family)
+	}
+	if e.Command == Batch {
+		fmt.Fprintf(out, " %d entries\n", len(e.Batch))
+		return
+	}
+	fmt.Fprintf(out, " key %q", e.Key)
+	if e.Command != Del {
+		fmt.Fprintf(out, " value %d bytes", len(e.Value))
+	}
+	if e.Command == SetExpiring {
+		fmt.Fprintf(out, " expires %s", time.Unix(0, e.ExpiresAt).UTC().Format(time.RFC3339))
+	}
+	if values && e.Command != Del {
+		if e.Command == Merge {
+			if op, err := decodeOperand(bytes.NewReader(e.Value)); err == nil {
+				fmt.Fprintf(out, " %s(%q)", op.name, op.value)
+			}
+		} else {
+			fmt.Fprintf(out, " %q", e.Value)
+		}
+	}
+	fmt.Fprintln(out)
+}
+
+// replayInto applies the entries of the records to a new database in dir and returns the number of
+// entries applied. The column families named by the entries are created with the default options.
+func replayInto(dir string, records []walRecord) (int, error) {
+	if info, err := os.Stat(filepath.Join(dir, "wal.log")); err == nil && info.Size() > 0 {
+		return 0, fmt.Errorf("waldump: %s already holds a database", dir)
+	}
+	db, err := Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	n := 0
+	for _, rec := range records {
+		if rec.watermark {
+			continue
+		}
+		for _, e := range append([]*Entry{rec.entry}, rec.entry.Batch...) {
+			if e.Family == "" || e.Command == Batch {
+				continue
+			}
+			if _, err := db.ColumnFamily(e.Family); err == ErrFamilyNotFound {
+				if _, err := db.CreateColumnFamily(e.Family, FamilyOptions{}); err != nil {
+					return n, err
+				}
+			}
+		}
+		if err := db.applyEntry(rec.entry); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// applyEntry adds an entry of the wal of another database to the wal and redoes it in the trees.
+func (db *DB) applyEntry(e *Entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.wal.AppendCommand(e); err != nil {
+		return err
+	}
+	if err := redo(e, db.trees()); err != nil {
+		return err
+	}
+	return db.maybeFlush()
+}
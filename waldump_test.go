@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWalDump(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	users, err := db.CreateColumnFamily("users", FamilyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("a"), []byte("1"))
+	users.Put([]byte("u"), []byte("2"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	db.PutWithTTL([]byte("t"), []byte("3"), time.Hour)
+	db.Merge([]byte("n"), "add", []byte("4"))
+	batch := &WriteBatch{}
+	batch.Put("users", []byte("v"), []byte("5"))
+	batch.Delete("", []byte("a"))
+	db.Write(batch)
+	db.Close()
+
+	name := filepath.Join(dir, "wal.log")
+	data, _ := os.ReadFile(name)
+	var out bytes.Buffer
+	replay := filepath.Join(t.TempDir(), "replay")
+	if err := waldump([]string{"-values", "-replay", replay, name}, &out); err != nil {
+		t.Fatalf("Expected a sound wal, but got %v\n%s", err, out.String())
+	}
+	for _, want := range []string{
+		`set   key "a" value 1 bytes "1"`, `set   family users key "u"`, "WATERMARK", `ttl   key "t"`,
+		`merge key "n" value 10 bytes add("4")`, "batch 2 entries", `del   key "a"`,
+		"records: 5 (set 2, ttl 1, merge 1, del 0, batch 1), watermarks: 1, unflushed records: 3",
+		"replayed 5 records",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("Expected %q in the output:\n%s", want, out.String())
+		}
+	}
+	// the replayed database holds all the records, including the ones that were flushed
+	copyDB, err := Open(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copyDB.Close()
+	copyUsers, err := copyDB.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		store      Store
+		key, value string
+	}{{copyDB, "t", "3"}, {copyDB, "n", "4"}, {copyUsers, "u", "2"}, {copyUsers, "v", "5"}} {
+		if value, err := c.store.Get([]byte(c.key)); err != nil || string(value) != c.value {
+			t.Fatalf("Expected value %s for %s, but got %s (%v)", c.value, c.key, value, err)
+		}
+	}
+	if _, err := copyDB.Get([]byte("a")); err != ErrKeynotfound {
+		t.Fatalf("Expected a to be deleted, but got %v", err)
+	}
+	if err := waldump([]string{"-replay", replay, name}, &out); err == nil {
+		t.Fatal("Expected an error when replaying into an existing database")
+	}
+
+	// a corrupt record is skipped up to the next watermark and a torn record is flagged
+	damaged := append([]byte{0xff, 0xff, 1, 2, 3}, data...)
+	damaged = append(damaged, data[:7]...)
+	os.WriteFile(name, damaged, 0644)
+	out.Reset()
+	if err := waldump([]string{name}, &out); err != errWalDamaged {
+		t.Fatalf("Expected errWalDamaged, but got %v", err)
+	}
+	for _, want := range []string{"0  corrupt record (invalid command)", "torn record, 7 bytes", "unflushed records: 3"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("Expected %q in the output:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestWalWatermarkBytes(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	db.Put([]byte("flushed"), []byte("1"))
+	if err := FlushToDisk(db); err != nil {
+		t.Fatal(err)
+	}
+	// keys and values are bytes, they may hold those of a watermark
+	db.Put([]byte("WATERMARK"), []byte("a value with a watermark and a WATERMARK"))
+	db.Put([]byte("after"), []byte("2"))
+	db.Close()
+	// a watermark cut short by a crash is torn
+	f, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("WATER"))
+	f.Close()
+
+	db = openTestDB(t, dir)
+	for key, want := range map[string]string{"flushed": "1", "WATERMARK": "a value with a watermark and a WATERMARK", "after": "2"} {
+		if value, err := db.Get([]byte(key)); err != nil || string(value) != want {
+			t.Fatalf("Expected %q for %s, but got %q (%v)", want, key, value, err)
+		}
+	}
+}